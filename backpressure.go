@@ -0,0 +1,63 @@
+package waffle
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync/atomic"
+)
+
+// ErrSaturated is returned by TrySend when actions of the event were dropped because the
+// engine or the actions were saturated: their concurrency limits were reached, the workers
+// stayed busy, their queue was full or they were throttled or rate limited.
+var ErrSaturated = errors.New("engine is saturated")
+
+// WithBackpressure makes Send wait, on the sending goroutine, for the concurrency slots of
+// the actions and for a worker instead of dropping the actions, until the context is done.
+// Senders waiting for the slots of a key get them in arrival order, ahead of later sends.
+// Actions queued with QueueWhenLimited are still queued. Producers sending with it are
+// slowed down to the pace the actions keep up with.
+func WithBackpressure() SendOption {
+	return func(opts *sendOptions) {
+		opts.backpressure = true
+	}
+}
+
+// TrySend sends an event like Send and returns ErrSaturated if any of the actions it
+// triggered was dropped for saturation, so that producers can slow down instead of losing
+// events silently. It returns ErrShutdown once the engine is shutting down, and nil
+// otherwise, including when no action is registered for the event. Actions spawned later,
+// like delayed, debounced or batched ones, aren't reported.
+func (e *Engine) TrySend(ctx context.Context, eventKey EventKey, data any, opts ...SendOption) error {
+	if e.rejectShutdown(ctx, eventKey) {
+		return ErrShutdown
+	}
+
+	saturated := &atomic.Bool{}
+	e.Send(ctx, eventKey, data, append(slices.Clip(opts), func(opts *sendOptions) {
+		opts.saturated = saturated
+	})...)
+
+	if saturated.Load() {
+		return ErrSaturated
+	}
+
+	return nil
+}
+
+// markSaturated records that an action of the dispatch was dropped for saturation.
+func (o sendOptions) markSaturated() {
+	if o.saturated != nil {
+		o.saturated.Store(true)
+	}
+}
+
+// acquireSlots acquires the concurrency slots of the action, waiting in their wait queues
+// or, when blocking, in arrival order until the context is done.
+func (e *Engine) acquireSlots(ctx context.Context, groups *ConcurrencyGroups, data any, block bool) (bool, []string, func(), error) {
+	if block {
+		return groups.acquire(ctx, data, acquireBlocking)
+	}
+
+	return groups.acquire(ctx, data, acquireQueued)
+}
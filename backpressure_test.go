@@ -0,0 +1,150 @@
+package waffle_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_TrySend(t *testing.T) {
+	t.Run("saturated", func(t *testing.T) {
+		engine := waffle.NewEngine(waffle.NewTestOperationLogger())
+
+		block := make(chan struct{})
+		defer close(block)
+		err := engine.On("event").Concurrency(1).Do("slow", func(_ context.Context, _ any) error {
+			<-block
+			return nil
+		})
+		require.NoError(t, err)
+
+		require.NoError(t, engine.TrySend(t.Context(), "event", nil))
+		require.ErrorIs(t, engine.TrySend(t.Context(), "event", nil), waffle.ErrSaturated)
+		require.Equal(t, 1, engine.DropReasons()[waffle.DropReasonConcurrencyLimit])
+	})
+
+	t.Run("no handler", func(t *testing.T) {
+		engine := waffle.NewEngine(waffle.NewTestOperationLogger())
+		require.NoError(t, engine.TrySend(t.Context(), "event", nil))
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		engine := waffle.NewEngine(waffle.NewTestOperationLogger())
+		require.NoError(t, engine.Shutdown(t.Context()))
+		require.ErrorIs(t, engine.TrySend(t.Context(), "event", nil), waffle.ErrShutdown)
+	})
+}
+
+func TestEngine_WithBackpressure(t *testing.T) {
+	t.Run("waits for slots", func(t *testing.T) {
+		engine := waffle.NewEngine(waffle.NewTestOperationLogger())
+
+		ran := make(chan struct{}, 2)
+		err := engine.On("event").Concurrency(1).Do("slow", func(_ context.Context, _ any) error {
+			time.Sleep(20 * time.Millisecond)
+			ran <- struct{}{}
+			return nil
+		})
+		require.NoError(t, err)
+
+		// The second send waits for the first action to free its slot
+		require.NoError(t, engine.TrySend(t.Context(), "event", nil, waffle.WithBackpressure()))
+		require.NoError(t, engine.TrySend(t.Context(), "event", nil, waffle.WithBackpressure()))
+
+		for range 2 {
+			select {
+			case <-ran:
+			case <-time.After(time.Second):
+				t.Fatal("action was not run")
+			}
+		}
+		require.Zero(t, engine.DropReasons()[waffle.DropReasonConcurrencyLimit])
+	})
+
+	t.Run("waits for workers", func(t *testing.T) {
+		engine := waffle.NewEngine(waffle.NewTestOperationLogger(), waffle.WithWorkerCap(1, 0))
+
+		ran := make(chan struct{}, 2)
+		err := engine.On("event").Do("slow", func(_ context.Context, _ any) error {
+			time.Sleep(20 * time.Millisecond)
+			ran <- struct{}{}
+			return nil
+		})
+		require.NoError(t, err)
+
+		require.True(t, engine.Send(t.Context(), "event", nil, waffle.WithBackpressure()))
+		require.True(t, engine.Send(t.Context(), "event", nil, waffle.WithBackpressure()))
+
+		for range 2 {
+			select {
+			case <-ran:
+			case <-time.After(time.Second):
+				t.Fatal("action was not run")
+			}
+		}
+		require.Zero(t, engine.DropReasons()[waffle.DropReasonWorkerSaturated])
+	})
+
+	t.Run("context done", func(t *testing.T) {
+		engine := waffle.NewEngine(waffle.NewTestOperationLogger())
+
+		block := make(chan struct{})
+		defer close(block)
+		err := engine.On("event").Concurrency(1).Do("slow", func(_ context.Context, _ any) error {
+			<-block
+			return nil
+		})
+		require.NoError(t, err)
+
+		require.NoError(t, engine.TrySend(t.Context(), "event", nil, waffle.WithBackpressure()))
+
+		ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, engine.TrySend(ctx, "event", nil, waffle.WithBackpressure()), waffle.ErrSaturated)
+		require.Equal(t, 1, engine.DropReasons()[waffle.DropReasonConcurrencyLimit])
+	})
+}
+
+func TestEngine_WithBackpressure_ArrivalOrder(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	global := waffle.NewConcurrencyLimit(1, nil)
+	groups := waffle.NewConcurrencyGroups()
+	groups.AddLimit("", global)
+
+	started := make(chan int, 4)
+	step := make(chan struct{})
+	err := engine.AddActionConfiguration(waffle.ActionConfiguration{
+		EventKeys:         []waffle.EventKey{"event"},
+		ActionKey:         "work",
+		ConcurrencyGroups: groups,
+		Action: func(_ context.Context, data any) error {
+			started <- data.(int)
+			<-step
+			return nil
+		},
+	})
+	require.NoError(t, err)
+
+	require.True(t, engine.Send(t.Context(), "event", 0))
+	require.Equal(t, 0, <-started)
+
+	for i := 1; i <= 3; i++ {
+		go engine.Send(t.Context(), "event", i, waffle.WithBackpressure())
+		require.Eventually(t, func() bool {
+			return global.Waiting() == uint(i)
+		}, time.Second, time.Millisecond)
+	}
+
+	// Senders that don't wait can't take the slot from the waiting ones
+	require.ErrorIs(t, engine.TrySend(t.Context(), "event", 4), waffle.ErrSaturated)
+
+	for i := 1; i <= 3; i++ {
+		step <- struct{}{}
+		require.Equal(t, i, <-started)
+	}
+	close(step)
+}
@@ -0,0 +1,114 @@
+package waffle
+
+import (
+	"context"
+	"strconv"
+	"sync"
+)
+
+// batchMembersKey is the context key holding the dispatches of the events in a batch.
+type batchMembersKey struct{}
+
+// pendingBatch accumulates the events of a batched action until it is flushed.
+type pendingBatch struct {
+	// ctxs are the dispatch contexts of the events, settled with the batch run
+	ctxs     []context.Context
+	data     []any
+	eventKey EventKey
+	opts     sendOptions
+	timer    Timer
+}
+
+// batcher holds the pending batch of each batched action.
+type batcher struct {
+	pending map[ActionKey]*pendingBatch
+	mu      sync.Mutex
+}
+
+// addToBatch adds the event to the pending batch of the action, flushing it once it is
+// full. The first event of a batch starts the timer flushing it after BatchWait.
+func (e *Engine) addToBatch(ctx context.Context, configuration ActionConfiguration, data any, eventKey EventKey, opts sendOptions) {
+	actionKey := configuration.ActionKey
+
+	e.batcher.mu.Lock()
+	if e.batcher.pending == nil {
+		e.batcher.pending = make(map[ActionKey]*pendingBatch)
+	}
+
+	batch, ok := e.batcher.pending[actionKey]
+	if !ok {
+		batch = &pendingBatch{eventKey: eventKey, opts: opts}
+		e.batcher.pending[actionKey] = batch
+		if configuration.BatchWait > 0 {
+			batch.timer = e.clock.AfterFunc(configuration.BatchWait, func() {
+				e.flushBatch(actionKey, batch)
+			})
+		}
+	}
+	batch.ctxs = append(batch.ctxs, ctx)
+	batch.data = append(batch.data, data)
+	full := len(batch.data) >= configuration.BatchSize
+	e.batcher.mu.Unlock()
+
+	if full {
+		e.flushBatch(actionKey, batch)
+	}
+}
+
+// flushBatch spawns the action with the data of the batch, unless it was already
+// flushed. The run settles the dispatches of all the events in the batch.
+func (e *Engine) flushBatch(actionKey ActionKey, batch *pendingBatch) {
+	e.batcher.mu.Lock()
+	if e.batcher.pending[actionKey] != batch {
+		e.batcher.mu.Unlock()
+		return
+	}
+	delete(e.batcher.pending, actionKey)
+	e.batcher.mu.Unlock()
+
+	if batch.timer != nil {
+		batch.timer.Stop()
+	}
+
+	// The batch run belongs to no single dispatch, its outcome settles all of them
+	ctx := context.WithoutCancel(batch.ctxs[0])
+	ctx = context.WithValue(ctx, storedDispatchKey{}, (*storedDispatch)(nil))
+	ctx = context.WithValue(ctx, dedupDispatchKey{}, (*dedupDispatch)(nil))
+	ctx = withSendHandle(ctx, nil)
+	ctx = withFanOut(ctx, nil)
+	ctx = context.WithValue(ctx, batchMembersKey{}, batch.ctxs)
+
+	// Log batch flushed
+	e.logOperation(ctx, "waffle.action.batch_flushed", map[string]string{
+		"actionKey": string(actionKey),
+		"eventKey":  string(batch.eventKey),
+		"size":      strconv.Itoa(len(batch.data)),
+	})
+
+	opts := batch.opts
+	opts.batched = true
+	e.spawnAction(ctx, actionKey, batch.data, batch.eventKey, 0, opts)
+}
+
+// flushBatches flushes the pending batches of all the actions.
+func (e *Engine) flushBatches() {
+	e.batcher.mu.Lock()
+	pending := make(map[ActionKey]*pendingBatch, len(e.batcher.pending))
+	for actionKey, batch := range e.batcher.pending {
+		pending[actionKey] = batch
+	}
+	e.batcher.mu.Unlock()
+
+	for actionKey, batch := range pending {
+		e.flushBatch(actionKey, batch)
+	}
+}
+
+// settleBatchMembers settles the dispatches of the events in the batch the context
+// belongs to, if any, with the result of the batch run.
+func (e *Engine) settleBatchMembers(ctx context.Context, result ActionResult) {
+	members, _ := ctx.Value(batchMembersKey{}).([]context.Context)
+	for _, member := range members {
+		e.settleDispatch(member, result)
+	}
+}
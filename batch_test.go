@@ -0,0 +1,85 @@
+package waffle_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_Batch(t *testing.T) {
+	clock := waffle.NewTestClock(time.Now())
+	engine := waffle.NewEngine(nil, waffle.WithClock(clock))
+
+	errInsert := errors.New("insert failed")
+	batches := make(chan []any, 4)
+	err := engine.On("row").Batch(3, time.Second).Do("insert", func(_ context.Context, data any) error {
+		rows := data.([]any)
+		batches <- rows
+		if len(rows) == 1 {
+			return errInsert
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	// A full batch runs right away
+	handles := make([]*waffle.SendHandle, 0, 3)
+	for _, row := range []string{"a", "b", "c"} {
+		handles = append(handles, engine.SendAwait(t.Context(), "row", row))
+	}
+	require.Equal(t, []any{"a", "b", "c"}, <-batches)
+
+	// The outcome of the batch is reported to each of its events
+	for _, handle := range handles {
+		results, err := handle.Wait(t.Context())
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+	}
+
+	// A partial batch runs once the wait is over
+	handle := engine.SendAwait(t.Context(), "row", "d")
+	clock.Advance(500 * time.Millisecond)
+	require.Empty(t, batches)
+	clock.Advance(500 * time.Millisecond)
+	require.Equal(t, []any{"d"}, <-batches)
+
+	_, err = handle.Wait(t.Context())
+	require.ErrorIs(t, err, errInsert)
+
+	// Closing the engine flushes the pending batch
+	require.True(t, engine.Send(t.Context(), "row", "e"))
+	require.True(t, engine.Send(t.Context(), "row", "f"))
+	require.NoError(t, engine.Close(t.Context()))
+	require.Equal(t, []any{"e", "f"}, <-batches)
+}
+
+func TestEngine_Batch_SendSync(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	batches := make(chan []any, 1)
+	err := engine.On("row").Batch(10, time.Minute).Do("insert", func(_ context.Context, data any) error {
+		batches <- data.([]any)
+		return nil
+	})
+	require.NoError(t, err)
+
+	_, err = engine.SendSync(t.Context(), "row", "a")
+	require.NoError(t, err)
+	require.Equal(t, []any{"a"}, <-batches)
+}
+
+func TestActionBuilder_InvalidBatch(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	err := engine.On("test").Batch(0, time.Second).Do("test", func(context.Context, any) error { return nil })
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Batch: maxSize must be positive")
+
+	err = engine.On("test").Batch(1, 0).Do("test", func(context.Context, any) error { return nil })
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Batch: maxWait must be positive")
+}
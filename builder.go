@@ -3,7 +3,12 @@ package waffle
 import (
 	"context"
 	"fmt"
+	"maps"
+	"reflect"
+	"runtime"
+	"slices"
 	"strings"
+	"time"
 )
 
 // ErrBuilderBadParams represents errors that occurred during action builder configuration.
@@ -32,17 +37,56 @@ func (e *ErrBuilderBadParams) Unwrap() []error {
 	return e.Errors
 }
 
+// BuilderError is a configuration mistake found while building an action. It is
+// returned within ErrBuilderBadParams and can be extracted with errors.As to inspect
+// the invalid field.
+type BuilderError struct {
+	// Method is the builder method that found the mistake
+	Method string
+	// Field is the invalid parameter or field
+	Field string
+	// Reason describes what is expected of the field
+	Reason string
+}
+
+func (e *BuilderError) Error() string {
+	return fmt.Sprintf("%s: %s %s", e.Method, e.Field, e.Reason)
+}
+
 // ActionBuilder builds actions for events.
 type ActionBuilder struct {
 	engine            *Engine
 	eventKeys         []EventKey
 	concurrencyGroups *ConcurrencyGroups
+	timeout           time.Duration
+	maxRetryLater     uint
+	quietConcurrency  bool
+	retryAttempts     uint
+	backoff           BackoffStrategy
+	defaultData       func(ctx context.Context) any
+	onClose           []func(ctx context.Context) error
+	inline            bool
+	detached          bool
+	deadlineFromData  func(ctx context.Context, data any) (time.Time, bool)
+	when              func(ctx context.Context, data any) bool
+	mapData           func(ctx context.Context, data any) (any, error)
+	middlewares       []Middleware
+	debounceWindow    time.Duration
+	throttle          *Throttle
+	rateLimits        *RateLimitGroups
+	batchSize         int
+	batchWait         time.Duration
+	debounceKey       func(ctx context.Context, data any) string
+	labels            map[string]string
+	queueWhenLimited  bool
+	queueSize         int
+	queueOverflow     OverflowPolicy
 	errors            []error
 }
 
 func (ab *ActionBuilder) Concurrency(limit uint) *ActionBuilder {
 	if limit == 0 {
-		ab.errors = append(ab.errors, fmt.Errorf("Concurrency: limit must be non-negative"))
+		ab.errors = append(ab.errors, &BuilderError{Method: "Concurrency", Field: "limit", Reason: "must be non-negative"})
 		return ab
 	}
 
@@ -51,19 +95,33 @@ func (ab *ActionBuilder) Concurrency(limit uint) *ActionBuilder {
 	return ab
 }
 
+// ConcurrencyWithQueue sets a global concurrency limit that makes Send wait for a slot,
+// in arrival order, when they are all taken. Up to maxWaiters sends may wait at once;
+// further sends drop the action immediately. A send stops waiting when its context is done.
+func (ab *ActionBuilder) ConcurrencyWithQueue(limit, maxWaiters uint) *ActionBuilder {
+	if limit == 0 {
+		ab.errors = append(ab.errors, &BuilderError{Method: "ConcurrencyWithQueue", Field: "limit", Reason: "must be greater than 0"})
+		return ab
+	}
+
+	ab.concurrencyGroups.AddLimit("", NewConcurrencyLimitWithQueue(limit, maxWaiters, nil))
+
+	return ab
+}
+
 func (ab *ActionBuilder) ConcurrencyGroup(groupName string, limit uint, keyFunc func(ctx context.Context, data any) string) *ActionBuilder {
 	if limit == 0 {
-		ab.errors = append(ab.errors, fmt.Errorf("ConcurrencyGroup: limit must be greater than 0"))
+		ab.errors = append(ab.errors, &BuilderError{Method: "ConcurrencyGroup", Field: "limit", Reason: "must be greater than 0"})
 		return ab
 	}
 
 	if keyFunc == nil {
-		ab.errors = append(ab.errors, fmt.Errorf("ConcurrencyGroup: keyFunc must be provided"))
+		ab.errors = append(ab.errors, &BuilderError{Method: "ConcurrencyGroup", Field: "keyFunc", Reason: "must be provided"})
 		return ab
 	}
 
 	if groupName == "" {
-		ab.errors = append(ab.errors, fmt.Errorf("ConcurrencyGroup: groupName must be provided"))
+		ab.errors = append(ab.errors, &BuilderError{Method: "ConcurrencyGroup", Field: "groupName", Reason: "must be provided"})
 		return ab
 	}
 
@@ -72,30 +130,579 @@ func (ab *ActionBuilder) ConcurrencyGroup(groupName string, limit uint, keyFunc
 	return ab
 }
 
+// ConcurrencyGroupByData is like ConcurrencyGroup keyed by the data itself, for actions
+// whose data is the key. It skips the key function call on every run. Runs whose data
+// isn't a string fail to acquire the group and are dropped, like with a failing key
+// function.
+func (ab *ActionBuilder) ConcurrencyGroupByData(groupName string, limit uint) *ActionBuilder {
+	if limit == 0 {
+		ab.errors = append(ab.errors, &BuilderError{Method: "ConcurrencyGroupByData", Field: "limit", Reason: "must be greater than 0"})
+		return ab
+	}
+
+	if groupName == "" {
+		ab.errors = append(ab.errors, &BuilderError{Method: "ConcurrencyGroupByData", Field: "groupName", Reason: "must be provided"})
+		return ab
+	}
+
+	ab.concurrencyGroups.AddByData(groupName, limit)
+
+	return ab
+}
+
+// ConcurrencyGroupWithEvent is like ConcurrencyGroup with a key function that also receives
+// the key of the event that triggered the action, for actions handling several events.
+func (ab *ActionBuilder) ConcurrencyGroupWithEvent(groupName string, limit uint, keyFunc func(ctx context.Context, eventKey EventKey, data any) string) *ActionBuilder {
+	if limit == 0 {
+		ab.errors = append(ab.errors, &BuilderError{Method: "ConcurrencyGroupWithEvent", Field: "limit", Reason: "must be greater than 0"})
+		return ab
+	}
+
+	if keyFunc == nil {
+		ab.errors = append(ab.errors, &BuilderError{Method: "ConcurrencyGroupWithEvent", Field: "keyFunc", Reason: "must be provided"})
+		return ab
+	}
+
+	if groupName == "" {
+		ab.errors = append(ab.errors, &BuilderError{Method: "ConcurrencyGroupWithEvent", Field: "groupName", Reason: "must be provided"})
+		return ab
+	}
+
+	ab.concurrencyGroups.AddWithEvent(groupName, limit, keyFunc)
+
+	return ab
+}
+
+// ConcurrencyGroupE is like ConcurrencyGroup with a key function that may fail.
+// When the key function returns an error, the event is dropped for this action
+// and waffle.concurrency.keyfunc_error is logged.
+func (ab *ActionBuilder) ConcurrencyGroupE(groupName string, limit uint, keyFunc func(ctx context.Context, data any) (string, error)) *ActionBuilder {
+	if limit == 0 {
+		ab.errors = append(ab.errors, &BuilderError{Method: "ConcurrencyGroupE", Field: "limit", Reason: "must be greater than 0"})
+		return ab
+	}
+
+	if keyFunc == nil {
+		ab.errors = append(ab.errors, &BuilderError{Method: "ConcurrencyGroupE", Field: "keyFunc", Reason: "must be provided"})
+		return ab
+	}
+
+	if groupName == "" {
+		ab.errors = append(ab.errors, &BuilderError{Method: "ConcurrencyGroupE", Field: "groupName", Reason: "must be provided"})
+		return ab
+	}
+
+	ab.concurrencyGroups.AddE(groupName, limit, keyFunc)
+
+	return ab
+}
+
+// ApplyPolicy adds copies of the groups of a reusable policy to the concurrency groups
+// of the action. Several policies can be applied as long as their group names differ.
+func (ab *ActionBuilder) ApplyPolicy(policy *ConcurrencyGroups) *ActionBuilder {
+	if policy == nil {
+		ab.errors = append(ab.errors, &BuilderError{Method: "ApplyPolicy", Field: "policy", Reason: "must be provided"})
+		return ab
+	}
+
+	if err := ab.concurrencyGroups.Merge(policy); err != nil {
+		ab.errors = append(ab.errors, &BuilderError{Method: "ApplyPolicy", Field: "policy", Reason: err.Error()})
+		return ab
+	}
+
+	return ab
+}
+
+// ShareConcurrencyWith makes the action share the concurrency groups of an already
+// registered action, so that their runs count against the same limits. Groups added to
+// the builder afterwards are shared as well. It must be called before adding any group.
+func (ab *ActionBuilder) ShareConcurrencyWith(actionKey ActionKey) *ActionBuilder {
+	ab.engine.registryMu.Lock()
+	defer ab.engine.registryMu.Unlock()
+
+	configuration, ok := ab.engine.actions[actionKey]
+	if !ok {
+		ab.errors = append(ab.errors, &BuilderError{Method: "ShareConcurrencyWith", Field: "actionKey", Reason: fmt.Sprintf("%q is not registered", actionKey)})
+		return ab
+	}
+
+	if !ab.concurrencyGroups.empty() {
+		ab.errors = append(ab.errors, &BuilderError{Method: "ShareConcurrencyWith", Field: "concurrencyGroups", Reason: "must not be set before sharing"})
+		return ab
+	}
+
+	if configuration.ConcurrencyGroups == nil {
+		configuration.ConcurrencyGroups = NewConcurrencyGroups()
+		ab.engine.actions[actionKey] = configuration
+	}
+
+	ab.concurrencyGroups = configuration.ConcurrencyGroups
+
+	return ab
+}
+
+// Timeout cancels the context passed to the action once the timeout elapses.
+func (ab *ActionBuilder) Timeout(timeout time.Duration) *ActionBuilder {
+	if timeout <= 0 {
+		ab.errors = append(ab.errors, &BuilderError{Method: "Timeout", Field: "timeout", Reason: "must be positive"})
+		return ab
+	}
+
+	ab.timeout = timeout
+
+	return ab
+}
+
+// DeadlineFromData sets a function reading the deadline carried by the event data, for
+// time sensitive events that expire. The action is dropped and waffle.action.deadline_passed
+// is logged when the deadline already passed at dispatch, otherwise the context of the
+// action expires at the deadline. Returning false leaves the action without a deadline.
+func (ab *ActionBuilder) DeadlineFromData(deadline func(ctx context.Context, data any) (time.Time, bool)) *ActionBuilder {
+	if deadline == nil {
+		ab.errors = append(ab.errors, &BuilderError{Method: "DeadlineFromData", Field: "deadline", Reason: "must be provided"})
+		return ab
+	}
+
+	ab.deadlineFromData = deadline
+
+	return ab
+}
+
+// When runs the action only for the events whose data passes the predicate, skipping
+// the others without counting them as dropped. The predicate sees the data after
+// DefaultData, before any concurrency slot is taken. Calling When again adds a predicate
+// that must pass as well.
+func (ab *ActionBuilder) When(predicate func(ctx context.Context, data any) bool) *ActionBuilder {
+	if predicate == nil {
+		ab.errors = append(ab.errors, &BuilderError{Method: "When", Field: "predicate", Reason: "must be provided"})
+		return ab
+	}
+
+	if previous := ab.when; previous != nil {
+		ab.when = func(ctx context.Context, data any) bool {
+			return previous(ctx, data) && predicate(ctx, data)
+		}
+		return ab
+	}
+	ab.when = predicate
+
+	return ab
+}
+
+// Map sets a function decoding or enriching the event data before each run of the
+// action, which receives its result. A mapping error fails the run with ErrMapFailed,
+// reaching the error handler and the retry policy like an error of the action. Calling
+// Map again chains the functions, each receiving the result of the previous one.
+func (ab *ActionBuilder) Map(mapper func(ctx context.Context, data any) (any, error)) *ActionBuilder {
+	if mapper == nil {
+		ab.errors = append(ab.errors, &BuilderError{Method: "Map", Field: "mapper", Reason: "must be provided"})
+		return ab
+	}
+
+	if previous := ab.mapData; previous != nil {
+		ab.mapData = func(ctx context.Context, data any) (any, error) {
+			data, err := previous(ctx, data)
+			if err != nil {
+				return nil, err
+			}
+			return mapper(ctx, data)
+		}
+		return ab
+	}
+	ab.mapData = mapper
+
+	return ab
+}
+
+// Use adds middlewares wrapping the action, inside the middlewares of the engine. They
+// run in the order they were added.
+func (ab *ActionBuilder) Use(middlewares ...Middleware) *ActionBuilder {
+	if slices.ContainsFunc(middlewares, func(mw Middleware) bool { return mw == nil }) {
+		ab.errors = append(ab.errors, &BuilderError{Method: "Use", Field: "middlewares", Reason: "must not be nil"})
+		return ab
+	}
+
+	ab.middlewares = append(ab.middlewares, middlewares...)
+
+	return ab
+}
+
+// Debounce collapses bursts of runs of the action with the same key into a single run,
+// with the data of the last one, once no other run came in for the window. Superseded
+// runs succeed without running and are counted as Debounced.
+func (ab *ActionBuilder) Debounce(window time.Duration, keyFunc func(ctx context.Context, data any) string) *ActionBuilder {
+	if window <= 0 {
+		ab.errors = append(ab.errors, &BuilderError{Method: "Debounce", Field: "window", Reason: "must be positive"})
+		return ab
+	}
+
+	if keyFunc == nil {
+		ab.errors = append(ab.errors, &BuilderError{Method: "Debounce", Field: "keyFunc", Reason: "must be provided"})
+		return ab
+	}
+
+	ab.debounceWindow = window
+	ab.debounceKey = keyFunc
+
+	return ab
+}
+
+// Batch makes the action receive the data of up to maxSize events at once, as a []any in
+// arrival order, for bulk consumers such as database inserts. A batch runs once it is
+// full, or maxWait after its first event, and its outcome is reported to each of its
+// events. Key functions and Map see the whole batch, When sees each event.
+func (ab *ActionBuilder) Batch(maxSize int, maxWait time.Duration) *ActionBuilder {
+	if maxSize <= 0 {
+		ab.errors = append(ab.errors, &BuilderError{Method: "Batch", Field: "maxSize", Reason: "must be positive"})
+		return ab
+	}
+
+	if maxWait <= 0 {
+		ab.errors = append(ab.errors, &BuilderError{Method: "Batch", Field: "maxWait", Reason: "must be positive"})
+		return ab
+	}
+
+	ab.batchSize = maxSize
+	ab.batchWait = maxWait
+
+	return ab
+}
+
+// RateLimitGroup limits the action to rate runs per second per key on average, allowing
+// bursts of up to burst runs, with a token bucket checked at dispatch time. Runs over the
+// rate are dropped with waffle.action.rate_limited. Several groups may be added, a run has
+// to fit within all of them. Adding a group with the same name replaces it.
+func (ab *ActionBuilder) RateLimitGroup(groupName string, rate float64, burst int, keyFunc func(ctx context.Context, data any) string) *ActionBuilder {
+	if rate <= 0 {
+		ab.errors = append(ab.errors, &BuilderError{Method: "RateLimitGroup", Field: "rate", Reason: "must be positive"})
+		return ab
+	}
+
+	if burst <= 0 {
+		ab.errors = append(ab.errors, &BuilderError{Method: "RateLimitGroup", Field: "burst", Reason: "must be positive"})
+		return ab
+	}
+
+	if keyFunc == nil {
+		ab.errors = append(ab.errors, &BuilderError{Method: "RateLimitGroup", Field: "keyFunc", Reason: "must be provided"})
+		return ab
+	}
+
+	if groupName == "" {
+		ab.errors = append(ab.errors, &BuilderError{Method: "RateLimitGroup", Field: "groupName", Reason: "must be provided"})
+		return ab
+	}
+
+	if ab.rateLimits == nil {
+		ab.rateLimits = NewRateLimitGroups()
+	}
+	ab.rateLimits.Add(groupName, rate, burst, keyFunc)
+
+	return ab
+}
+
+// SlidingWindowGroup limits the action to limit runs per key within any rolling window,
+// with a sliding log of the run times checked at dispatch time. Unlike RateLimitGroup, it
+// never lets more than limit runs through within a window, for actions calling APIs with
+// strict quotas.
+// Runs over the limit are dropped with waffle.action.rate_limited. It shares the groups of
+// RateLimitGroup, adding a group with the same name replaces it.
+func (ab *ActionBuilder) SlidingWindowGroup(groupName string, limit int, window time.Duration, keyFunc func(ctx context.Context, data any) string) *ActionBuilder {
+	if limit <= 0 {
+		ab.errors = append(ab.errors, &BuilderError{Method: "SlidingWindowGroup", Field: "limit", Reason: "must be positive"})
+		return ab
+	}
+
+	if window <= 0 {
+		ab.errors = append(ab.errors, &BuilderError{Method: "SlidingWindowGroup", Field: "window", Reason: "must be positive"})
+		return ab
+	}
+
+	if keyFunc == nil {
+		ab.errors = append(ab.errors, &BuilderError{Method: "SlidingWindowGroup", Field: "keyFunc", Reason: "must be provided"})
+		return ab
+	}
+
+	if groupName == "" {
+		ab.errors = append(ab.errors, &BuilderError{Method: "SlidingWindowGroup", Field: "groupName", Reason: "must be provided"})
+		return ab
+	}
+
+	if ab.rateLimits == nil {
+		ab.rateLimits = NewRateLimitGroups()
+	}
+	ab.rateLimits.AddSlidingWindow(groupName, limit, window, keyFunc)
+
+	return ab
+}
+
+// Throttle limits the action to n runs per key within any window of per, dropping the
+// runs over the limit with waffle.action.throttled. Unlike Concurrency, it bounds how
+// often the action runs rather than how many runs are in flight.
+func (ab *ActionBuilder) Throttle(n int, per time.Duration, keyFunc func(ctx context.Context, data any) string) *ActionBuilder {
+	if n <= 0 {
+		ab.errors = append(ab.errors, &BuilderError{Method: "Throttle", Field: "n", Reason: "must be positive"})
+		return ab
+	}
+
+	if per <= 0 {
+		ab.errors = append(ab.errors, &BuilderError{Method: "Throttle", Field: "per", Reason: "must be positive"})
+		return ab
+	}
+
+	if keyFunc == nil {
+		ab.errors = append(ab.errors, &BuilderError{Method: "Throttle", Field: "keyFunc", Reason: "must be provided"})
+		return ab
+	}
+
+	ab.throttle = NewThrottle(n, per, keyFunc)
+
+	return ab
+}
+
+// DefaultData sets a factory producing the data passed to key functions and to the
+// action when the event is sent with nil data. Typed nils, e.g. a nil pointer, are
+// replaced as well.
+func (ab *ActionBuilder) DefaultData(factory func(ctx context.Context) any) *ActionBuilder {
+	if factory == nil {
+		ab.errors = append(ab.errors, &BuilderError{Method: "DefaultData", Field: "factory", Reason: "must be provided"})
+		return ab
+	}
+
+	ab.defaultData = factory
+
+	return ab
+}
+
+// MaxRetryLater caps how many times the action is retried when it returns ErrRetryLater.
+// It defaults to DefaultMaxRetryLater, zero treats ErrRetryLater as a failure.
+func (ab *ActionBuilder) MaxRetryLater(retries uint) *ActionBuilder {
+	ab.maxRetryLater = retries
+
+	return ab
+}
+
+// Retry retries a failed action up to attempts runs in total, waiting the delay of the
+// backoff strategy between runs, e.g. an ExponentialBackoff. Every retry is logged as
+// waffle.action.retry_scheduled.
+func (ab *ActionBuilder) Retry(attempts uint, backoff BackoffStrategy) *ActionBuilder {
+	if attempts == 0 {
+		ab.errors = append(ab.errors, &BuilderError{Method: "Retry", Field: "attempts", Reason: "must be greater than 0"})
+		return ab
+	}
+
+	if backoff == nil {
+		ab.errors = append(ab.errors, &BuilderError{Method: "Retry", Field: "backoff", Reason: "must be provided"})
+		return ab
+	}
+
+	ab.retryAttempts = attempts
+	ab.backoff = backoff
+
+	return ab
+}
+
+// RetryWithJitter retries a failed action up to attempts runs in total, waiting an
+// exponential backoff of base*2^retry capped at max between runs. Each delay is randomly
+// spread by up to the jitter fraction in either direction so that actions failing
+// together don't retry in lockstep.
+func (ab *ActionBuilder) RetryWithJitter(attempts uint, base, max time.Duration, jitter float64) *ActionBuilder {
+	if attempts == 0 {
+		ab.errors = append(ab.errors, &BuilderError{Method: "RetryWithJitter", Field: "attempts", Reason: "must be greater than 0"})
+		return ab
+	}
+
+	if base <= 0 || max < base {
+		ab.errors = append(ab.errors, &BuilderError{Method: "RetryWithJitter", Field: "base", Reason: "must be positive and not greater than max"})
+		return ab
+	}
+
+	if jitter < 0 || jitter > 1 {
+		ab.errors = append(ab.errors, &BuilderError{Method: "RetryWithJitter", Field: "jitter", Reason: "must be between 0 and 1"})
+		return ab
+	}
+
+	ab.retryAttempts = attempts
+	ab.backoff = ExponentialBackoff(base, max, jitter, ab.engine.random)
+
+	return ab
+}
+
+// QuietConcurrencyLogs suppresses the waffle.concurrency.* operation logs of the action,
+// for hot actions where they are too noisy. Lifecycle logs are still emitted.
+func (ab *ActionBuilder) QuietConcurrencyLogs() *ActionBuilder {
+	ab.quietConcurrency = true
+
+	return ab
+}
+
+// Inline runs the action within Send, on the sending goroutine, once its concurrency
+// slots are acquired. It saves spawning a goroutine for hot and cheap actions, at the
+// cost of Send returning only after the action finished. Retries still run later.
+func (ab *ActionBuilder) Inline() *ActionBuilder {
+	ab.inline = true
+
+	return ab
+}
+
+// Detached runs the action with a context that keeps the values of the context passed to
+// Send but isn't canceled with it, for background work that must outlive the caller, e.g.
+// an HTTP request. Waiting for concurrency slots or workers still stops once the caller's
+// context is done. The action Timeout still applies.
+func (ab *ActionBuilder) Detached() *ActionBuilder {
+	ab.detached = true
+
+	return ab
+}
+
+// OnClose registers a teardown run by Engine.Close once the in-flight actions finished,
+// e.g. to close resources the action initialized lazily. It may be called several times.
+func (ab *ActionBuilder) OnClose(teardown func(ctx context.Context) error) *ActionBuilder {
+	if teardown == nil {
+		ab.errors = append(ab.errors, &BuilderError{Method: "OnClose", Field: "teardown", Reason: "must be provided"})
+		return ab
+	}
+
+	ab.onClose = append(ab.onClose, teardown)
+
+	return ab
+}
+
+// QueueWhenLimited queues the action when its concurrency limits are reached instead of
+// dropping it, without blocking Send. Queued actions run in arrival order as soon as a run
+// frees slots; they are dropped if the context of their event is done by then.
+func (ab *ActionBuilder) QueueWhenLimited() *ActionBuilder {
+	ab.queueWhenLimited = true
+	return ab
+}
+
+// Queue queues the action when its concurrency limits are reached like QueueWhenLimited,
+// keeping up to size runs and applying the overflow policy to the runs beyond that.
+func (ab *ActionBuilder) Queue(size int, policy OverflowPolicy) *ActionBuilder {
+	if size <= 0 {
+		ab.errors = append(ab.errors, &BuilderError{Method: "Queue", Field: "size", Reason: "must be greater than 0"})
+		return ab
+	}
+
+	ab.queueWhenLimited = true
+	ab.queueSize = size
+	ab.queueOverflow = policy
+
+	return ab
+}
+
+// Label tags the action with a label, e.g. team=payments, for filtering with
+// Engine.ActionsWithLabel and grouping its completions. Setting a key again replaces its value.
+func (ab *ActionBuilder) Label(key, value string) *ActionBuilder {
+	if key == "" {
+		ab.errors = append(ab.errors, &BuilderError{Method: "Label", Field: "key", Reason: "must be provided"})
+		return ab
+	}
+
+	if ab.labels == nil {
+		ab.labels = make(map[string]string)
+	}
+	ab.labels[key] = value
+
+	return ab
+}
+
 // Do registers the action for all the event keys.
 func (ab *ActionBuilder) Do(actionKey ActionKey, action Action) error {
+	configuration, err := ab.build("Do", actionKey, action)
+	if err != nil {
+		return err
+	}
+
+	return ab.engine.AddActionConfiguration(configuration)
+}
+
+// MustDo is like Do but panics when the action can't be registered, for wiring done at
+// startup where a misconfiguration should stop the service.
+func (ab *ActionBuilder) MustDo(actionKey ActionKey, action Action) {
+	if err := ab.Do(actionKey, action); err != nil {
+		panic(err)
+	}
+}
+
+// BuildConfig validates the builder like Do and returns the resulting configuration
+// without registering it, so it can be inspected or passed to AddActionConfiguration later.
+func (ab *ActionBuilder) BuildConfig(actionKey ActionKey, action Action) (ActionConfiguration, error) {
+	return ab.build("BuildConfig", actionKey, action)
+}
+
+// build validates the builder and returns the action configuration. The method name
+// prefixes the validation errors.
+func (ab *ActionBuilder) build(method string, actionKey ActionKey, action Action) (ActionConfiguration, error) {
+	errs := slices.Clone(ab.errors)
+
 	if actionKey == "" {
-		ab.errors = append(ab.errors, fmt.Errorf("Do: actionKey must be provided"))
+		errs = append(errs, &BuilderError{Method: method, Field: "actionKey", Reason: "must be provided"})
 	}
 
 	if len(ab.eventKeys) == 0 {
-		ab.errors = append(ab.errors, fmt.Errorf("Do: eventKeys must be provided"))
+		errs = append(errs, &BuilderError{Method: method, Field: "eventKeys", Reason: "must be provided"})
 	}
 
 	if action == nil {
-		ab.errors = append(ab.errors, fmt.Errorf("Do: action must be provided"))
+		errs = append(errs, &BuilderError{Method: method, Field: "action", Reason: "must be provided"})
+	}
+
+	if len(errs) > 0 {
+		return ActionConfiguration{}, &ErrBuilderBadParams{Errors: errs}
 	}
 
-	if len(ab.errors) > 0 {
-		return &ErrBuilderBadParams{Errors: ab.errors}
+	return ActionConfiguration{
+		EventKeys:            ab.eventKeys,
+		ConcurrencyGroups:    ab.concurrencyGroups,
+		ActionKey:            actionKey,
+		Action:               action,
+		Timeout:              ab.timeout,
+		MaxRetryLater:        ab.maxRetryLater,
+		RetryAttempts:        ab.retryAttempts,
+		Backoff:              ab.backoff,
+		DefaultData:          ab.defaultData,
+		QuietConcurrencyLogs: ab.quietConcurrency,
+		OnClose:              slices.Clone(ab.onClose),
+		Inline:               ab.inline,
+		Detached:             ab.detached,
+		DeadlineFromData:     ab.deadlineFromData,
+		When:                 ab.when,
+		Map:                  ab.mapData,
+		Middlewares:          slices.Clone(ab.middlewares),
+		DebounceWindow:       ab.debounceWindow,
+		DebounceKey:          ab.debounceKey,
+		Throttle:             ab.throttle,
+		RateLimits:           ab.rateLimits,
+		BatchSize:            ab.batchSize,
+		BatchWait:            ab.batchWait,
+		Labels:               maps.Clone(ab.labels),
+		QueueWhenLimited:     ab.queueWhenLimited,
+		QueueSize:            ab.queueSize,
+		QueueOverflow:        ab.queueOverflow,
+	}, nil
+}
+
+// DoNamed registers the action for all the event keys, deriving the action key
+// from the fully qualified name of the action function. Closures created by the same
+// function literal share a name, so registering a second one returns an error.
+func (ab *ActionBuilder) DoNamed(action Action) error {
+	var actionKey ActionKey
+	if action != nil {
+		fn := runtime.FuncForPC(reflect.ValueOf(action).Pointer())
+		if fn == nil || fn.Name() == "" {
+			ab.errors = append(ab.errors, &BuilderError{Method: "DoNamed", Field: "action", Reason: "name could not be resolved"})
+			return &ErrBuilderBadParams{Errors: ab.errors}
+		}
+
+		actionKey = ActionKey(fn.Name())
 	}
 
-	ab.engine.AddActionConfiguration(ActionConfiguration{
-		EventKeys:         ab.eventKeys,
-		ConcurrencyGroups: ab.concurrencyGroups,
-		ActionKey:         actionKey,
-		Action:            action,
-	})
+	configuration, err := ab.build("Do", actionKey, action)
+	if err != nil {
+		return err
+	}
 
-	return nil
+	// Unlike Do, fail rather than replace an action registered under the same name
+	return ab.engine.addActionConfiguration("DoNamed", configuration, false)
 }
@@ -3,6 +3,7 @@ package waffle_test
 import (
 	"context"
 	"fmt"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -131,3 +132,384 @@ func TestErrBuilderBadParams_Is(t *testing.T) {
 	require.ErrorAs(t, err, &builderErr)
 	require.NotNil(t, builderErr)
 }
+
+func namedActionA(_ context.Context, _ any) error { return nil }
+
+func namedActionB(_ context.Context, _ any) error { return nil }
+
+func TestBuilderError_As(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	err := engine.On("test").Concurrency(0).Do("test", func(_ context.Context, _ any) error {
+		return nil
+	})
+
+	var builderErr *waffle.BuilderError
+	require.ErrorAs(t, err, &builderErr)
+	require.Equal(t, "Concurrency", builderErr.Method)
+	require.Equal(t, "limit", builderErr.Field)
+	require.Equal(t, "Concurrency: limit must be non-negative", builderErr.Error())
+
+	err = engine.On("test").ConcurrencyGroup("group", 1, nil).Do("test", func(_ context.Context, _ any) error {
+		return nil
+	})
+
+	require.ErrorAs(t, err, &builderErr)
+	require.Equal(t, "ConcurrencyGroup", builderErr.Method)
+	require.Equal(t, "keyFunc", builderErr.Field)
+	require.Equal(t, "must be provided", builderErr.Reason)
+}
+
+func TestActionBuilder_DoNamed(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	require.NoError(t, engine.On("a").DoNamed(namedActionA))
+	require.NoError(t, engine.On("b").DoNamed(namedActionB))
+
+	engine.Send(t.Context(), "a", nil)
+	engine.Send(t.Context(), "b", nil)
+
+	time.Sleep(10 * time.Millisecond)
+
+	// Each function should get its own derived key
+	actionKeys := make(map[string]string)
+	for _, log := range logger.GetLogs() {
+		if log.Event == "waffle.action.spawned" {
+			actionKeys[log.Metadata["eventKey"]] = log.Metadata["actionKey"]
+		}
+	}
+	require.Equal(t, "github.com/doron-cohen/waffle_test.namedActionA", actionKeys["a"])
+	require.Equal(t, "github.com/doron-cohen/waffle_test.namedActionB", actionKeys["b"])
+}
+
+func TestActionBuilder_DoNamed_AnonymousFunc(t *testing.T) {
+	ran := atomic.Int32{}
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	require.NoError(t, engine.On("first").DoNamed(func(_ context.Context, _ any) error {
+		ran.Add(1)
+		return nil
+	}))
+	require.NoError(t, engine.On("second").DoNamed(func(_ context.Context, _ any) error {
+		ran.Add(1)
+		return nil
+	}))
+
+	require.True(t, engine.Send(t.Context(), "first", nil))
+	require.True(t, engine.Send(t.Context(), "second", nil))
+
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, int32(2), ran.Load())
+
+	// Each anonymous func should get a usable key of its own
+	actionKeys := make(map[string]string)
+	for _, log := range logger.GetLogs() {
+		if log.Event == "waffle.action.spawned" {
+			actionKeys[log.Metadata["eventKey"]] = log.Metadata["actionKey"]
+		}
+	}
+	require.NotEmpty(t, actionKeys["first"])
+	require.NotEmpty(t, actionKeys["second"])
+	require.NotEqual(t, actionKeys["first"], actionKeys["second"])
+}
+
+func makeNamedHandler(counter *atomic.Int32) waffle.Action {
+	return func(_ context.Context, _ any) error {
+		counter.Add(1)
+		return nil
+	}
+}
+
+func TestActionBuilder_DoNamed_DuplicateName(t *testing.T) {
+	counter := atomic.Int32{}
+
+	engine := waffle.NewEngine(nil)
+
+	require.NoError(t, engine.On("first").DoNamed(makeNamedHandler(&counter)))
+
+	// Closures from the same literal derive the same key
+	err := engine.On("second").DoNamed(makeNamedHandler(&counter))
+
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is already registered")
+
+	var builderErr *waffle.ErrBuilderBadParams
+	require.ErrorAs(t, err, &builderErr)
+
+	require.False(t, engine.Send(t.Context(), "second", nil))
+}
+
+func TestActionBuilder_DoNamed_Concurrent(t *testing.T) {
+	counter := atomic.Int32{}
+	engine := waffle.NewEngine(nil)
+
+	var registered atomic.Int32
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if engine.On("event").DoNamed(makeNamedHandler(&counter)) == nil {
+				registered.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Only one of the registrations racing for the same name wins
+	require.Equal(t, int32(1), registered.Load())
+}
+
+func TestActionBuilder_DoNamed_NilAction(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	err := engine.On().DoNamed(nil)
+
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Do: action must be provided")
+	require.Contains(t, err.Error(), "Do: eventKeys must be provided")
+}
+
+func TestActionBuilder_InvalidTimeout(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	err := engine.
+		On("test").
+		Timeout(0).
+		Do("test", func(_ context.Context, _ any) error {
+			return nil
+		})
+
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Timeout: timeout must be positive")
+}
+
+func TestActionBuilder_NilWhen(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	err := engine.
+		On("test").
+		When(nil).
+		Do("test", func(_ context.Context, _ any) error {
+			return nil
+		})
+
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "When: predicate must be provided")
+}
+
+func TestActionBuilder_NilMap(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	err := engine.
+		On("test").
+		Map(nil).
+		Do("test", func(_ context.Context, _ any) error {
+			return nil
+		})
+
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Map: mapper must be provided")
+}
+
+func TestActionBuilder_NilMiddleware(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	err := engine.
+		On("test").
+		Use(nil).
+		Do("test", func(_ context.Context, _ any) error {
+			return nil
+		})
+
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Use: middlewares must not be nil")
+}
+
+func TestActionBuilder_BuildConfig(t *testing.T) {
+	counter := atomic.Int32{}
+
+	engine := waffle.NewEngine(nil)
+
+	configuration, err := engine.
+		On("test").
+		Concurrency(1).
+		Timeout(time.Second).
+		BuildConfig("test", func(_ context.Context, _ any) error {
+			counter.Add(1)
+			return nil
+		})
+	require.NoError(t, err)
+
+	require.Equal(t, waffle.ActionKey("test"), configuration.ActionKey)
+	require.Equal(t, []waffle.EventKey{"test"}, configuration.EventKeys)
+	require.Equal(t, time.Second, configuration.Timeout)
+
+	// Nothing is registered until the configuration is added
+	require.False(t, engine.Send(t.Context(), "test", nil))
+
+	require.NoError(t, engine.AddActionConfiguration(configuration))
+	require.True(t, engine.Send(t.Context(), "test", nil))
+
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, int32(1), counter.Load())
+}
+
+func TestActionBuilder_BuildConfig_Errors(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	_, buildErr := engine.On("test").Concurrency(0).BuildConfig("", nil)
+	doErr := engine.On("test").Concurrency(0).Do("", nil)
+
+	var buildBadParams, doBadParams *waffle.ErrBuilderBadParams
+	require.ErrorAs(t, buildErr, &buildBadParams)
+	require.ErrorAs(t, doErr, &doBadParams)
+	require.Len(t, buildBadParams.Errors, len(doBadParams.Errors))
+	require.Contains(t, buildErr.Error(), "Concurrency: limit must be non-negative")
+	require.Contains(t, buildErr.Error(), "BuildConfig: actionKey must be provided")
+	require.Contains(t, buildErr.Error(), "BuildConfig: action must be provided")
+
+	require.False(t, engine.Send(t.Context(), "test", nil))
+}
+
+func TestActionBuilder_InvalidRetryWithJitter(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+	action := func(_ context.Context, _ any) error {
+		return nil
+	}
+
+	err := engine.On("test").RetryWithJitter(0, time.Second, time.Minute, 0.1).Do("test", action)
+	require.ErrorContains(t, err, "RetryWithJitter: attempts must be greater than 0")
+
+	err = engine.On("test").RetryWithJitter(3, time.Minute, time.Second, 0.1).Do("test", action)
+	require.ErrorContains(t, err, "RetryWithJitter: base must be positive and not greater than max")
+
+	err = engine.On("test").RetryWithJitter(3, time.Second, time.Minute, 1.5).Do("test", action)
+	require.ErrorContains(t, err, "RetryWithJitter: jitter must be between 0 and 1")
+}
+
+func TestActionBuilder_ApplyPolicy(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	policy := waffle.NewConcurrencyGroups()
+	policy.Add("tenant", 1, func(_ context.Context, data any) string {
+		return data.(string)
+	})
+
+	config, err := engine.On("test").
+		ApplyPolicy(policy).
+		BuildConfig("test", func(_ context.Context, _ any) error {
+			return nil
+		})
+	require.NoError(t, err)
+	require.Equal(t, []string{"tenant"}, config.ConcurrencyGroups.Saturated(-1))
+
+	_, err = engine.On("test").
+		ApplyPolicy(policy).
+		ApplyPolicy(policy).
+		BuildConfig("test", func(_ context.Context, _ any) error {
+			return nil
+		})
+
+	var builderErr *waffle.BuilderError
+	require.ErrorAs(t, err, &builderErr)
+	require.Equal(t, "ApplyPolicy", builderErr.Method)
+	require.Equal(t, "policy", builderErr.Field)
+}
+
+func TestActionBuilder_ShareConcurrencyWith(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	var running, maxRunning atomic.Int32
+	handler := func(_ context.Context, _ any) error {
+		current := running.Add(1)
+		defer running.Add(-1)
+
+		for {
+			observed := maxRunning.Load()
+			if current <= observed || maxRunning.CompareAndSwap(observed, current) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}
+
+	require.NoError(t, engine.On("orders").Concurrency(1).Do("orders", handler))
+	require.NoError(t, engine.On("refunds").ShareConcurrencyWith("orders").Do("refunds", handler))
+
+	require.True(t, engine.Send(t.Context(), "orders", nil))
+	require.True(t, engine.Send(t.Context(), "refunds", nil))
+	require.True(t, engine.Send(t.Context(), "orders", nil))
+
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int32(1), maxRunning.Load())
+	require.Equal(t, uint64(1), engine.Stats().Dispatched)
+}
+
+func TestActionBuilder_ShareConcurrencyWith_Errors(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+	action := func(_ context.Context, _ any) error {
+		return nil
+	}
+
+	require.NoError(t, engine.On("orders").Concurrency(1).Do("orders", action))
+
+	var builderErr *waffle.BuilderError
+	err := engine.On("refunds").ShareConcurrencyWith("missing").Do("refunds", action)
+	require.ErrorAs(t, err, &builderErr)
+	require.Equal(t, "actionKey", builderErr.Field)
+
+	err = engine.On("refunds").Concurrency(2).ShareConcurrencyWith("orders").Do("refunds", action)
+	require.ErrorAs(t, err, &builderErr)
+	require.Equal(t, "concurrencyGroups", builderErr.Field)
+}
+
+func TestActionBuilder_MustDo(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+	action := func(_ context.Context, _ any) error {
+		return nil
+	}
+
+	require.PanicsWithError(t, "builder errors: Concurrency: limit must be non-negative", func() {
+		engine.On("orders").Concurrency(0).MustDo("orders", action)
+	})
+
+	require.NotPanics(t, func() {
+		engine.On("orders").Concurrency(1).MustDo("orders", action)
+		engine.MustOn("refunds", "refunds", action)
+	})
+	require.True(t, engine.Send(t.Context(), "refunds", nil))
+}
+
+func TestActionBuilder_Label(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+	action := func(_ context.Context, _ any) error {
+		return nil
+	}
+
+	require.NoError(t, engine.On("charge").Label("team", "payments").Do("charge", action))
+	require.NoError(t, engine.On("refund").Label("team", "payments").Label("tier", "1").Do("refund", action))
+	require.NoError(t, engine.On("ship").Label("team", "logistics").Do("ship", action))
+
+	require.Equal(t, []waffle.ActionKey{"charge", "refund"}, engine.ActionsWithLabel("team", "payments"))
+	require.Equal(t, []waffle.ActionKey{"refund"}, engine.ActionsWithLabel("tier", "1"))
+	require.Empty(t, engine.ActionsWithLabel("team", "growth"))
+
+	// Completions carry the labels
+	require.True(t, engine.Send(t.Context(), "ship", nil))
+	select {
+	case completion := <-engine.Completions():
+		require.Equal(t, map[string]string{"team": "logistics"}, completion.Labels)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("action did not complete")
+	}
+
+	var builderErr *waffle.BuilderError
+	err := engine.On("ship").Label("", "x").Do("other", action)
+	require.ErrorAs(t, err, &builderErr)
+	require.Equal(t, "key", builderErr.Field)
+}
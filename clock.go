@@ -0,0 +1,28 @@
+package waffle
+
+import "time"
+
+// Clock provides the current time and timers to the engine, allowing tests to control time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once the duration elapses.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a call scheduled by a Clock.
+type Timer interface {
+	// Stop prevents the call from running, returning false if it already ran or was stopped.
+	Stop() bool
+}
+
+// realClock is the Clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
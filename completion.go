@@ -0,0 +1,36 @@
+package waffle
+
+import "time"
+
+// completionsBuffer is how many completions are kept for the readers of Engine.Completions.
+const completionsBuffer = 256
+
+// Completion is the outcome of a finished action run, published on Engine.Completions.
+type Completion struct {
+	EventKey  EventKey
+	ActionKey ActionKey
+	// Err is the error returned by the action, or describes its panic. It is nil when the
+	// action succeeded or returned ErrStop
+	Err error
+	// Duration is how long the action ran
+	Duration time.Duration
+	// Labels are the labels of the action, they must not be modified
+	Labels map[string]string
+}
+
+// Completions returns a channel receiving the completion of every action run that isn't
+// retried, for ad-hoc consumers of the action outcomes. The channel is buffered; when
+// nobody reads it and the buffer is full, completions are dropped and counted in the
+// CompletionsDropped stat rather than blocking the engine. The channel is never closed.
+func (e *Engine) Completions() <-chan Completion {
+	return e.completions
+}
+
+// complete publishes the completion without blocking.
+func (e *Engine) complete(completion Completion) {
+	select {
+	case e.completions <- completion:
+	default:
+		e.stats.completionsDropped.Add(1)
+	}
+}
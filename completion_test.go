@@ -0,0 +1,57 @@
+package waffle_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_Completions(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	failure := errors.New("failed")
+	require.NoError(t, engine.On("event").Do("succeeds", func(_ context.Context, _ any) error {
+		return nil
+	}))
+	require.NoError(t, engine.On("event").Do("fails", func(_ context.Context, _ any) error {
+		return failure
+	}))
+
+	require.True(t, engine.Send(t.Context(), "event", nil))
+
+	completions := make(map[waffle.ActionKey]waffle.Completion)
+	for range 2 {
+		select {
+		case completion := <-engine.Completions():
+			completions[completion.ActionKey] = completion
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("completion was not published")
+		}
+	}
+
+	require.Equal(t, waffle.EventKey("event"), completions["succeeds"].EventKey)
+	require.NoError(t, completions["succeeds"].Err)
+	require.Equal(t, waffle.EventKey("event"), completions["fails"].EventKey)
+	require.ErrorIs(t, completions["fails"].Err, failure)
+}
+
+func TestEngine_Completions_DroppedWhenFull(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	require.NoError(t, engine.On("event").Do("action", func(_ context.Context, _ any) error {
+		return nil
+	}))
+
+	// Nobody reads the completions, so they fill up the buffer
+	for range cap(engine.Completions()) + 2 {
+		_, err := engine.SendSync(t.Context(), "event", nil)
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, uint64(2), engine.Stats().CompletionsDropped)
+	require.Len(t, engine.Completions(), cap(engine.Completions()))
+}
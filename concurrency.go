@@ -1,14 +1,78 @@
 package waffle
 
 import (
+	"container/list"
 	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
+)
+
+// ErrQueueFull is returned when acquiring a concurrency slot while all the slots are
+// taken and the wait queue is full. It is also the error of an action run rejected by
+// its full queue, see OverflowReject.
+var ErrQueueFull = errors.New("concurrency queue is full")
+
+// ErrKeyCapReached is returned when acquiring a concurrency slot for a new key while the
+// limit already tracks its maximum number of keys, none of them idle.
+var ErrKeyCapReached = errors.New("concurrency key cap reached")
+
+// ErrKeyNotString is returned when acquiring a slot of a limit keyed by the data, see
+// NewConcurrencyLimitByData, for data that isn't a string.
+var ErrKeyNotString = errors.New("concurrency key data is not a string")
+
+// ConcurrencyLimitOption configures optional concurrency limit behavior.
+type ConcurrencyLimitOption func(*StringConcurrencyLimit)
+
+// WithMaxKeys caps how many distinct keys the limit tracks, bounding its memory when keys
+// come from untrusted input. Idle keys are forgotten as soon as their slots are released,
+// so the cap bounds the keys holding or waiting for slots: once it is reached, a new key
+// fails to acquire. A value of zero or less disables the cap.
+func WithMaxKeys(maxKeys int) ConcurrencyLimitOption {
+	return func(c *StringConcurrencyLimit) {
+		c.maxKeys = max(maxKeys, 0)
+	}
+}
+
+// WithFIFO hands the freed slots of a key to its waiting acquirers strictly in arrival
+// order, even when the engine weighs events with WithFairShares, so that a busy event
+// can't starve the acquirers that waited longer.
+func WithFIFO() ConcurrencyLimitOption {
+	return func(c *StringConcurrencyLimit) {
+		c.fifo = true
+	}
+}
+
+// acquireMode tells how acquiring slots waits for them when they are all taken.
+type acquireMode int
+
+const (
+	// acquireTry fails right away
+	acquireTry acquireMode = iota
+	// acquireQueued waits in the wait queue of the limit, failing when it is full
+	acquireQueued
+	// acquireBlocking waits in arrival order whatever the size of the wait queue
+	acquireBlocking
 )
 
 // ConcurrencyGroups manages multiple concurrency limits.
+//
+// Groups are always acquired in the same canonical order, sorted by group name with
+// the global limit first, and released in reverse order. When several actions share
+// limits through AddLimit under the same group names, they all acquire them in the
+// same order regardless of the order the limits were added, so two actions can't each
+// hold one shared limit while failing on the other.
+//
+// A nil ConcurrencyGroups has no limits: acquiring it always succeeds.
 type ConcurrencyGroups struct {
 	groups map[string]*ConcurrencyLimit
-	mu     sync.RWMutex
+	// names holds the group names in acquisition order
+	names []string
+	mu    sync.RWMutex
 }
 
 // NewConcurrencyGroups creates a new ConcurrencyGroups instance.
@@ -21,109 +85,974 @@ func NewConcurrencyGroups() *ConcurrencyGroups {
 // AddGlobalLimit adds a global concurrency limit.
 func (c *ConcurrencyGroups) AddGlobalLimit(limit uint) {
 	c.mu.Lock()
-	c.groups[""] = NewConcurrencyLimit(limit, nil)
+	c.set("", NewConcurrencyLimit(limit, nil))
 	c.mu.Unlock()
 }
 
 // Add adds a named concurrency group with a limit and key function.
 func (c *ConcurrencyGroups) Add(groupName string, limit uint, keyFunc func(ctx context.Context, data any) string) {
 	c.mu.Lock()
-	c.groups[groupName] = NewConcurrencyLimit(limit, keyFunc)
+	c.set(groupName, NewConcurrencyLimit(limit, keyFunc))
 	c.mu.Unlock()
 }
 
-// TryAcquire attempts to acquire all concurrency limits.
-func (c *ConcurrencyGroups) TryAcquire(ctx context.Context, data any) (acquired bool, release func()) {
+// AddWithEvent adds a named concurrency group with a limit and a key function that also
+// receives the key of the event that triggered the action.
+func (c *ConcurrencyGroups) AddWithEvent(groupName string, limit uint, keyFunc func(ctx context.Context, eventKey EventKey, data any) string) {
+	c.mu.Lock()
+	c.set(groupName, NewConcurrencyLimitWithEvent(limit, keyFunc))
+	c.mu.Unlock()
+}
+
+// AddE adds a named concurrency group with a limit and a key function that may fail.
+// When the key function returns an error, the acquisition fails.
+func (c *ConcurrencyGroups) AddE(groupName string, limit uint, keyFunc func(ctx context.Context, data any) (string, error)) {
+	c.mu.Lock()
+	c.set(groupName, NewConcurrencyLimitE(limit, keyFunc))
+	c.mu.Unlock()
+}
+
+// AddByData adds a named concurrency group keyed by the data itself, which must be a
+// string, see NewConcurrencyLimitByData.
+func (c *ConcurrencyGroups) AddByData(groupName string, limit uint) {
+	c.mu.Lock()
+	c.set(groupName, NewConcurrencyLimitByData(limit))
+	c.mu.Unlock()
+}
+
+// AddLimit adds a named concurrency group backed by an existing limit. Adding the same
+// limit to the ConcurrencyGroups of several actions makes them share its slots.
+func (c *ConcurrencyGroups) AddLimit(groupName string, limit *ConcurrencyLimit) {
+	c.mu.Lock()
+	c.set(groupName, limit)
+	c.mu.Unlock()
+}
+
+// Merge adds copies of the groups of other, each with its own slots, so that a policy
+// can be applied to several actions without them sharing slots. It returns an error,
+// without adding any group, if a group name exists in both.
+func (c *ConcurrencyGroups) Merge(other *ConcurrencyGroups) error {
+	if other == nil {
+		return nil
+	}
+
+	other.mu.RLock()
+	names := slices.Clone(other.names)
+	groups := make([]*ConcurrencyLimit, 0, len(names))
+	for _, name := range names {
+		groups = append(groups, other.groups[name].clone())
+	}
+	other.mu.RUnlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, name := range names {
+		if _, ok := c.groups[name]; ok {
+			return fmt.Errorf("concurrency group %q already exists", name)
+		}
+	}
+
+	for i, name := range names {
+		c.set(name, groups[i])
+	}
+
+	return nil
+}
+
+// ReplaceKeyFunc swaps the key function of a group, returning false if there is no such
+// group. New acquisitions use the new function, while in-flight acquisitions release their
+// slots under the keys they were acquired with.
+func (c *ConcurrencyGroups) ReplaceKeyFunc(groupName string, keyFunc func(ctx context.Context, data any) string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	group, ok := c.groups[groupName]
+	if !ok {
+		return false
+	}
+
+	// Other groups may share the limit, so replace it rather than mutating it
+	replaced := NewConcurrencyLimit(0, keyFunc)
+	replaced.StringConcurrencyLimit = group.StringConcurrencyLimit
+	c.groups[groupName] = replaced
+
+	return true
+}
+
+// Remove removes a group, the global limit under the empty name, reporting false if there
+// is no such group. Runs holding its slots release them as usual, later runs no longer
+// acquire it. Groups shared with other actions are removed for all of them.
+func (c *ConcurrencyGroups) Remove(name string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.groups[name]; !ok {
+		return false
+	}
+
+	delete(c.groups, name)
+	c.names = slices.DeleteFunc(c.names, func(n string) bool { return n == name })
+
+	return true
+}
+
+// Reset removes all the groups, like Remove, so that they can be added again from scratch.
+func (c *ConcurrencyGroups) Reset() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.groups)
+	c.names = nil
+}
+
+// empty reports whether there are no groups to acquire.
+func (c *ConcurrencyGroups) empty() bool {
+	if c == nil {
+		return true
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.groups) == 0
+}
+
+// limits returns the names and limits of the groups, in acquisition order.
+func (c *ConcurrencyGroups) limits() ([]string, []*ConcurrencyLimit) {
+	if c == nil {
+		return nil, nil
+	}
+
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	acquiredGroups := make([]*ConcurrencyLimit, 0, len(c.groups))
+	limits := make([]*ConcurrencyLimit, 0, len(c.names))
+	for _, name := range c.names {
+		limits = append(limits, c.groups[name])
+	}
+
+	return slices.Clone(c.names), limits
+}
+
+// set stores the group and keeps the acquisition order sorted. The caller must hold the lock.
+func (c *ConcurrencyGroups) set(groupName string, limit *ConcurrencyLimit) {
+	if _, ok := c.groups[groupName]; !ok {
+		c.names = append(c.names, groupName)
+		sort.Strings(c.names)
+	}
+
+	c.groups[groupName] = limit
+}
+
+// TryAcquire attempts to acquire all concurrency limits in canonical order without waiting.
+// A key function error fails the acquisition.
+func (c *ConcurrencyGroups) TryAcquire(ctx context.Context, data any) (acquired bool, release func()) {
+	if c == nil {
+		return true, func() {}
+	}
+
+	acquired, _, release, _ = c.acquire(ctx, data, acquireTry)
+	return acquired, release
+}
+
+// Acquire acquires all concurrency limits in canonical order, waiting for a slot in the
+// limits that have a wait queue. When a limit can't be acquired, because its queue is full,
+// its key function failed or the context is done while waiting, the limits acquired so far
+// are released and it returns false.
+func (c *ConcurrencyGroups) Acquire(ctx context.Context, data any) (acquired bool, release func()) {
+	if c == nil {
+		return true, func() {}
+	}
+
+	acquired, _, release, _ = c.acquire(ctx, data, acquireQueued)
+	return acquired, release
+}
+
+// acquire attempts to acquire all concurrency limits in canonical order, computing the
+// key of each group once. When wait is set, it waits for the limits that have a wait
+// queue, until the context is done. It returns the keys of the groups in acquisition
+// order, and a release function freeing the slots under those same keys. A key function
+// error, or ErrKeyCapReached, rolls back the groups acquired so far and is returned.
+func (c *ConcurrencyGroups) acquire(ctx context.Context, data any, mode acquireMode) (acquired bool, keys []string, release func(), err error) {
+	// Don't hold the lock while waiting for slots
+	c.mu.RLock()
+	groups := make([]*ConcurrencyLimit, 0, len(c.names))
+	for _, name := range c.names {
+		groups = append(groups, c.groups[name])
+	}
+	c.mu.RUnlock()
+
+	acquiredGroups := make([]*ConcurrencyLimit, 0, len(groups))
+	keys = make([]string, 0, len(groups))
 	canRun := true
-	for _, group := range c.groups {
-		if !group.TryAcquire(ctx, data) {
+	for _, group := range groups {
+		var key string
+		key, err = group.getKey(ctx, data)
+		if err != nil {
 			canRun = false
 			break
 		}
 
+		if mode != acquireTry {
+			acquireErr := group.StringConcurrencyLimit.acquire(ctx, key, mode == acquireQueued)
+			if errors.Is(acquireErr, ErrKeyCapReached) {
+				err = acquireErr
+			}
+			canRun = acquireErr == nil
+		} else {
+			canRun = group.StringConcurrencyLimit.TryAcquire(ctx, key)
+		}
+		if !canRun {
+			break
+		}
+
 		acquiredGroups = append(acquiredGroups, group)
+		keys = append(keys, key)
 	}
 
 	releaseFunc := func() {
-		for _, group := range acquiredGroups {
-			group.Release(ctx, data)
+		for i := len(acquiredGroups) - 1; i >= 0; i-- {
+			acquiredGroups[i].StringConcurrencyLimit.Release(ctx, keys[i])
 		}
 	}
 
 	if canRun {
-		return true, releaseFunc
+		return true, keys, releaseFunc, nil
 	}
 
 	releaseFunc()
-	return false, nil
+	return false, nil, nil, err
+}
+
+// globalLimit returns the global limit, or nil if there is none.
+func (c *ConcurrencyGroups) globalLimit() *ConcurrencyLimit {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.groups[""]
+}
+
+// GroupLimit returns the configured limit of a group, or false if there is no such group.
+// The global limit is reported under the empty name.
+func (c *ConcurrencyGroups) GroupLimit(name string) (uint, bool) {
+	if c == nil {
+		return 0, false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	group, ok := c.groups[name]
+	if !ok {
+		return 0, false
+	}
+
+	return group.Limit(), true
+}
+
+// SetLimit changes the limit of a group while it is in use, see
+// StringConcurrencyLimit.SetLimit, reporting false if there is no such group. The global
+// limit is set under the empty name. Groups shared with other actions change for all of
+// them. Runs queued with QueueWhenLimited take the new slots once a run of any action
+// finishes.
+func (c *ConcurrencyGroups) SetLimit(name string, limit uint) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.RLock()
+	group, ok := c.groups[name]
+	c.mu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	group.SetLimit(limit)
+
+	return true
+}
+
+// Stats returns a snapshot of the usage of each group by name, the global limit under the
+// empty name.
+func (c *ConcurrencyGroups) Stats() map[string]ConcurrencyStats {
+	if c == nil {
+		return map[string]ConcurrencyStats{}
+	}
+
+	c.mu.RLock()
+	groups := maps.Clone(c.groups)
+	c.mu.RUnlock()
+
+	stats := make(map[string]ConcurrencyStats, len(groups))
+	for name, group := range groups {
+		stats[name] = group.Stats()
+	}
+
+	return stats
+}
+
+// Snapshot returns the current usage of each group by name and key, the global limit
+// under the empty name, showing which keys, e.g. tenants, hold slots right now.
+func (c *ConcurrencyGroups) Snapshot() map[string]ConcurrencySnapshot {
+	if c == nil {
+		return map[string]ConcurrencySnapshot{}
+	}
+
+	c.mu.RLock()
+	groups := maps.Clone(c.groups)
+	c.mu.RUnlock()
+
+	snapshots := make(map[string]ConcurrencySnapshot, len(groups))
+	for name, group := range groups {
+		snapshots[name] = group.Snapshot()
+	}
+
+	return snapshots
+}
+
+// Saturated returns the names of the groups whose utilization exceeds the threshold,
+// in acquisition order. The global limit is reported under the empty name.
+func (c *ConcurrencyGroups) Saturated(threshold float64) []string {
+	if c == nil {
+		return []string{}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	saturated := make([]string, 0)
+	for _, name := range c.names {
+		if c.groups[name].Utilization() > threshold {
+			saturated = append(saturated, name)
+		}
+	}
+
+	return saturated
 }
 
 // ConcurrencyLimit is a semaphore that limits the number of concurrent actions.
+// It computes the key of each acquisition with its key function and keeps a separate
+// StringConcurrencyLimit slot count per key.
 type ConcurrencyLimit struct {
-	limit      uint
-	semaphores map[string]chan struct{}
-	keyFunc    func(ctx context.Context, data any) string
-	mu         sync.RWMutex
+	*StringConcurrencyLimit
+	keyFunc func(ctx context.Context, data any) (string, error)
+	// dataKey uses the data as the key, skipping the key function
+	dataKey bool
 }
 
 // NewConcurrencyLimit creates a new ConcurrencyLimit with the specified limit and key function.
-func NewConcurrencyLimit(limit uint, keyFunc func(ctx context.Context, data any) string) *ConcurrencyLimit {
+func NewConcurrencyLimit(limit uint, keyFunc func(ctx context.Context, data any) string, opts ...ConcurrencyLimitOption) *ConcurrencyLimit {
+	var keyFuncE func(ctx context.Context, data any) (string, error)
+	if keyFunc != nil {
+		keyFuncE = func(ctx context.Context, data any) (string, error) {
+			return keyFunc(ctx, data), nil
+		}
+	}
+
+	return NewConcurrencyLimitE(limit, keyFuncE, opts...)
+}
+
+// NewConcurrencyLimitWithEvent creates a new ConcurrencyLimit with the specified limit and a
+// key function that also receives the key of the event being dispatched, so that an action
+// triggered by several events can limit each event separately. Outside of an engine
+// dispatch the event key is empty.
+func NewConcurrencyLimitWithEvent(limit uint, keyFunc func(ctx context.Context, eventKey EventKey, data any) string, opts ...ConcurrencyLimitOption) *ConcurrencyLimit {
+	var keyFuncE func(ctx context.Context, data any) (string, error)
+	if keyFunc != nil {
+		keyFuncE = func(ctx context.Context, data any) (string, error) {
+			return keyFunc(ctx, eventKeyFromContext(ctx), data), nil
+		}
+	}
+
+	return NewConcurrencyLimitE(limit, keyFuncE, opts...)
+}
+
+// NewConcurrencyLimitWithQueue creates a new ConcurrencyLimit with the specified limit and
+// key function, allowing up to maxWaiters acquirers per key to wait in Acquire for a slot.
+// Acquirers beyond that are refused immediately.
+func NewConcurrencyLimitWithQueue(limit, maxWaiters uint, keyFunc func(ctx context.Context, data any) string, opts ...ConcurrencyLimitOption) *ConcurrencyLimit {
+	concurrencyLimit := NewConcurrencyLimit(limit, keyFunc)
+	concurrencyLimit.StringConcurrencyLimit = NewStringConcurrencyLimitWithQueue(limit, maxWaiters, opts...)
+
+	return concurrencyLimit
+}
+
+// NewConcurrencyLimitE creates a new ConcurrencyLimit with the specified limit and a key
+// function that may fail.
+func NewConcurrencyLimitE(limit uint, keyFunc func(ctx context.Context, data any) (string, error), opts ...ConcurrencyLimitOption) *ConcurrencyLimit {
 	return &ConcurrencyLimit{
-		limit:      limit,
-		semaphores: make(map[string]chan struct{}),
-		keyFunc:    keyFunc,
+		StringConcurrencyLimit: NewStringConcurrencyLimit(limit, opts...),
+		keyFunc:                keyFunc,
+	}
+}
+
+// NewConcurrencyLimitByData creates a new ConcurrencyLimit keyed by the data itself,
+// which must be a string. The data is passed straight to its StringConcurrencyLimit,
+// without a key function call, and acquiring a slot for other data fails with
+// ErrKeyNotString.
+func NewConcurrencyLimitByData(limit uint, opts ...ConcurrencyLimitOption) *ConcurrencyLimit {
+	return &ConcurrencyLimit{
+		StringConcurrencyLimit: NewStringConcurrencyLimit(limit, opts...),
+		dataKey:                true,
 	}
 }
 
 // TryAcquire attempts to acquire a slot in the concurrency limit.
+// It fails when the key function returns an error or the context is already done.
 func (c *ConcurrencyLimit) TryAcquire(ctx context.Context, data any) bool {
-	key := c.getKey(ctx, data)
+	if ctx.Err() != nil {
+		return false
+	}
+
+	key, err := c.getKey(ctx, data)
+	if err != nil {
+		return false
+	}
+
+	return c.StringConcurrencyLimit.TryAcquire(ctx, key)
+}
+
+// TryAcquireN attempts to acquire n slots at once in the concurrency limit, so that heavy
+// work takes more of the limit than light work. It fails like TryAcquire, and when fewer
+// than n slots are free. The slots are released with ReleaseN.
+func (c *ConcurrencyLimit) TryAcquireN(ctx context.Context, data any, n uint) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	key, err := c.getKey(ctx, data)
+	if err != nil {
+		return false
+	}
+
+	return c.StringConcurrencyLimit.TryAcquireN(ctx, key, n)
+}
+
+// ReleaseN releases n slots acquired with TryAcquireN.
+func (c *ConcurrencyLimit) ReleaseN(ctx context.Context, data any, n uint) {
+	key, err := c.getKey(ctx, data)
+	if err != nil {
+		return
+	}
+
+	c.StringConcurrencyLimit.ReleaseN(ctx, key, n)
+}
+
+// clone returns a limit with the same configuration and key function, and no slots taken.
+func (c *ConcurrencyLimit) clone() *ConcurrencyLimit {
+	limit := NewStringConcurrencyLimitWithQueue(c.Limit(), c.maxWaiters, WithMaxKeys(c.maxKeys))
+	limit.fifo = c.fifo
+
+	return &ConcurrencyLimit{
+		StringConcurrencyLimit: limit,
+		keyFunc:                c.keyFunc,
+		dataKey:                c.dataKey,
+	}
+}
+
+// Acquire acquires a slot in the concurrency limit, waiting for one when they are all
+// taken. It returns the key function error, ErrQueueFull when the wait queue is full, or
+// the context error if the context is done before a slot frees up.
+func (c *ConcurrencyLimit) Acquire(ctx context.Context, data any) error {
+	key, err := c.getKey(ctx, data)
+	if err != nil {
+		return err
+	}
+
+	return c.StringConcurrencyLimit.Acquire(ctx, key)
+}
+
+// Release releases a slot in the concurrency limit.
+func (c *ConcurrencyLimit) Release(ctx context.Context, data any) {
+	key, err := c.getKey(ctx, data)
+	if err != nil {
+		return
+	}
+
+	c.StringConcurrencyLimit.Release(ctx, key)
+}
+
+func (c *ConcurrencyLimit) getKey(ctx context.Context, data any) (string, error) {
+	if c.dataKey {
+		key, ok := data.(string)
+		if !ok {
+			return "", ErrKeyNotString
+		}
+		return key, nil
+	}
+
+	if c.keyFunc == nil {
+		return "", nil
+	}
+
+	return c.keyFunc(ctx, data)
+}
+
+// StringConcurrencyLimit is a semaphore keyed directly by strings. It skips the key
+// function and the boxing of the data, for hot paths where the caller already has the key.
+// The engine uses it directly for the groups keyed by the data, see
+// ActionBuilder.ConcurrencyGroupByData.
+type StringConcurrencyLimit struct {
+	limit uint
+	// maxWaiters caps how many acquirers may wait for a slot of each key
+	maxWaiters uint
+	// maxKeys caps how many keys are tracked, zero means no cap
+	maxKeys int
+	keys    map[string]*keySlots
+	// fairShares picks the waiter a freed slot goes to by event key, nil hands slots over in arrival order
+	fairShares *fairShares
+	// fifo hands slots over in arrival order even with fair shares
+	fifo bool
+	// failures counts the acquisitions that failed
+	failures atomic.Uint64
+	mu       sync.Mutex
+}
+
+// keySlots tracks the slots held for a key and the acquirers waiting for one, in arrival order.
+type keySlots struct {
+	key     string
+	inUse   uint
+	waiters list.List
+}
+
+// slotWaiter is an acquirer waiting for a slot.
+type slotWaiter struct {
+	ready chan struct{}
+	// eventKey is the event the acquirer dispatches, for fair shares
+	eventKey EventKey
+	// priority orders the waiters, higher first, see ContextWithPriority
+	priority int
+}
+
+// fairShares hands freed slots over to the waiters of each event key in proportion to its
+// weight, using stride scheduling: every slot granted to an event key moves its pass forward
+// by the inverse of its weight, and the waiter whose event key has the lowest pass goes next.
+type fairShares struct {
+	weights map[EventKey]int
+	passes  map[EventKey]float64
+	// virtualTime is the pass of the last grant, event keys that were idle resume from it
+	// instead of catching up on the slots they didn't ask for
+	virtualTime float64
+}
+
+// newFairShares creates fair shares with the weights of the event keys.
+func newFairShares(weights map[EventKey]int) *fairShares {
+	return &fairShares{
+		weights: maps.Clone(weights),
+		passes:  make(map[EventKey]float64),
+	}
+}
+
+// next removes and returns the waiter the next slot goes to among the waiters with the
+// priority, the earliest waiter of the event key with the lowest pass.
+func (f *fairShares) next(waiters *list.List, priority int) *slotWaiter {
+	var chosen *list.Element
+	chosenPass := 0.0
+	for elem := waiters.Front(); elem != nil; elem = elem.Next() {
+		if elem.Value.(*slotWaiter).priority != priority {
+			continue
+		}
+
+		pass := max(f.passes[elem.Value.(*slotWaiter).eventKey], f.virtualTime)
+		if chosen == nil || pass < chosenPass {
+			chosen, chosenPass = elem, pass
+		}
+	}
+
+	waiter := waiters.Remove(chosen).(*slotWaiter)
+	weight := f.weights[waiter.eventKey]
+	if weight <= 0 {
+		weight = 1
+	}
 
+	f.virtualTime = chosenPass
+	f.passes[waiter.eventKey] = chosenPass + 1/float64(weight)
+
+	return waiter
+}
+
+// setFairShares makes freed slots go to the waiters of each event key in proportion to
+// the weights, event keys without a weight weigh 1.
+func (c *StringConcurrencyLimit) setFairShares(weights map[EventKey]int) {
 	c.mu.Lock()
-	semaphore, ok := c.semaphores[key]
+	defer c.mu.Unlock()
+
+	c.fairShares = newFairShares(weights)
+}
+
+// NewStringConcurrencyLimit creates a new StringConcurrencyLimit allowing limit slots per key.
+func NewStringConcurrencyLimit(limit uint, opts ...ConcurrencyLimitOption) *StringConcurrencyLimit {
+	return NewStringConcurrencyLimitWithQueue(limit, 0, opts...)
+}
+
+// NewStringConcurrencyLimitWithQueue creates a new StringConcurrencyLimit allowing limit
+// slots per key, and up to maxWaiters acquirers per key to wait in Acquire for a slot.
+func NewStringConcurrencyLimitWithQueue(limit, maxWaiters uint, opts ...ConcurrencyLimitOption) *StringConcurrencyLimit {
+	concurrencyLimit := &StringConcurrencyLimit{
+		limit:      limit,
+		maxWaiters: maxWaiters,
+		keys:       make(map[string]*keySlots),
+	}
+
+	for _, opt := range opts {
+		opt(concurrencyLimit)
+	}
+
+	return concurrencyLimit
+}
+
+// TryAcquire attempts to acquire a slot for the key without waiting. It fails while
+// other acquirers are waiting for the key, so that it doesn't jump the queue, and when
+// the context is already done, since the slot would be wasted.
+func (c *StringConcurrencyLimit) TryAcquire(ctx context.Context, key string) bool {
+	if ctx.Err() != nil {
+		c.failures.Add(1)
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	slots, ok := c.slotsFor(key)
 	if !ok {
-		semaphore = make(chan struct{}, c.limit)
-		c.semaphores[key] = semaphore
+		c.failures.Add(1)
+		return false
 	}
-	c.mu.Unlock()
 
-	select {
-	case semaphore <- struct{}{}:
+	if slots.inUse < c.limit && slots.waiters.Len() == 0 {
+		slots.inUse++
 		return true
-	default:
+	}
+	c.forgetIdle(slots)
+	c.failures.Add(1)
+
+	return false
+}
+
+// TryAcquireN attempts to acquire n slots for the key at once without waiting. It fails
+// when fewer than n slots are free, and like TryAcquire while other acquirers are waiting
+// or the context is done. Acquiring zero slots always succeeds.
+func (c *StringConcurrencyLimit) TryAcquireN(ctx context.Context, key string, n uint) bool {
+	if ctx.Err() != nil {
+		c.failures.Add(1)
 		return false
 	}
+	if n == 0 {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	slots, ok := c.slotsFor(key)
+	if !ok {
+		c.failures.Add(1)
+		return false
+	}
+
+	if slots.inUse+n <= c.limit && slots.waiters.Len() == 0 {
+		slots.inUse += n
+		return true
+	}
+	c.forgetIdle(slots)
+	c.failures.Add(1)
+
+	return false
 }
 
-// Release releases a slot in the concurrency limit.
-func (c *ConcurrencyLimit) Release(ctx context.Context, data any) {
-	key := c.getKey(ctx, data)
+// Acquire acquires a slot for the key, waiting for one when they are all taken, in
+// arrival order among the acquirers with the same priority, see ContextWithPriority. It returns ErrQueueFull without waiting when maxWaiters acquirers are
+// already waiting for the key, ErrKeyCapReached when the key can't be tracked, or the
+// context error if the context is done first.
+func (c *StringConcurrencyLimit) Acquire(ctx context.Context, key string) error {
+	return c.acquire(ctx, key, true)
+}
 
-	c.mu.RLock()
-	semaphore, ok := c.semaphores[key]
-	c.mu.RUnlock()
+// acquire acquires a slot for the key, waiting for one in arrival order. The wait queue
+// caps the waiters only when capped.
+func (c *StringConcurrencyLimit) acquire(ctx context.Context, key string, capped bool) error {
+	c.mu.Lock()
+	slots, ok := c.slotsFor(key)
+	if !ok {
+		c.mu.Unlock()
+		c.failures.Add(1)
+		return ErrKeyCapReached
+	}
+
+	if slots.inUse < c.limit && slots.waiters.Len() == 0 {
+		slots.inUse++
+		c.mu.Unlock()
+		return nil
+	}
+
+	if capped && uint(slots.waiters.Len()) >= c.maxWaiters {
+		c.forgetIdle(slots)
+		c.mu.Unlock()
+		c.failures.Add(1)
+		return ErrQueueFull
+	}
+
+	waiter := &slotWaiter{ready: make(chan struct{}), eventKey: eventKeyFromContext(ctx), priority: priorityFromContext(ctx)}
+	elem := slots.waiters.PushBack(waiter)
+	c.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		defer c.mu.Unlock()
 
-	if ok {
-		// Non-blocking release - if channel is empty, don't block
 		select {
-		case <-semaphore:
-			// Successfully released
+		case <-waiter.ready:
+			// The slot was handed over while giving up, pass it on
+			c.release(slots)
 		default:
-			// Channel is empty (over-release), do nothing
+			slots.waiters.Remove(elem)
+			c.forgetIdle(slots)
+		}
+
+		c.failures.Add(1)
+		return ctx.Err()
+	}
+}
+
+// Release releases a slot for the key, handing it over to the first waiting acquirer.
+func (c *StringConcurrencyLimit) Release(_ context.Context, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if slots, ok := c.keys[key]; ok {
+		c.release(slots)
+	}
+}
+
+// ReleaseN releases n slots for the key, handing each over to the first waiting acquirer.
+func (c *StringConcurrencyLimit) ReleaseN(_ context.Context, key string, n uint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if slots, ok := c.keys[key]; ok {
+		for range n {
+			c.release(slots)
+		}
+	}
+}
+
+// slotsFor returns the slots of the key, creating them if needed. It returns false when
+// the key cap is reached. The caller must hold the lock.
+func (c *StringConcurrencyLimit) slotsFor(key string) (*keySlots, bool) {
+	if slots, ok := c.keys[key]; ok {
+		return slots, true
+	}
+
+	if c.maxKeys > 0 && len(c.keys) >= c.maxKeys {
+		return nil, false
+	}
+
+	slots := &keySlots{key: key}
+	c.keys[key] = slots
+
+	return slots, true
+}
+
+// release frees a slot or hands it over to a waiter. The caller must hold the lock.
+func (c *StringConcurrencyLimit) release(slots *keySlots) {
+	// Over-release, do nothing
+	if slots.inUse == 0 {
+		return
+	}
+
+	// Slots held over a lowered limit are freed rather than handed over
+	if slots.waiters.Len() > 0 && slots.inUse <= c.limit {
+		c.handOver(slots)
+		return
+	}
+
+	slots.inUse--
+	c.forgetIdle(slots)
+}
+
+// forgetIdle stops tracking the key of the slots once none is held or waited for, so that
+// limits keyed by high cardinality values, like user ids, don't grow without bound. The
+// caller must hold the lock.
+func (c *StringConcurrencyLimit) forgetIdle(slots *keySlots) {
+	if slots.inUse == 0 && slots.waiters.Len() == 0 && c.keys[slots.key] == slots {
+		delete(c.keys, slots.key)
+	}
+}
+
+// Len returns the number of keys tracked, those holding or waiting for slots.
+func (c *StringConcurrencyLimit) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.keys)
+}
+
+// handOver gives a held slot to the first waiter with the highest priority, or to the
+// waiter picked among them by the fair shares unless the limit is FIFO. The caller must
+// hold the lock.
+func (c *StringConcurrencyLimit) handOver(slots *keySlots) {
+	first := slots.waiters.Front()
+	priority := first.Value.(*slotWaiter).priority
+	for elem := first.Next(); elem != nil; elem = elem.Next() {
+		if waiter := elem.Value.(*slotWaiter); waiter.priority > priority {
+			first, priority = elem, waiter.priority
+		}
+	}
+
+	if c.fairShares != nil && !c.fifo {
+		close(c.fairShares.next(&slots.waiters, priority).ready)
+		return
+	}
+
+	close(slots.waiters.Remove(first).(*slotWaiter).ready)
+}
+
+// SetLimit changes the number of slots per key while the limit is in use, e.g. from an
+// admin API, without registering the actions again. Raising it hands the new slots over
+// to the waiting acquirers right away. Lowering it lets the holders keep their slots,
+// new acquisitions fail until enough of them are released. A limit of zero refuses
+// every acquisition.
+func (c *StringConcurrencyLimit) SetLimit(limit uint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.limit = limit
+	for _, slots := range c.keys {
+		for slots.waiters.Len() > 0 && slots.inUse < c.limit {
+			slots.inUse++
+			c.handOver(slots)
 		}
 	}
 }
 
-func (c *ConcurrencyLimit) getKey(ctx context.Context, data any) string {
-	key := ""
+// InUse returns the number of slots currently held across all keys.
+func (c *StringConcurrencyLimit) InUse() uint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	inUse := uint(0)
+	for _, slots := range c.keys {
+		inUse += slots.inUse
+	}
+
+	return inUse
+}
+
+// Limit returns the configured number of slots per key.
+func (c *StringConcurrencyLimit) Limit() uint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.limit
+}
+
+// Waiting returns the number of acquirers waiting for a slot across all keys.
+func (c *StringConcurrencyLimit) Waiting() uint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	waiting := uint(0)
+	for _, slots := range c.keys {
+		waiting += uint(slots.waiters.Len())
+	}
+
+	return waiting
+}
+
+// ConcurrencyStats is a snapshot of the usage of a concurrency limit, for exporting gauges
+// of its saturation.
+type ConcurrencyStats struct {
+	// Limit is the number of slots per key
+	Limit uint
+	// InUse is the number of slots held across all keys
+	InUse uint
+	// Waiting is the number of acquirers waiting for a slot across all keys
+	Waiting uint
+	// Keys is the number of keys holding or waiting for slots
+	Keys int
+	// AcquireFailures counts the acquisitions that failed since the limit was created,
+	// whether refused right away or given up while waiting
+	AcquireFailures uint64
+}
+
+// Stats returns a snapshot of the usage of the limit.
+func (c *StringConcurrencyLimit) Stats() ConcurrencyStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := ConcurrencyStats{
+		Limit:           c.limit,
+		Keys:            len(c.keys),
+		AcquireFailures: c.failures.Load(),
+	}
+	for _, slots := range c.keys {
+		stats.InUse += slots.inUse
+		stats.Waiting += uint(slots.waiters.Len())
+	}
+
+	return stats
+}
+
+// ConcurrencySnapshot is the state of a concurrency limit at a point in time, showing
+// which keys hold slots, e.g. for an admin endpoint.
+type ConcurrencySnapshot struct {
+	// Limit is the number of slots per key
+	Limit uint
+	// Keys holds the usage of each key holding or waiting for slots
+	Keys map[string]KeyUsage
+}
+
+// KeyUsage is the usage of the slots of a key.
+type KeyUsage struct {
+	// InUse is the number of slots held for the key
+	InUse uint
+	// Waiting is the number of acquirers waiting for a slot of the key
+	Waiting uint
+}
+
+// Snapshot returns the current usage of the limit by key.
+func (c *StringConcurrencyLimit) Snapshot() ConcurrencySnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snapshot := ConcurrencySnapshot{
+		Limit: c.limit,
+		Keys:  make(map[string]KeyUsage, len(c.keys)),
+	}
+	for key, slots := range c.keys {
+		snapshot.Keys[key] = KeyUsage{InUse: slots.inUse, Waiting: uint(slots.waiters.Len())}
+	}
+
+	return snapshot
+}
 
-	if c.keyFunc != nil {
-		key = c.keyFunc(ctx, data)
+// Utilization returns the ratio of slots held across all keys to the limit.
+// A limit of zero always reports zero utilization.
+func (c *StringConcurrencyLimit) Utilization() float64 {
+	limit := c.Limit()
+	if limit == 0 {
+		return 0
 	}
 
-	return key
+	return float64(c.InUse()) / float64(limit)
 }
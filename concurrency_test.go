@@ -2,6 +2,7 @@ package waffle_test
 
 import (
 	"context"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -112,6 +113,250 @@ func TestConcurrencyGroups_MultipleGroups(t *testing.T) {
 	require.False(t, acquired4)
 }
 
+func TestConcurrencyGroups_ReplaceKeyFunc(t *testing.T) {
+	type request struct {
+		user   string
+		tenant string
+	}
+
+	groups := waffle.NewConcurrencyGroups()
+	groups.Add("group", 1, func(_ context.Context, data any) string {
+		return data.(request).user
+	})
+
+	acquired, releaseAlice := groups.TryAcquire(t.Context(), request{user: "alice", tenant: "acme"})
+	require.True(t, acquired)
+
+	require.True(t, groups.ReplaceKeyFunc("group", func(_ context.Context, data any) string {
+		return data.(request).tenant
+	}))
+	require.False(t, groups.ReplaceKeyFunc("missing", nil))
+
+	// New acquisitions are keyed by tenant, while alice still holds the slot of her user key
+	acquired, releaseBob := groups.TryAcquire(t.Context(), request{user: "bob", tenant: "acme"})
+	require.True(t, acquired)
+	acquired, _ = groups.TryAcquire(t.Context(), request{user: "carol", tenant: "acme"})
+	require.False(t, acquired)
+
+	// Alice releases her user key, leaving bob's tenant slot taken
+	releaseAlice()
+	acquired, _ = groups.TryAcquire(t.Context(), request{user: "carol", tenant: "acme"})
+	require.False(t, acquired)
+	require.Equal(t, []string{"group"}, groups.Saturated(0))
+
+	releaseBob()
+	require.Empty(t, groups.Saturated(0))
+}
+
+func TestConcurrencyGroups_Merge(t *testing.T) {
+	tenant := waffle.NewConcurrencyGroups()
+	tenant.Add("tenant", 1, func(_ context.Context, data any) string {
+		return data.([]string)[0]
+	})
+
+	resource := waffle.NewConcurrencyGroups()
+	resource.Add("resource", 1, func(_ context.Context, data any) string {
+		return data.([]string)[1]
+	})
+
+	groups := waffle.NewConcurrencyGroups()
+	require.NoError(t, groups.Merge(tenant))
+	require.NoError(t, groups.Merge(resource))
+
+	acquired, release := groups.TryAcquire(t.Context(), []string{"acme", "db"})
+	require.True(t, acquired)
+
+	// Both limits apply
+	acquired, _ = groups.TryAcquire(t.Context(), []string{"acme", "cache"})
+	require.False(t, acquired)
+	acquired, _ = groups.TryAcquire(t.Context(), []string{"globex", "db"})
+	require.False(t, acquired)
+
+	// The merged groups have their own slots
+	acquired, _ = tenant.TryAcquire(t.Context(), []string{"acme", "db"})
+	require.True(t, acquired)
+
+	release()
+	acquired, _ = groups.TryAcquire(t.Context(), []string{"globex", "cache"})
+	require.True(t, acquired)
+}
+
+func TestConcurrencyGroups_MergeCollision(t *testing.T) {
+	keyFunc := func(_ context.Context, _ any) string {
+		return ""
+	}
+
+	policy := waffle.NewConcurrencyGroups()
+	policy.Add("other", 1, keyFunc)
+	policy.Add("tenant", 1, keyFunc)
+
+	groups := waffle.NewConcurrencyGroups()
+	groups.Add("tenant", 2, keyFunc)
+
+	require.EqualError(t, groups.Merge(policy), `concurrency group "tenant" already exists`)
+
+	// Nothing was merged
+	acquired, release := groups.TryAcquire(t.Context(), nil)
+	require.True(t, acquired)
+	release()
+	require.Equal(t, []string{"tenant"}, groups.Saturated(-1))
+}
+
+func TestConcurrencyGroups_Remove(t *testing.T) {
+	groups := waffle.NewConcurrencyGroups()
+	groups.AddGlobalLimit(1)
+	groups.Add("tenant", 1, func(_ context.Context, _ any) string {
+		return "acme"
+	})
+
+	acquired, release := groups.TryAcquire(t.Context(), nil)
+	require.True(t, acquired)
+
+	require.True(t, groups.Remove(""))
+	require.False(t, groups.Remove(""))
+	_, ok := groups.GroupLimit("")
+	require.False(t, ok)
+
+	// The remaining group still limits the runs
+	acquired, _ = groups.TryAcquire(t.Context(), nil)
+	require.False(t, acquired)
+
+	// Slots held before the removal are released as usual
+	release()
+	acquired, _ = groups.TryAcquire(t.Context(), nil)
+	require.True(t, acquired)
+
+	// The group can be added again with another limit
+	groups.Add("tenant", 2, func(_ context.Context, _ any) string {
+		return "acme"
+	})
+	acquired, _ = groups.TryAcquire(t.Context(), nil)
+	require.True(t, acquired)
+}
+
+func TestConcurrencyGroups_Reset(t *testing.T) {
+	groups := waffle.NewConcurrencyGroups()
+	groups.AddGlobalLimit(1)
+	groups.Add("tenant", 1, func(_ context.Context, _ any) string {
+		return "acme"
+	})
+
+	acquired, _ := groups.TryAcquire(t.Context(), nil)
+	require.True(t, acquired)
+
+	groups.Reset()
+	require.Empty(t, groups.Stats())
+
+	// Without groups nothing is limited until they are added again
+	acquired, _ = groups.TryAcquire(t.Context(), nil)
+	require.True(t, acquired)
+
+	groups.AddGlobalLimit(1)
+	acquired, _ = groups.TryAcquire(t.Context(), nil)
+	require.True(t, acquired)
+	acquired, _ = groups.TryAcquire(t.Context(), nil)
+	require.False(t, acquired)
+}
+
+func TestConcurrencyGroups_Nil(t *testing.T) {
+	var groups *waffle.ConcurrencyGroups
+
+	acquired, release := groups.TryAcquire(t.Context(), nil)
+	require.True(t, acquired)
+	release()
+
+	require.Empty(t, groups.Saturated(0))
+	require.False(t, groups.ReplaceKeyFunc("group", nil))
+	require.NoError(t, waffle.NewConcurrencyGroups().Merge(groups))
+}
+
+func TestConcurrencyGroups_GroupLimit(t *testing.T) {
+	groups := waffle.NewConcurrencyGroups()
+	groups.AddGlobalLimit(3)
+	groups.Add("group", 5, func(_ context.Context, _ any) string {
+		return ""
+	})
+
+	limit, ok := groups.GroupLimit("group")
+	require.True(t, ok)
+	require.Equal(t, uint(5), limit)
+
+	limit, ok = groups.GroupLimit("")
+	require.True(t, ok)
+	require.Equal(t, uint(3), limit)
+
+	limit, ok = groups.GroupLimit("unknown")
+	require.False(t, ok)
+	require.Equal(t, uint(0), limit)
+
+	require.Equal(t, uint(5), waffle.NewConcurrencyLimit(5, nil).Limit())
+}
+
+func TestConcurrencyGroups_SetLimit(t *testing.T) {
+	groups := waffle.NewConcurrencyGroups()
+	groups.AddGlobalLimit(1)
+	groups.Add("tenant", 1, func(_ context.Context, data any) string {
+		return data.(string)
+	})
+
+	require.True(t, groups.SetLimit("", 3))
+	require.True(t, groups.SetLimit("tenant", 2))
+	require.False(t, groups.SetLimit("unknown", 2))
+
+	limit, _ := groups.GroupLimit("tenant")
+	require.Equal(t, uint(2), limit)
+
+	acquired, _ := groups.TryAcquire(t.Context(), "acme")
+	require.True(t, acquired)
+	acquired, _ = groups.TryAcquire(t.Context(), "acme")
+	require.True(t, acquired)
+	acquired, _ = groups.TryAcquire(t.Context(), "acme")
+	require.False(t, acquired)
+}
+
+func TestConcurrencyLimit_SetLimit(t *testing.T) {
+	limit := waffle.NewConcurrencyLimitWithQueue(1, 2, nil)
+	require.NoError(t, limit.Acquire(t.Context(), nil))
+
+	acquired := make(chan error, 2)
+	for range 2 {
+		go func() {
+			acquired <- limit.Acquire(t.Context(), nil)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return limit.Waiting() == 2
+	}, time.Second, time.Millisecond)
+
+	// Raising the limit hands the new slots over to the waiters
+	limit.SetLimit(3)
+	require.NoError(t, <-acquired)
+	require.NoError(t, <-acquired)
+	require.Equal(t, uint(3), limit.InUse())
+
+	// Lowering it lets the holders keep their slots until they release them
+	limit.SetLimit(1)
+	require.Equal(t, uint(3), limit.InUse())
+	require.False(t, limit.TryAcquire(t.Context(), nil))
+
+	go func() {
+		acquired <- limit.Acquire(t.Context(), nil)
+	}()
+	require.Eventually(t, func() bool {
+		return limit.Waiting() == 1
+	}, time.Second, time.Millisecond)
+
+	// Slots over the lowered limit are freed rather than handed over
+	limit.Release(t.Context(), nil)
+	limit.Release(t.Context(), nil)
+	require.Equal(t, uint(1), limit.InUse())
+	require.Equal(t, uint(1), limit.Waiting())
+
+	limit.Release(t.Context(), nil)
+	require.NoError(t, <-acquired)
+	require.Equal(t, uint(1), limit.InUse())
+}
+
 func TestConcurrencyLimit_BasicAcquireRelease(t *testing.T) {
 	limit := waffle.NewConcurrencyLimit(2, nil)
 
@@ -127,6 +372,68 @@ func TestConcurrencyLimit_BasicAcquireRelease(t *testing.T) {
 	require.True(t, limit.TryAcquire(t.Context(), "test"))
 }
 
+func TestConcurrencyLimit_TryAcquireN(t *testing.T) {
+	limit := waffle.NewConcurrencyLimit(5, nil)
+
+	// Heavy work takes more of the limit than light work
+	require.True(t, limit.TryAcquireN(t.Context(), "heavy", 3))
+	require.True(t, limit.TryAcquire(t.Context(), "light"))
+	require.Equal(t, uint(4), limit.InUse())
+
+	require.False(t, limit.TryAcquireN(t.Context(), "heavy", 2))
+	require.True(t, limit.TryAcquireN(t.Context(), "heavy", 1))
+	require.False(t, limit.TryAcquireN(t.Context(), "heavy", 6))
+	require.True(t, limit.TryAcquireN(t.Context(), "heavy", 0))
+
+	limit.ReleaseN(t.Context(), "heavy", 3)
+	require.Equal(t, uint(2), limit.InUse())
+	require.True(t, limit.TryAcquireN(t.Context(), "heavy", 3))
+}
+
+func TestConcurrencyLimitWithQueue_ReleaseN(t *testing.T) {
+	limit := waffle.NewConcurrencyLimitWithQueue(2, 2, nil)
+
+	require.True(t, limit.TryAcquireN(t.Context(), nil, 2))
+
+	acquired := make(chan error, 2)
+	for range 2 {
+		go func() {
+			acquired <- limit.Acquire(t.Context(), nil)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return limit.Waiting() == 2
+	}, time.Second, time.Millisecond)
+
+	// Waiters don't let weighted acquirers jump the queue
+	require.False(t, limit.TryAcquireN(t.Context(), nil, 1))
+
+	// Each released slot goes to a waiter
+	limit.ReleaseN(t.Context(), nil, 2)
+	require.NoError(t, <-acquired)
+	require.NoError(t, <-acquired)
+	require.Equal(t, uint(2), limit.InUse())
+	require.Equal(t, uint(0), limit.Waiting())
+}
+
+func TestConcurrencyLimit_TryAcquireContextDone(t *testing.T) {
+	limit := waffle.NewConcurrencyLimit(1, nil)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	require.False(t, limit.TryAcquire(ctx, "test"))
+	require.Equal(t, uint(0), limit.InUse())
+
+	groups := waffle.NewConcurrencyGroups()
+	groups.AddLimit("", limit)
+	acquired, _ := groups.TryAcquire(ctx, "test")
+	require.False(t, acquired)
+	require.Equal(t, uint(0), limit.InUse())
+
+	require.True(t, limit.TryAcquire(t.Context(), "test"))
+}
+
 func TestConcurrencyLimit_ZeroLimit(t *testing.T) {
 	limit := waffle.NewConcurrencyLimit(0, nil)
 
@@ -233,6 +540,174 @@ func TestConcurrencyLimit_ReleaseUnknownKey(t *testing.T) {
 	}
 }
 
+func TestConcurrencyLimitWithQueue_Acquire(t *testing.T) {
+	limit := waffle.NewConcurrencyLimitWithQueue(1, 1, nil)
+
+	require.NoError(t, limit.Acquire(t.Context(), nil))
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- limit.Acquire(t.Context(), nil)
+	}()
+
+	require.Eventually(t, func() bool {
+		return limit.Waiting() == 1
+	}, time.Second, time.Millisecond)
+
+	// The queue is full, so further acquirers are refused, including non waiting ones
+	require.ErrorIs(t, limit.Acquire(t.Context(), nil), waffle.ErrQueueFull)
+	require.False(t, limit.TryAcquire(t.Context(), nil))
+
+	// Releasing hands the slot over to the waiter
+	limit.Release(t.Context(), nil)
+	require.NoError(t, <-acquired)
+	require.Equal(t, uint(1), limit.InUse())
+	require.Equal(t, uint(0), limit.Waiting())
+
+	limit.Release(t.Context(), nil)
+	require.Equal(t, uint(0), limit.InUse())
+}
+
+func TestConcurrencyLimitWithQueue_Priority(t *testing.T) {
+	limit := waffle.NewStringConcurrencyLimitWithQueue(1, 10)
+	require.True(t, limit.TryAcquire(t.Context(), ""))
+
+	acquired := make(chan string, 4)
+	waiters := []struct {
+		name     string
+		priority int
+	}{
+		{name: "batch-1", priority: 0},
+		{name: "interactive-1", priority: 10},
+		{name: "batch-2", priority: 0},
+		{name: "interactive-2", priority: 10},
+	}
+	for i, waiter := range waiters {
+		go func() {
+			ctx := waffle.ContextWithPriority(t.Context(), waiter.priority)
+			if limit.Acquire(ctx, "") == nil {
+				acquired <- waiter.name
+			}
+		}()
+		require.Eventually(t, func() bool {
+			return limit.Waiting() == uint(i+1)
+		}, time.Second, time.Millisecond)
+	}
+
+	// Higher priorities go first, in arrival order within a priority
+	for _, name := range []string{"interactive-1", "interactive-2", "batch-1", "batch-2"} {
+		limit.Release(t.Context(), "")
+		require.Equal(t, name, <-acquired)
+	}
+}
+
+func TestConcurrencyLimitWithQueue_AcquireContextDone(t *testing.T) {
+	limit := waffle.NewConcurrencyLimitWithQueue(1, 1, nil)
+	require.NoError(t, limit.Acquire(t.Context(), nil))
+
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+
+	require.ErrorIs(t, limit.Acquire(ctx, nil), context.DeadlineExceeded)
+	require.Equal(t, uint(0), limit.Waiting())
+
+	// The slot isn't handed over to the waiter that gave up
+	limit.Release(t.Context(), nil)
+	require.Equal(t, uint(0), limit.InUse())
+}
+
+func TestConcurrencyGroups_Acquire(t *testing.T) {
+	first := waffle.NewConcurrencyLimitWithQueue(1, 1, nil)
+	second := waffle.NewConcurrencyLimitWithQueue(1, 1, nil)
+
+	groups := waffle.NewConcurrencyGroups()
+	groups.AddLimit("a", first)
+	groups.AddLimit("b", second)
+
+	// Hold the second group so that Acquire blocks on it
+	require.NoError(t, second.Acquire(t.Context(), nil))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	result := make(chan bool)
+	go func() {
+		acquired, _ := groups.Acquire(ctx, nil)
+		result <- acquired
+	}()
+
+	require.Eventually(t, func() bool {
+		return first.InUse() == 1 && second.Waiting() == 1
+	}, time.Second, time.Millisecond)
+
+	// Cancelling while blocked on the second group frees the first one
+	cancel()
+	require.False(t, <-result)
+	require.Equal(t, uint(0), first.InUse())
+	require.Equal(t, uint(0), second.Waiting())
+
+	second.Release(t.Context(), nil)
+	acquired, release := groups.Acquire(t.Context(), nil)
+	require.True(t, acquired)
+	release()
+	require.Equal(t, uint(0), first.InUse()+second.InUse())
+}
+
+func TestConcurrencyLimit_AcquireWithoutQueue(t *testing.T) {
+	limit := waffle.NewConcurrencyLimit(1, nil)
+
+	require.NoError(t, limit.Acquire(t.Context(), nil))
+	require.ErrorIs(t, limit.Acquire(t.Context(), nil), waffle.ErrQueueFull)
+}
+
+func TestStringConcurrencyLimit_ForgetsIdleKeys(t *testing.T) {
+	limit := waffle.NewStringConcurrencyLimitWithQueue(1, 1)
+
+	for i := range 100 {
+		require.True(t, limit.TryAcquire(t.Context(), strconv.Itoa(i)))
+	}
+	require.Equal(t, 100, limit.Len())
+
+	// Released keys are forgotten
+	for i := range 100 {
+		limit.Release(t.Context(), strconv.Itoa(i))
+	}
+	require.Equal(t, 0, limit.Len())
+
+	// So are the keys of waiters that gave up
+	require.True(t, limit.TryAcquire(t.Context(), "user"))
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, limit.Acquire(ctx, "user"), context.DeadlineExceeded)
+	require.Equal(t, 1, limit.Len())
+	limit.Release(t.Context(), "user")
+	require.Equal(t, 0, limit.Len())
+
+	// And keys that failed to acquire
+	limit.SetLimit(0)
+	require.False(t, limit.TryAcquire(t.Context(), "user"))
+	require.Equal(t, 0, limit.Len())
+}
+
+func TestStringConcurrencyLimit_WithMaxKeys(t *testing.T) {
+	limit := waffle.NewStringConcurrencyLimit(1, waffle.WithMaxKeys(2))
+
+	require.True(t, limit.TryAcquire(t.Context(), "a"))
+	require.True(t, limit.TryAcquire(t.Context(), "b"))
+
+	// A third key can't be tracked while both keys hold slots
+	require.False(t, limit.TryAcquire(t.Context(), "c"))
+	require.ErrorIs(t, limit.Acquire(t.Context(), "c"), waffle.ErrKeyCapReached)
+
+	// Existing keys keep working
+	limit.Release(t.Context(), "a")
+	require.True(t, limit.TryAcquire(t.Context(), "a"))
+
+	// Once a key is idle, a new key takes its place
+	limit.Release(t.Context(), "b")
+	require.True(t, limit.TryAcquire(t.Context(), "c"))
+	require.False(t, limit.TryAcquire(t.Context(), "b"))
+	require.Equal(t, uint(2), limit.InUse())
+}
+
 func BenchmarkConcurrencyLimit(b *testing.B) {
 	limit := waffle.NewConcurrencyLimit(100, func(_ context.Context, data any) string {
 		return data.(string)
@@ -251,6 +726,50 @@ func BenchmarkConcurrencyLimit(b *testing.B) {
 	})
 }
 
+func BenchmarkConcurrencyLimit_Keys(b *testing.B) {
+	limit := waffle.NewConcurrencyLimit(100, func(_ context.Context, data any) string {
+		return data.(string)
+	})
+	keys := benchmarkKeys()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if limit.TryAcquire(context.Background(), key) {
+				limit.Release(context.Background(), key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkStringConcurrencyLimit(b *testing.B) {
+	limit := waffle.NewStringConcurrencyLimit(100)
+	keys := benchmarkKeys()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if limit.TryAcquire(context.Background(), key) {
+				limit.Release(context.Background(), key)
+			}
+			i++
+		}
+	})
+}
+
+func benchmarkKeys() []string {
+	keys := make([]string, 10)
+	for i := range keys {
+		keys[i] = string(rune('a' + i))
+	}
+	return keys
+}
+
 func BenchmarkConcurrencyGroups(b *testing.B) {
 	groups := waffle.NewConcurrencyGroups()
 	groups.AddGlobalLimit(100)
@@ -264,3 +783,360 @@ func BenchmarkConcurrencyGroups(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkConcurrencyGroups_KeyFunc(b *testing.B) {
+	groups := waffle.NewConcurrencyGroups()
+	groups.Add("user", 100, func(_ context.Context, data any) string {
+		return data.(string)
+	})
+	keys := benchmarkKeys()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if acquired, release := groups.TryAcquire(context.Background(), keys[i%len(keys)]); acquired {
+				release()
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkConcurrencyGroups_ByData(b *testing.B) {
+	groups := waffle.NewConcurrencyGroups()
+	groups.AddByData("user", 100)
+	keys := benchmarkKeys()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if acquired, release := groups.TryAcquire(context.Background(), keys[i%len(keys)]); acquired {
+				release()
+			}
+			i++
+		}
+	})
+}
+
+func TestConcurrencyLimitByData(t *testing.T) {
+	limit := waffle.NewConcurrencyLimitByData(1)
+
+	require.True(t, limit.TryAcquire(t.Context(), "alice"))
+	require.False(t, limit.TryAcquire(t.Context(), "alice"))
+	require.True(t, limit.TryAcquire(t.Context(), "bob"))
+	require.False(t, limit.TryAcquire(t.Context(), 42))
+	require.ErrorIs(t, limit.Acquire(t.Context(), 42), waffle.ErrKeyNotString)
+
+	limit.Release(t.Context(), "alice")
+	require.True(t, limit.StringConcurrencyLimit.TryAcquire(t.Context(), "alice"))
+}
+
+func TestConcurrencyGroups_Stats(t *testing.T) {
+	groups := waffle.NewConcurrencyGroups()
+	groups.AddGlobalLimit(3)
+	groups.Add("tenant", 1, func(_ context.Context, data any) string {
+		return data.(string)
+	})
+
+	acquired, _ := groups.TryAcquire(t.Context(), "acme")
+	require.True(t, acquired)
+	acquired, _ = groups.TryAcquire(t.Context(), "globex")
+	require.True(t, acquired)
+	acquired, _ = groups.TryAcquire(t.Context(), "acme")
+	require.False(t, acquired)
+
+	require.Equal(t, map[string]waffle.ConcurrencyStats{
+		"": {
+			Limit: 3,
+			InUse: 2,
+			Keys:  1,
+		},
+		"tenant": {
+			Limit:           1,
+			InUse:           2,
+			Keys:            2,
+			AcquireFailures: 1,
+		},
+	}, groups.Stats())
+
+	var empty *waffle.ConcurrencyGroups
+	require.Empty(t, empty.Stats())
+}
+
+func TestConcurrencyGroups_Snapshot(t *testing.T) {
+	groups := waffle.NewConcurrencyGroups()
+	groups.AddGlobalLimit(5)
+	groups.Add("tenant", 2, func(_ context.Context, data any) string {
+		return data.(string)
+	})
+
+	_, releaseAcme := groups.TryAcquire(t.Context(), "acme")
+	groups.TryAcquire(t.Context(), "acme")
+	groups.TryAcquire(t.Context(), "globex")
+
+	require.Equal(t, map[string]waffle.ConcurrencySnapshot{
+		"": {
+			Limit: 5,
+			Keys:  map[string]waffle.KeyUsage{"": {InUse: 3}},
+		},
+		"tenant": {
+			Limit: 2,
+			Keys: map[string]waffle.KeyUsage{
+				"acme":   {InUse: 2},
+				"globex": {InUse: 1},
+			},
+		},
+	}, groups.Snapshot())
+
+	releaseAcme()
+	require.Equal(t, waffle.KeyUsage{InUse: 1}, groups.Snapshot()["tenant"].Keys["acme"])
+
+	var empty *waffle.ConcurrencyGroups
+	require.Empty(t, empty.Snapshot())
+}
+
+func TestStringConcurrencyLimit_Stats(t *testing.T) {
+	limit := waffle.NewStringConcurrencyLimitWithQueue(1, 1)
+	require.True(t, limit.TryAcquire(t.Context(), "user"))
+
+	go func() {
+		_ = limit.Acquire(t.Context(), "user")
+	}()
+	require.Eventually(t, func() bool {
+		return limit.Stats().Waiting == 1
+	}, time.Second, time.Millisecond)
+
+	require.ErrorIs(t, limit.Acquire(t.Context(), "user"), waffle.ErrQueueFull)
+	require.Equal(t, waffle.ConcurrencyStats{
+		Limit:           1,
+		InUse:           1,
+		Waiting:         1,
+		Keys:            1,
+		AcquireFailures: 1,
+	}, limit.Stats())
+
+	limit.Release(t.Context(), "user")
+	limit.Release(t.Context(), "user")
+	require.Equal(t, 0, limit.Stats().Keys)
+}
+
+func TestConcurrencyGroups_Saturated(t *testing.T) {
+	groups := waffle.NewConcurrencyGroups()
+	groups.Add("user", 2, func(_ context.Context, data any) string {
+		return data.(string)
+	})
+	groups.Add("tenant", 2, func(_ context.Context, _ any) string {
+		return "tenant1"
+	})
+
+	require.Empty(t, groups.Saturated(0.4))
+
+	// Hold one of the two slots in each group
+	acquired, release := groups.TryAcquire(t.Context(), "user1")
+	require.True(t, acquired)
+
+	require.Equal(t, []string{"tenant", "user"}, groups.Saturated(0.4))
+	require.Empty(t, groups.Saturated(0.6))
+
+	release()
+	require.Empty(t, groups.Saturated(0.4))
+}
+
+func TestConcurrencyGroups_Saturated_AggregatesKeys(t *testing.T) {
+	groups := waffle.NewConcurrencyGroups()
+	groups.Add("user", 2, func(_ context.Context, data any) string {
+		return data.(string)
+	})
+
+	// One slot per key, the busiest key is only half full
+	acquired1, _ := groups.TryAcquire(t.Context(), "user1")
+	require.True(t, acquired1)
+	acquired2, _ := groups.TryAcquire(t.Context(), "user2")
+	require.True(t, acquired2)
+
+	// Usage is aggregated across keys: 2 held out of a limit of 2
+	require.Equal(t, []string{"user"}, groups.Saturated(0.6))
+	require.Empty(t, groups.Saturated(1))
+}
+
+func TestConcurrencyLimit_Utilization(t *testing.T) {
+	limit := waffle.NewConcurrencyLimit(4, func(_ context.Context, data any) string {
+		return data.(string)
+	})
+
+	require.True(t, limit.TryAcquire(t.Context(), "key1"))
+	require.True(t, limit.TryAcquire(t.Context(), "key1"))
+	require.True(t, limit.TryAcquire(t.Context(), "key2"))
+
+	require.Equal(t, uint(3), limit.InUse())
+	require.InDelta(t, 0.75, limit.Utilization(), 0.001)
+
+	limit.Release(t.Context(), "key1")
+	require.Equal(t, uint(2), limit.InUse())
+	require.InDelta(t, 0.5, limit.Utilization(), 0.001)
+}
+
+func TestConcurrencyGroups_CanonicalOrder(t *testing.T) {
+	groups := waffle.NewConcurrencyGroups()
+
+	order := make([]string, 0, 3)
+	keyFunc := func(name string) func(context.Context, any) string {
+		return func(_ context.Context, _ any) string {
+			order = append(order, name)
+			return ""
+		}
+	}
+
+	groups.Add("c", 1, keyFunc("c"))
+	groups.Add("a", 1, keyFunc("a"))
+	groups.Add("b", 1, keyFunc("b"))
+
+	acquired, _ := groups.TryAcquire(t.Context(), nil)
+	require.True(t, acquired)
+
+	require.Equal(t, []string{"a", "b", "c"}, order)
+}
+
+func TestConcurrencyGroups_CanonicalOrderAfterRemove(t *testing.T) {
+	groups := waffle.NewConcurrencyGroups()
+
+	order := make([]string, 0, 3)
+	keyFunc := func(name string) func(context.Context, any) string {
+		return func(_ context.Context, _ any) string {
+			order = append(order, name)
+			return ""
+		}
+	}
+
+	groups.Add("b", 1, keyFunc("b"))
+	groups.Add("c", 1, keyFunc("c"))
+	require.True(t, groups.Remove("b"))
+	groups.Add("a", 1, keyFunc("a"))
+	groups.Add("b", 1, keyFunc("b"))
+
+	// Groups added again take their place in the canonical order, not the last one
+	acquired, _ := groups.TryAcquire(t.Context(), nil)
+	require.True(t, acquired)
+	require.Equal(t, []string{"a", "b", "c"}, order)
+}
+
+func TestConcurrencyGroups_ContendedPartialAcquire(t *testing.T) {
+	groups := waffle.NewConcurrencyGroups()
+	groups.Add("a", 2, func(_ context.Context, _ any) string { return "" })
+	groups.Add("b", 1, func(_ context.Context, _ any) string { return "" })
+
+	acquired, release := groups.TryAcquire(t.Context(), nil)
+	require.True(t, acquired)
+
+	// Acquirers failing on the second group roll the first one back, whatever their number
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if acquired, release := groups.TryAcquire(t.Context(), nil); acquired {
+				release()
+				t.Error("acquired a full group")
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := groups.Stats()
+	require.Equal(t, uint(1), stats["a"].InUse)
+	require.Equal(t, uint(1), stats["b"].InUse)
+	require.Zero(t, stats["a"].AcquireFailures)
+	require.Equal(t, uint64(50), stats["b"].AcquireFailures)
+
+	release()
+	acquired, _ = groups.TryAcquire(t.Context(), nil)
+	require.True(t, acquired)
+}
+
+func TestConcurrencyGroups_SharedLimitsProgress(t *testing.T) {
+	// attempt makes both acquirers meet right before taking their first and their
+	// second limit, forcing them to contend at the same time. An acquirer that already
+	// gave up never reaches its second limit, so that meeting only waits briefly.
+	type attempt struct {
+		meetings []*sync.WaitGroup
+		calls    int
+	}
+
+	meet := func(meeting *sync.WaitGroup, wait time.Duration) {
+		meeting.Done()
+		met := make(chan struct{})
+		go func() {
+			meeting.Wait()
+			close(met)
+		}()
+		select {
+		case <-met:
+		case <-time.After(wait):
+		}
+	}
+
+	var limitA, limitB *waffle.ConcurrencyLimit
+	var holdAndWait atomic.Bool
+	keyFunc := func(_ context.Context, data any) string {
+		a := data.(*attempt)
+		a.calls++
+		switch a.calls {
+		case 1:
+			meet(a.meetings[0], time.Second)
+		case 2:
+			meet(a.meetings[1], 20*time.Millisecond)
+			// Each acquirer holding one limit while going for the other is the
+			// state that leads to both failing
+			if limitA.InUse()+limitB.InUse() > 1 {
+				holdAndWait.Store(true)
+			}
+		}
+		return ""
+	}
+
+	limitA = waffle.NewConcurrencyLimit(1, keyFunc)
+	limitB = waffle.NewConcurrencyLimit(1, keyFunc)
+
+	// Two actions share both single-slot limits, added in opposite orders
+	first := waffle.NewConcurrencyGroups()
+	first.AddLimit("a", limitA)
+	first.AddLimit("b", limitB)
+
+	second := waffle.NewConcurrencyGroups()
+	second.AddLimit("b", limitB)
+	second.AddLimit("a", limitA)
+
+	for range 5 {
+		meetings := []*sync.WaitGroup{{}, {}}
+		for _, meeting := range meetings {
+			meeting.Add(2)
+		}
+
+		var wg sync.WaitGroup
+		var succeeded atomic.Int32
+		releases := make(chan func(), 2)
+		for _, groups := range []*waffle.ConcurrencyGroups{first, second} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if acquired, release := groups.TryAcquire(t.Context(), &attempt{meetings: meetings}); acquired {
+					succeeded.Add(1)
+					releases <- release
+				}
+			}()
+		}
+		wg.Wait()
+		close(releases)
+
+		// Both contend on the same first limit, so exactly one gets both slots
+		// instead of each holding one and failing on the other
+		require.False(t, holdAndWait.Load())
+		require.Equal(t, int32(1), succeeded.Load())
+
+		for release := range releases {
+			release()
+		}
+	}
+}
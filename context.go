@@ -0,0 +1,110 @@
+package waffle
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+// correlationIDKey is the context key holding the correlation id of a dispatch.
+type correlationIDKey struct{}
+
+// CorrelationIDFromContext returns the correlation id of the dispatch the context
+// belongs to, reporting false outside of a dispatch.
+func CorrelationIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(correlationIDKey{}).(string)
+	return id, ok
+}
+
+// withCorrelationID returns a context carrying the correlation id.
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// newCorrelationID generates a random UUID formatted correlation id.
+func newCorrelationID(_ context.Context) string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+
+	// Mark as a version 4, variant 1 UUID
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// ContextDecorator enriches the context of a dispatch, e.g. with a request id, tenant info
+// or a deadline, before the actions of the event are spawned.
+type ContextDecorator func(ctx context.Context, eventKey EventKey, data any) context.Context
+
+// WithContextDecorator adds a decorator applied to the context of every dispatch, once per
+// sent event, so that all its actions, their retries and their key functions get the same
+// values. Decorators run in the order they were added, after the correlation id is set,
+// and must return a context derived from the one they receive. A decorator adding a
+// deadline can't cancel it once the actions are done, use the action Timeout for that.
+func WithContextDecorator(decorator ContextDecorator) EngineOption {
+	return func(e *Engine) {
+		if decorator != nil {
+			e.contextDecorators = append(e.contextDecorators, decorator)
+		}
+	}
+}
+
+// eventKeyKey is the context key holding the key of the event being dispatched.
+type eventKeyKey struct{}
+
+// withEventKey returns a context carrying the key of the event being dispatched.
+func withEventKey(ctx context.Context, eventKey EventKey) context.Context {
+	return context.WithValue(ctx, eventKeyKey{}, eventKey)
+}
+
+// eventKeyFromContext returns the key of the event being dispatched, empty outside of a dispatch.
+func eventKeyFromContext(ctx context.Context) EventKey {
+	eventKey, _ := ctx.Value(eventKeyKey{}).(EventKey)
+	return eventKey
+}
+
+// priorityKey is the context key holding the priority of the acquirers of concurrency slots.
+type priorityKey struct{}
+
+// ContextWithPriority returns a context whose acquirers of concurrency slots get a freed
+// slot ahead of the waiting acquirers with a lower priority, e.g. to keep interactive work
+// ahead of batch work. Acquirers wait with priority zero by default, and higher goes first.
+// It only orders acquirers that wait, see WithWaitPriority for the actions of an event.
+func ContextWithPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// priorityFromContext returns the priority of the acquirers of the context, zero by default.
+func priorityFromContext(ctx context.Context) int {
+	priority, _ := ctx.Value(priorityKey{}).(int)
+	return priority
+}
+
+// depthKey is the context key holding how many actions deep a dispatch is.
+type depthKey struct{}
+
+// withDepth returns a context carrying the dispatch depth.
+func withDepth(ctx context.Context, depth int) context.Context {
+	return context.WithValue(ctx, depthKey{}, depth)
+}
+
+// depthFromContext returns the dispatch depth, zero outside of any action.
+func depthFromContext(ctx context.Context) int {
+	depth, _ := ctx.Value(depthKey{}).(int)
+	return depth
+}
+
+// BudgetFromContext returns the time left for the action to run before its context
+// expires. The result reflects the earliest deadline on the context, whether it comes
+// from the action Timeout or from the context passed to Send. It reports false when
+// the context has no deadline.
+func BudgetFromContext(ctx context.Context) (time.Duration, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+
+	return max(time.Until(deadline), 0), true
+}
@@ -0,0 +1,152 @@
+package waffle_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBudgetFromContext_WithTimeout(t *testing.T) {
+	type budgetResult struct {
+		budget time.Duration
+		ok     bool
+	}
+
+	budgets := make(chan budgetResult, 1)
+
+	engine := waffle.NewEngine(nil)
+
+	require.NoError(t, engine.
+		On("test").
+		Timeout(time.Second).
+		Do("test", func(ctx context.Context, _ any) error {
+			budget, ok := waffle.BudgetFromContext(ctx)
+			budgets <- budgetResult{budget: budget, ok: ok}
+			return nil
+		}))
+
+	engine.Send(t.Context(), "test", nil)
+
+	select {
+	case result := <-budgets:
+		require.True(t, result.ok)
+		require.LessOrEqual(t, result.budget, time.Second)
+		require.Greater(t, result.budget, 900*time.Millisecond)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("action did not run")
+	}
+}
+
+func TestBudgetFromContext_NoTimeout(t *testing.T) {
+	budget, ok := waffle.BudgetFromContext(t.Context())
+
+	require.False(t, ok)
+	require.Zero(t, budget)
+}
+
+func TestBudgetFromContext_Expired(t *testing.T) {
+	ctx, cancel := context.WithDeadline(t.Context(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	budget, ok := waffle.BudgetFromContext(ctx)
+
+	require.True(t, ok)
+	require.Zero(t, budget)
+}
+
+func TestCorrelationIDFromContext(t *testing.T) {
+	ids := make(chan string, 2)
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	require.NoError(t, engine.On("test").Do("test", func(ctx context.Context, _ any) error {
+		id, _ := waffle.CorrelationIDFromContext(ctx)
+		ids <- id
+		return nil
+	}))
+
+	engine.Send(t.Context(), "test", nil)
+	engine.Send(t.Context(), "test", nil)
+
+	time.Sleep(10 * time.Millisecond)
+
+	first, second := <-ids, <-ids
+	require.NotEmpty(t, first)
+	require.NotEmpty(t, second)
+	require.NotEqual(t, first, second)
+
+	// Every log of a send should share its id
+	byID := make(map[string][]string)
+	for _, log := range logger.GetLogs() {
+		id := log.Metadata["correlationId"]
+		require.NotEmpty(t, id, "event %s has no correlation id", log.Event)
+		byID[id] = append(byID[id], log.Event)
+	}
+	require.Len(t, byID, 2)
+	require.Contains(t, byID[first], "waffle.event.received")
+	require.Contains(t, byID[first], "waffle.action.spawned")
+	require.Contains(t, byID[first], "waffle.action.started")
+	require.Contains(t, byID[first], "waffle.action.finished")
+}
+
+func TestCorrelationIDFromContext_CustomGenerator(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithCorrelationID(func(_ context.Context) string {
+		return "fixed-id"
+	}))
+
+	require.NoError(t, engine.On("test").Do("test", func(_ context.Context, _ any) error {
+		return nil
+	}))
+
+	engine.Send(t.Context(), "test", nil)
+
+	time.Sleep(10 * time.Millisecond)
+	logger.AssertEventLoggedWithMetadata(t, "waffle.event.received", map[string]string{
+		"correlationId": "fixed-id",
+	})
+}
+
+func TestCorrelationIDFromContext_OutsideDispatch(t *testing.T) {
+	id, ok := waffle.CorrelationIDFromContext(t.Context())
+
+	require.False(t, ok)
+	require.Empty(t, id)
+}
+
+func TestEngine_WithContextDecorator(t *testing.T) {
+	type tenantKey struct{}
+	type requestKey struct{}
+
+	seen := make(chan string, 2)
+	engine := waffle.NewEngine(nil,
+		waffle.WithContextDecorator(func(ctx context.Context, eventKey waffle.EventKey, data any) context.Context {
+			return context.WithValue(ctx, tenantKey{}, string(eventKey)+"/"+data.(string))
+		}),
+		waffle.WithContextDecorator(func(ctx context.Context, _ waffle.EventKey, _ any) context.Context {
+			// Decorators see the values added by the previous ones and the correlation id
+			id, _ := waffle.CorrelationIDFromContext(ctx)
+			return context.WithValue(ctx, requestKey{}, ctx.Value(tenantKey{}).(string)+"/"+id)
+		}),
+		waffle.WithCorrelationID(func(_ context.Context) string { return "req-1" }),
+	)
+
+	action := func(ctx context.Context, _ any) error {
+		seen <- ctx.Value(requestKey{}).(string)
+		return nil
+	}
+	require.NoError(t, engine.On("order.created").Do("notify", action))
+	require.NoError(t, engine.On("order.created").Inline().Do("audit", action))
+
+	require.True(t, engine.Send(t.Context(), "order.created", "acme"))
+	require.Equal(t, "order.created/acme/req-1", <-seen)
+	require.Equal(t, "order.created/acme/req-1", <-seen)
+
+	_, err := engine.SendSync(t.Context(), "order.created", "globex")
+	require.NoError(t, err)
+	require.Equal(t, "order.created/globex/req-1", <-seen)
+	require.Equal(t, "order.created/globex/req-1", <-seen)
+}
@@ -0,0 +1,204 @@
+package waffle
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrDeadLetterNotFound is returned when redriving a dead letter that isn't in the store.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter is an action run that failed for good, once its retries were exhausted.
+type DeadLetter struct {
+	ID        string
+	EventKey  EventKey
+	ActionKey ActionKey
+	Data      any
+	// Err is the error of the last run, or describes its panic
+	Err error
+	// Attempts counts the runs of the action, retries included
+	Attempts uint
+	FailedAt time.Time
+}
+
+// DeadLetterStore keeps the dead letters of the engine until they are redriven or purged.
+// Serializing the data is up to the store.
+type DeadLetterStore interface {
+	// Put stores a dead letter, returning its id
+	Put(ctx context.Context, letter DeadLetter) (string, error)
+	// List returns the stored dead letters, in the order they were put
+	List(ctx context.Context) ([]DeadLetter, error)
+	// Remove removes a dead letter, returning false if there is no such dead letter
+	Remove(ctx context.Context, id string) (DeadLetter, bool, error)
+}
+
+// WithDeadLetterStore makes the engine put the action runs that failed or panicked for
+// good into the store, so that they can be inspected with DeadLetters, run again with
+// Redrive or dropped with PurgeDeadLetters. Runs of SendSync aren't dead-lettered, their
+// errors are returned to the caller.
+func WithDeadLetterStore(store DeadLetterStore) EngineOption {
+	return func(e *Engine) {
+		e.deadLetters = store
+	}
+}
+
+// DeadLetters returns the dead letters of the engine, none if no store is configured.
+func (e *Engine) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	if e.deadLetters == nil {
+		return nil, nil
+	}
+
+	return e.deadLetters.List(ctx)
+}
+
+// Redrive removes a dead letter from the store and runs its action again with the same
+// event key and data, as a first attempt. It returns ErrDeadLetterNotFound if there is no
+// such dead letter, and false if the action was dropped again.
+func (e *Engine) Redrive(ctx context.Context, id string) (bool, error) {
+	if e.deadLetters == nil {
+		return false, ErrDeadLetterNotFound
+	}
+
+	letter, ok, err := e.deadLetters.Remove(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, ErrDeadLetterNotFound
+	}
+
+	// Log dead letter redriven
+	e.logOperation(ctx, "waffle.action.redriven", map[string]string{
+		"actionKey": string(letter.ActionKey),
+		"eventKey":  string(letter.EventKey),
+		"id":        letter.ID,
+	})
+
+	ctx = withEventKey(ctx, letter.EventKey)
+	if _, ok := CorrelationIDFromContext(ctx); !ok {
+		ctx = withCorrelationID(ctx, e.correlationID(ctx))
+	}
+
+	return e.spawnAction(ctx, letter.ActionKey, letter.Data, letter.EventKey, 0, sendOptions{}), nil
+}
+
+// PurgeDeadLetters removes the dead letters with the ids, or all of them when no id is
+// given, returning how many were removed.
+func (e *Engine) PurgeDeadLetters(ctx context.Context, ids ...string) (int, error) {
+	if e.deadLetters == nil {
+		return 0, nil
+	}
+
+	if len(ids) == 0 {
+		letters, err := e.deadLetters.List(ctx)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, letter := range letters {
+			ids = append(ids, letter.ID)
+		}
+	}
+
+	purged := 0
+	for _, id := range ids {
+		_, ok, err := e.deadLetters.Remove(ctx, id)
+		if err != nil {
+			return purged, err
+		}
+		if ok {
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+// deadLetter puts a run that failed for good into the dead letter store.
+func (e *Engine) deadLetter(ctx context.Context, actionKey ActionKey, eventKey EventKey, data any, err error, attempts uint) {
+	if e.deadLetters == nil {
+		return
+	}
+
+	id, putErr := e.deadLetters.Put(ctx, DeadLetter{
+		EventKey:  eventKey,
+		ActionKey: actionKey,
+		Data:      data,
+		Err:       err,
+		Attempts:  attempts,
+		FailedAt:  e.clock.Now(),
+	})
+	if putErr != nil {
+		// Log dead letter failed
+		e.logOperation(ctx, "waffle.action.dead_letter_failed", map[string]string{
+			"actionKey": string(actionKey),
+			"eventKey":  string(eventKey),
+			"error":     putErr.Error(),
+		})
+		return
+	}
+
+	// Log action dead-lettered
+	e.logOperation(ctx, "waffle.action.dead_lettered", map[string]string{
+		"actionKey": string(actionKey),
+		"eventKey":  string(eventKey),
+		"id":        id,
+		"attempts":  strconv.FormatUint(uint64(attempts), 10),
+	})
+}
+
+// MemoryDeadLetterStore is a DeadLetterStore keeping the dead letters in memory, as a
+// reference implementation and for tests. It doesn't survive the process.
+type MemoryDeadLetterStore struct {
+	letters []DeadLetter
+	nextID  int
+	mu      sync.Mutex
+}
+
+var _ DeadLetterStore = (*MemoryDeadLetterStore)(nil)
+
+// NewMemoryDeadLetterStore creates a new in-memory dead letter store.
+func NewMemoryDeadLetterStore() *MemoryDeadLetterStore {
+	return &MemoryDeadLetterStore{
+		letters: make([]DeadLetter, 0),
+	}
+}
+
+// Put implements the DeadLetterStore interface.
+func (s *MemoryDeadLetterStore) Put(_ context.Context, letter DeadLetter) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	letter.ID = strconv.Itoa(s.nextID)
+	s.letters = append(s.letters, letter)
+
+	return letter.ID, nil
+}
+
+// List implements the DeadLetterStore interface.
+func (s *MemoryDeadLetterStore) List(_ context.Context) ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.letters), nil
+}
+
+// Remove implements the DeadLetterStore interface.
+func (s *MemoryDeadLetterStore) Remove(_ context.Context, id string) (DeadLetter, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, letter := range s.letters {
+		if letter.ID == id {
+			s.letters = slices.Delete(s.letters, i, i+1)
+			return letter, true, nil
+		}
+	}
+
+	return DeadLetter{}, false, nil
+}
@@ -0,0 +1,67 @@
+package waffle_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_WithDeadLetterStore(t *testing.T) {
+	store := waffle.NewMemoryDeadLetterStore()
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithDeadLetterStore(store))
+
+	chargeErr := errors.New("card declined")
+	var healthy atomic.Bool
+	charged := make(chan any, 1)
+	require.NoError(t, engine.On("order").Do("charge", func(_ context.Context, data any) error {
+		if !healthy.Load() {
+			return chargeErr
+		}
+		charged <- data
+		return nil
+	}))
+
+	require.True(t, engine.Send(t.Context(), "order", "order-1"))
+	require.True(t, engine.Send(t.Context(), "order", "order-2"))
+	require.NoError(t, engine.Wait(t.Context()))
+
+	letters, err := engine.DeadLetters(t.Context())
+	require.NoError(t, err)
+	require.Len(t, letters, 2)
+	require.Equal(t, waffle.ActionKey("charge"), letters[0].ActionKey)
+	require.Equal(t, waffle.EventKey("order"), letters[0].EventKey)
+	require.ErrorIs(t, letters[0].Err, chargeErr)
+	require.Equal(t, uint(1), letters[0].Attempts)
+	logger.AssertEventLoggedTimes(t, "waffle.action.dead_lettered", 2)
+
+	// Redrive the first order once the action is healthy
+	healthy.Store(true)
+	redriven, err := engine.Redrive(t.Context(), letters[0].ID)
+	require.NoError(t, err)
+	require.True(t, redriven)
+
+	select {
+	case data := <-charged:
+		require.Equal(t, letters[0].Data, data)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("dead letter was not redriven")
+	}
+
+	_, err = engine.Redrive(t.Context(), letters[0].ID)
+	require.ErrorIs(t, err, waffle.ErrDeadLetterNotFound)
+
+	// Purge the rest
+	purged, err := engine.PurgeDeadLetters(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, 1, purged)
+
+	letters, err = engine.DeadLetters(t.Context())
+	require.NoError(t, err)
+	require.Empty(t, letters)
+}
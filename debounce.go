@@ -0,0 +1,78 @@
+package waffle
+
+import (
+	"context"
+	"sync"
+)
+
+// debounceKey identifies the bursts of an action collapsed together.
+type debounceKey struct {
+	actionKey ActionKey
+	key       string
+}
+
+// debouncedRun is the latest run of a burst, spawned once the burst is quiet.
+type debouncedRun struct {
+	ctx      context.Context
+	data     any
+	eventKey EventKey
+	opts     sendOptions
+	timer    Timer
+}
+
+// debouncer holds the latest run of each burst of debounced actions.
+type debouncer struct {
+	pending map[debounceKey]*debouncedRun
+	mu      sync.Mutex
+}
+
+// debounce holds the run of a debounced action until no other run with the same key
+// comes in for the debounce window, superseding the run held so far.
+func (e *Engine) debounce(ctx context.Context, configuration ActionConfiguration, data any, eventKey EventKey, opts sendOptions) {
+	key := debounceKey{actionKey: configuration.ActionKey}
+	if configuration.DebounceKey != nil {
+		key.key = configuration.DebounceKey(ctx, data)
+	}
+	run := &debouncedRun{
+		ctx:      context.WithoutCancel(ctx),
+		data:     data,
+		eventKey: eventKey,
+		opts:     opts,
+	}
+
+	e.debouncer.mu.Lock()
+	if e.debouncer.pending == nil {
+		e.debouncer.pending = make(map[debounceKey]*debouncedRun)
+	}
+	superseded := e.debouncer.pending[key]
+	if superseded != nil {
+		superseded.timer.Stop()
+	}
+	e.debouncer.pending[key] = run
+	run.timer = e.clock.AfterFunc(configuration.DebounceWindow, func() {
+		e.debouncer.mu.Lock()
+		if e.debouncer.pending[key] != run {
+			// A later run superseded this one while the timer fired
+			e.debouncer.mu.Unlock()
+			return
+		}
+		delete(e.debouncer.pending, key)
+		e.debouncer.mu.Unlock()
+
+		run.opts.debounced = true
+		e.spawnAction(run.ctx, key.actionKey, run.data, run.eventKey, 0, run.opts)
+	})
+	e.debouncer.mu.Unlock()
+
+	if superseded == nil {
+		return
+	}
+
+	// Log action debounced
+	e.logOperation(superseded.ctx, "waffle.action.debounced", map[string]string{
+		"actionKey": string(configuration.ActionKey),
+		"eventKey":  string(superseded.eventKey),
+	})
+	e.stats.debounced.Add(1)
+	e.settleDispatch(superseded.ctx, ActionResult{ActionKey: configuration.ActionKey})
+}
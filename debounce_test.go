@@ -0,0 +1,65 @@
+package waffle_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_Debounce(t *testing.T) {
+	clock := waffle.NewTestClock(time.Now())
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithClock(clock))
+
+	ran := make(chan string, 4)
+	err := engine.On("file.changed").
+		Debounce(time.Second, func(_ context.Context, data any) string {
+			// Debounce the changes per directory
+			dir, _, _ := strings.Cut(data.(string), "/")
+			return dir
+		}).
+		Do("rebuild", func(_ context.Context, data any) error {
+			ran <- data.(string)
+			return nil
+		})
+	require.NoError(t, err)
+
+	first := engine.SendAwait(t.Context(), "file.changed", "src/a.go")
+	clock.Advance(500 * time.Millisecond)
+	engine.Send(t.Context(), "file.changed", "docs/index.md")
+	engine.Send(t.Context(), "file.changed", "src/b.go")
+
+	// The superseded run succeeds without running
+	results, err := first.Wait(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, []waffle.ActionResult{{ActionKey: "rebuild"}}, results)
+
+	// The bursts wait for a quiet window after their last event
+	clock.Advance(900 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	require.Empty(t, ran)
+
+	clock.Advance(100 * time.Millisecond)
+	require.ElementsMatch(t, []string{"docs/index.md", "src/b.go"}, []string{<-ran, <-ran})
+
+	require.NoError(t, engine.Wait(t.Context()))
+	require.Empty(t, ran)
+	require.Equal(t, uint64(1), engine.Stats().Debounced)
+	logger.AssertEventLoggedTimes(t, "waffle.action.debounced", 1)
+}
+
+func TestActionBuilder_InvalidDebounce(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	err := engine.On("test").Debounce(0, nil).Do("test", func(context.Context, any) error { return nil })
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Debounce: window must be positive")
+
+	err = engine.On("test").Debounce(time.Second, nil).Do("test", func(context.Context, any) error { return nil })
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Debounce: keyFunc must be provided")
+}
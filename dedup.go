@@ -0,0 +1,101 @@
+package waffle
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DedupStore remembers the dedup keys of the sent events for a while, so that an event
+// delivered again by an at-least-once producer isn't processed twice. Implementations
+// backed by a shared store, e.g. Redis SET NX with an expiry, deduplicate across engines.
+type DedupStore interface {
+	// Claim marks the key as seen for the ttl, returning false if it was already seen
+	// and didn't expire yet. Checking and marking the key must be atomic
+	Claim(ctx context.Context, key string, ttl time.Duration) (bool, error)
+}
+
+// WithDedupStore makes Send drop the events whose dedup key was claimed within the ttl,
+// see WithDedupKey and SendWithDedupKey, instead of only while they are in flight. Keys
+// stay claimed once their actions are done, whether they failed or not. When the store
+// fails, the event is sent and waffle.event.dedup_failed is logged.
+func WithDedupStore(store DedupStore, ttl time.Duration) EngineOption {
+	return func(e *Engine) {
+		e.dedupStore = store
+		e.dedupTTL = ttl
+	}
+}
+
+// SendWithDedupKey sends an event like Send with WithDedupKey, dropping it when an event
+// with the same key is in flight, or was sent within the ttl of the dedup store.
+func (e *Engine) SendWithDedupKey(ctx context.Context, eventKey EventKey, data any, key string) bool {
+	return e.Send(ctx, eventKey, data, WithDedupKey(key))
+}
+
+// claimDedupStore claims the key in the dedup store, reporting false when it was seen
+// within the ttl. Store failures let the event through.
+func (e *Engine) claimDedupStore(ctx context.Context, eventKey EventKey, key string) bool {
+	if e.dedupStore == nil {
+		return true
+	}
+
+	claimed, err := e.dedupStore.Claim(ctx, key, e.dedupTTL)
+	if err != nil {
+		// Log dedup store failed
+		e.logOperation(ctx, "waffle.event.dedup_failed", map[string]string{
+			"eventKey": string(eventKey),
+			"dedupKey": key,
+			"error":    err.Error(),
+		})
+		return true
+	}
+
+	return claimed
+}
+
+// MemoryDedupStore is a DedupStore keeping the keys in memory, for a single engine and
+// for tests. Expired keys are forgotten as new keys are claimed.
+type MemoryDedupStore struct {
+	clock     Clock
+	expiries  map[string]time.Time
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+var _ DedupStore = (*MemoryDedupStore)(nil)
+
+// NewMemoryDedupStore creates a new in-memory dedup store reading the time from the
+// clock, the real one when nil.
+func NewMemoryDedupStore(clock Clock) *MemoryDedupStore {
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	return &MemoryDedupStore{
+		clock:    clock,
+		expiries: make(map[string]time.Time),
+	}
+}
+
+// Claim implements the DedupStore interface.
+func (s *MemoryDedupStore) Claim(_ context.Context, key string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	if now.Sub(s.lastSweep) >= ttl {
+		s.lastSweep = now
+		for seen, expiry := range s.expiries {
+			if !expiry.After(now) {
+				delete(s.expiries, seen)
+			}
+		}
+	}
+
+	if expiry, ok := s.expiries[key]; ok && expiry.After(now) {
+		return false, nil
+	}
+	s.expiries[key] = now.Add(ttl)
+
+	return true, nil
+}
@@ -0,0 +1,65 @@
+package waffle_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_WithDedupStore(t *testing.T) {
+	clock := waffle.NewTestClock(time.Now())
+	engine := waffle.NewEngine(nil,
+		waffle.WithClock(clock),
+		waffle.WithDedupStore(waffle.NewMemoryDedupStore(clock), time.Hour),
+	)
+
+	ran := make(chan any, 3)
+	require.NoError(t, engine.On("payment.received").Do("credit", func(_ context.Context, data any) error {
+		ran <- data
+		return nil
+	}))
+
+	require.True(t, engine.SendWithDedupKey(t.Context(), "payment.received", "first", "payment-1"))
+	require.NoError(t, engine.Wait(t.Context()))
+	require.Equal(t, "first", <-ran)
+
+	// Delivered again once processed, within the ttl
+	clock.Advance(30 * time.Minute)
+	require.False(t, engine.SendWithDedupKey(t.Context(), "payment.received", "redelivered", "payment-1"))
+	require.True(t, engine.SendWithDedupKey(t.Context(), "payment.received", "other", "payment-2"))
+	require.NoError(t, engine.Wait(t.Context()))
+	require.Equal(t, "other", <-ran)
+	require.Equal(t, 1, engine.DropReasons()[waffle.DropReasonDuplicate])
+
+	// The key expires after the ttl
+	clock.Advance(30 * time.Minute)
+	require.True(t, engine.SendWithDedupKey(t.Context(), "payment.received", "late", "payment-1"))
+	require.NoError(t, engine.Wait(t.Context()))
+	require.Equal(t, "late", <-ran)
+}
+
+type failingDedupStore struct{}
+
+func (failingDedupStore) Claim(context.Context, string, time.Duration) (bool, error) {
+	return false, errors.New("store unavailable")
+}
+
+func TestEngine_WithDedupStore_Failure(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithDedupStore(failingDedupStore{}, time.Hour))
+
+	require.NoError(t, engine.On("payment.received").Do("credit", func(context.Context, any) error { return nil }))
+
+	// Events go through when the store fails
+	require.True(t, engine.SendWithDedupKey(t.Context(), "payment.received", nil, "payment-1"))
+	require.NoError(t, engine.Wait(t.Context()))
+	logger.AssertEventLoggedWithMetadata(t, "waffle.event.dedup_failed", map[string]string{
+		"eventKey": "payment.received",
+		"dedupKey": "payment-1",
+		"error":    "store unavailable",
+	})
+}
@@ -0,0 +1,32 @@
+package waffle
+
+import "context"
+
+// WithDryRun makes the engine route the events and admit their actions through their
+// concurrency limits, throttles and predicates as usual, but log waffle.action.would_run
+// instead of running the admitted actions, releasing their slots right away. Fallbacks
+// are logged without running either. It lets configuration changes be validated against
+// real traffic. Dry runs aren't counted as dispatched, and SendSync reports them without
+// an error.
+func WithDryRun() EngineOption {
+	return func(e *Engine) {
+		e.dryRun = true
+	}
+}
+
+// dryRunAction logs the admitted action as one that would run and releases its slots
+// when the engine is in dry-run mode. It returns false when the action should run.
+func (e *Engine) dryRunAction(ctx context.Context, actionKey ActionKey, eventKey EventKey, release func()) bool {
+	if !e.dryRun {
+		return false
+	}
+
+	// Log action would run
+	e.logOperation(ctx, "waffle.action.would_run", map[string]string{
+		"actionKey": string(actionKey),
+		"eventKey":  string(eventKey),
+	})
+	release()
+
+	return true
+}
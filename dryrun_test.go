@@ -0,0 +1,67 @@
+package waffle_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_WithDryRun(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithDryRun())
+
+	run := func(_ context.Context, _ any) error {
+		t.Error("action ran in dry-run mode")
+		return nil
+	}
+	perEvent := func(_ context.Context, _ any) string { return "" }
+	require.NoError(t, engine.On("order.created").Throttle(1, time.Minute, perEvent).Do("notify", run))
+	require.NoError(t, engine.On("order.created").When(func(_ context.Context, data any) bool {
+		return data == "vip"
+	}).Do("upgrade", run))
+	engine.OnDropped("order.created", run)
+
+	require.True(t, engine.Send(t.Context(), "order.created", "vip"))
+	wouldRun := make([]string, 0)
+	for _, log := range logger.GetLogs() {
+		if log.Event == "waffle.action.would_run" {
+			wouldRun = append(wouldRun, log.Metadata["actionKey"])
+		}
+	}
+	require.Equal(t, []string{"notify", "upgrade"}, wouldRun)
+
+	// The throttle and the predicate still apply
+	results, err := engine.SendSync(t.Context(), "order.created", "regular")
+	require.ErrorIs(t, err, waffle.ErrDropped)
+	require.Equal(t, []waffle.ActionResult{
+		{ActionKey: "notify", Err: waffle.ErrDropped},
+		{ActionKey: "upgrade"},
+	}, results)
+	logger.AssertEventLoggedTimes(t, "waffle.action.would_run", 2)
+	require.Equal(t, 1, engine.DropReasons()[waffle.DropReasonThrottled])
+
+	require.NoError(t, engine.Wait(t.Context()))
+	require.Zero(t, engine.Stats().Dispatched)
+}
+
+func TestEngine_WithDryRun_Fallback(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithDryRun())
+
+	run := func(_ context.Context, _ any) error {
+		t.Error("action ran in dry-run mode")
+		return nil
+	}
+	require.NoError(t, engine.On("event").DeadlineFromData(func(_ context.Context, _ any) (time.Time, bool) {
+		return time.Unix(0, 0), true
+	}).Do("expired", run))
+	engine.OnDropped("event", run)
+
+	// The fallback is logged without running
+	require.True(t, engine.Send(t.Context(), "event", nil))
+	logger.AssertEventLoggedTimes(t, "waffle.event.fallback", 1)
+	logger.AssertEventNotLogged(t, "waffle.action.would_run")
+}
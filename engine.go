@@ -2,7 +2,18 @@ package waffle
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"reflect"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type (
@@ -18,10 +29,77 @@ type (
 
 // ActionConfiguration represents the configuration of an action.
 type ActionConfiguration struct {
-	EventKeys         []EventKey
+	EventKeys []EventKey
+	// ConcurrencyGroups limits the concurrent runs of the action, nil means no limits
 	ConcurrencyGroups *ConcurrencyGroups
 	ActionKey         ActionKey
 	Action            Action
+	// Timeout bounds each run of the action, zero means no timeout
+	Timeout time.Duration
+	// MaxRetryLater caps how many times the action is retried when it returns ErrRetryLater,
+	// zero treats ErrRetryLater as a failure
+	MaxRetryLater uint
+	// RetryAttempts caps how many times the action runs for an event when it fails,
+	// including the first run. Retries are only made when Backoff is set
+	RetryAttempts uint
+	// Backoff computes the delay before each retry of a failed run
+	Backoff BackoffStrategy
+	// QuietConcurrencyLogs suppresses the waffle.concurrency.* operation logs of the action,
+	// except for key function errors and reached key caps
+	QuietConcurrencyLogs bool
+	// DefaultData produces the data for the action when the event is sent with nil data,
+	// including typed nils such as a nil pointer
+	DefaultData func(ctx context.Context) any
+	// DeadlineFromData reads the deadline of an event from its data, if it has one. The
+	// action is dropped once the deadline passed, otherwise it runs with the deadline
+	DeadlineFromData func(ctx context.Context, data any) (time.Time, bool)
+	// When decides whether the action runs for the data of an event, nil runs it for
+	// every event. Skipped runs aren't counted as dropped
+	When func(ctx context.Context, data any) bool
+	// Map decodes or enriches the data of the event before each run, nil passes it as is.
+	// Key functions and When see the data as sent
+	Map func(ctx context.Context, data any) (any, error)
+	// DebounceWindow collapses the runs of the action with the same DebounceKey into the
+	// last one, spawned once no other run came in for the window. Zero disables debouncing.
+	// SendSync runs the action right away
+	DebounceWindow time.Duration
+	// DebounceKey returns the key of the burst a run belongs to, nil puts all the runs of
+	// the action in the same burst
+	DebounceKey func(ctx context.Context, data any) string
+	// BatchSize makes the action receive the data of up to BatchSize events at once, as
+	// a []any, instead of running once per event. Zero disables batching. SendSync runs
+	// the action right away with a batch of one
+	BatchSize int
+	// BatchWait is how long a batch waits for more events after its first one before
+	// running, zero waits until the batch is full or the engine is closed
+	BatchWait time.Duration
+	// Throttle limits how often the action runs per key, dropping the runs over the
+	// limit. Nil means no throttling
+	Throttle *Throttle
+	// RateLimits limits how often the action runs per key, dropping the runs over the rate
+	// of any group. Nil means no rate limits
+	RateLimits *RateLimitGroups
+	// Middlewares wrap the action, inside the middlewares of the engine, outermost first
+	Middlewares []Middleware
+	// Inline runs the action on the goroutine sending the event instead of a new one,
+	// for cheap actions where spawning a goroutine costs more than the action itself
+	Inline bool
+	// Detached runs the action, once admitted, with a context that isn't canceled with the
+	// context passed to Send, keeping its values
+	Detached bool
+	// OnClose holds the teardowns run by Engine.Close once the in-flight actions finished
+	OnClose []func(ctx context.Context) error
+	// QueueWhenLimited queues the action when its concurrency limits are reached instead
+	// of dropping it, running it once a run of any action frees slots. SendSync still
+	// drops it
+	QueueWhenLimited bool
+	// QueueSize caps the queued runs of the action, zero means no cap
+	QueueSize int
+	// QueueOverflow decides what happens to a run when the queue is full
+	QueueOverflow OverflowPolicy
+	// Labels tag the action for filtering with Engine.ActionsWithLabel, and are reported
+	// with its completions
+	Labels map[string]string
 }
 
 // OperationLogger logs internal engine operations
@@ -29,51 +107,508 @@ type OperationLogger interface {
 	LogOperation(ctx context.Context, event string, metadata map[string]string)
 }
 
+// TimestampedOperationLogger is an OperationLogger also receiving the time of each
+// operation, as reported by the engine clock. The engine calls LogOperationAt instead of
+// LogOperation on loggers implementing it.
+type TimestampedOperationLogger interface {
+	OperationLogger
+	// LogOperationAt logs an operation that happened at the given time
+	LogOperationAt(ctx context.Context, timestamp time.Time, event string, metadata map[string]string)
+}
+
+// Dispatcher sends events to be handled by actions. It is implemented by Engine, and
+// by MockEngine for testing code that sends events.
+type Dispatcher interface {
+	// Send sends an event, see Engine.Send
+	Send(ctx context.Context, eventKey EventKey, data any, opts ...SendOption) bool
+	// SendMany sends the same data to several events, see Engine.SendMany
+	SendMany(ctx context.Context, data any, eventKeys ...EventKey) int
+	// SendSync sends an event and runs its actions synchronously, see Engine.SendSync
+	SendSync(ctx context.Context, eventKey EventKey, data any) ([]ActionResult, error)
+}
+
+var _ Dispatcher = (*Engine)(nil)
+
+// Router rewrites the key of a sent event before its actions are looked up, e.g. to
+// prefix it with the tenant found in the context.
+type Router func(ctx context.Context, eventKey EventKey, data any) EventKey
+
 // Engine maps events to actions and executes them.
 type Engine struct {
 	// triggers maps event keys to their corresponding actions
 	triggers map[EventKey][]ActionKey
-	// actions maps action keys to their corresponding actions
-	actions map[ActionKey]Action
-	// actionConcurrencyLimits maps action keys to their concurrency configuration
-	actionConcurrencyLimits map[ActionKey]*ConcurrencyGroups
+	// actions maps action keys to their configuration
+	actions map[ActionKey]ActionConfiguration
+	// wildcards holds the event keys of triggers matching several events, in the order
+	// they were added
+	wildcards []wildcard
+	// registryMu guards the registrations, e.g. triggers, wildcards, actions and fallbacks,
+	// which may change while events are sent
+	registryMu sync.RWMutex
 	// operationLogger logs internal engine operations
 	operationLogger OperationLogger
+	// hierarchySeparator splits event keys into levels, empty when hierarchy is disabled
+	hierarchySeparator string
+	// clock provides the time for logs and timers
+	clock Clock
+	// maxDepth caps how deeply actions may send events, zero means no cap
+	maxDepth int
+	// correlationID generates the correlation id of a dispatch
+	correlationID func(ctx context.Context) string
+	// middlewares wrap every action, outermost first
+	middlewares []Middleware
+	// contextDecorators enrich the context of every dispatch, in order
+	contextDecorators []ContextDecorator
+	// dedupKeys holds the dedup keys of the events in flight
+	dedupKeys map[string]struct{}
+	dedupMu   sync.Mutex
+	// dedupStore remembers the dedup keys for dedupTTL, nil to only drop events in flight
+	dedupStore DedupStore
+	dedupTTL   time.Duration
+	// fanOuts maps event keys to how their actions are run, parallel when missing
+	fanOuts map[EventKey]FanOutMode
+	// fallbacks maps event keys to the action run when all their actions were dropped
+	fallbacks map[EventKey]Action
+	// completions receives the outcome of every finished action
+	completions chan Completion
+	// dryRun logs the admitted actions instead of running them
+	dryRun bool
+	// serialSpawn waits for each spawned action to start before spawning the next
+	serialSpawn bool
+	// queues hold the runs of the actions queued when limited, by action key
+	queues map[ActionKey]*actionQueue
+	// queuedRuns counts the runs in all the queues, to skip draining when they are empty
+	queuedRuns atomic.Int64
+	// workers caps the actions running on their own goroutine, nil when uncapped
+	workers chan struct{}
+	// pool runs the actions on a fixed set of workers, nil for a goroutine per run
+	pool *workerPool
+	// workerWait is how long spawning an action waits for a worker before dropping it
+	workerWait time.Duration
+	// deadLetters keeps the runs that failed for good, nil when disabled
+	deadLetters DeadLetterStore
+	// panicHandler receives the panics of the actions, nil when unset
+	panicHandler PanicHandler
+	// errorHandler receives the errors of the actions, nil when unset. It may be set while
+	// actions run
+	errorHandler atomic.Pointer[ErrorHandler]
+	// actionResolver provides the triggered actions that aren't registered, nil when disabled
+	actionResolver ActionResolver
+	// fairShares weighs the events waiting for global concurrency limits, nil for arrival order
+	fairShares map[EventKey]int
+	// batcher holds the pending batch of each batched action
+	batcher batcher
+	// debouncer holds the latest run of each burst of debounced actions
+	debouncer debouncer
+	// scheduler keeps the events sent with SendAfter until they are due
+	scheduler scheduler
+	// pauser holds the events sent while paused
+	pauser pauser
+	// eventStore persists the sent events until their actions are done, nil when disabled
+	eventStore EventStore
+	// routers rewrite the key of each sent event, in order
+	routers []Router
+	// mounts holds the engines events are routed to by key prefix, longest prefix first
+	mounts []mount
+	// random returns values within [0, 1) for jitter
+	random func() float64
+	// running counts the in-flight invocations per action and concurrency key
+	running   map[runningKey]int
+	runningMu sync.Mutex
+	// runningChanged is closed and replaced whenever an invocation finishes, waking up
+	// the goroutines waiting for in-flight invocations
+	runningChanged chan struct{}
+	// shuttingDown rejects new events once Shutdown is called
+	shuttingDown atomic.Bool
+	// closed is set once the teardowns ran
+	closed   bool
+	closedMu sync.Mutex
+	// stats counts sends and action outcomes
+	stats engineStats
+	// heartbeat periodically logs the engine stats
+	heartbeat heartbeat
+}
+
+// mount routes the events whose key starts with prefix to an engine.
+type mount struct {
+	prefix string
+	engine *Engine
+}
+
+// runningKey identifies in-flight invocations of an action for a concurrency key.
+type runningKey struct {
+	actionKey ActionKey
+	key       string
+}
+
+// EngineOption configures optional engine behavior.
+type EngineOption func(*Engine)
+
+// WithHierarchy makes Send also dispatch an event to the actions registered on its
+// ancestor keys, splitting the key into levels by the separator. For example, with
+// the separator "." sending "order.created" also triggers the actions of "order".
+// Empty levels are skipped, so "order..created" has the single ancestor "order".
+// An empty separator leaves hierarchy disabled.
+func WithHierarchy(separator string) EngineOption {
+	return func(e *Engine) {
+		e.hierarchySeparator = separator
+	}
+}
+
+// WithClock sets the clock used for operation timestamps, durations and timers.
+// It defaults to the system clock.
+func WithClock(clock Clock) EngineOption {
+	return func(e *Engine) {
+		e.clock = clock
+	}
+}
+
+// WithMaxDepth caps how deeply events may be sent from within actions, protecting
+// against events that trigger each other in a loop. An event sent from the context of
+// an action is one level deeper than the event that triggered the action; once the
+// depth reaches maxDepth Send refuses the event. A value of zero or less disables the cap.
+func WithMaxDepth(maxDepth int) EngineOption {
+	return func(e *Engine) {
+		e.maxDepth = max(maxDepth, 0)
+	}
+}
+
+// WithCorrelationID sets the generator of the correlation id given to each Send that
+// isn't already part of a dispatch. The id is included in every operation log of the
+// dispatch and is available to actions via CorrelationIDFromContext. It defaults to
+// a random UUID.
+func WithCorrelationID(generator func(ctx context.Context) string) EngineOption {
+	return func(e *Engine) {
+		e.correlationID = generator
+	}
+}
+
+// WithRandom sets the source of randomness used for retry jitter, returning values
+// within [0, 1). It defaults to rand.Float64.
+func WithRandom(random func() float64) EngineOption {
+	return func(e *Engine) {
+		e.random = random
+	}
+}
+
+// WithHeartbeat makes the engine log waffle.engine.heartbeat every interval, with the
+// number of in-flight actions and the total dispatched actions, for dashboards fed by the
+// operation logger. The heartbeat starts on the first Send, or on StartHeartbeat, and
+// stops on Close.
+func WithHeartbeat(interval time.Duration) EngineOption {
+	return func(e *Engine) {
+		e.heartbeat.interval = interval
+	}
+}
+
+// WithEventStore makes Send append every event to the store before dispatching it, and
+// complete it once all its actions finished or were dropped. The events left pending by
+// a crash can be dispatched again with RecoverPending. SendSync doesn't store events.
+func WithEventStore(store EventStore) EngineOption {
+	return func(e *Engine) {
+		e.eventStore = store
+	}
+}
+
+// WithFairShares shares the global concurrency limit of the actions between the events
+// waiting for it in proportion to their weights, instead of in arrival order, so that a
+// noisy event can't take all the slots. Event keys without a weight weigh 1. It only
+// affects global limits with a wait queue, see ConcurrencyWithQueue.
+func WithFairShares(weights map[EventKey]int) EngineOption {
+	return func(e *Engine) {
+		e.fairShares = weights
+	}
+}
+
+// PanicHandler receives the value of a panic recovered from an action and the stack it
+// was raised from.
+type PanicHandler func(ctx context.Context, eventKey EventKey, actionKey ActionKey, recovered any, stack []byte)
+
+// WithPanicHandler sets a handler called when an action panics, on top of logging
+// waffle.action.panicked, e.g. to report the stack to an error tracker. Panics are always
+// recovered, so a panicking action doesn't crash the process and releases its slots.
+func WithPanicHandler(handler PanicHandler) EngineOption {
+	return func(e *Engine) {
+		e.panicHandler = handler
+	}
+}
+
+// WithSerialSpawn makes Send wait for each action it spawns to start before spawning the
+// next one, so that the actions of an event start in the order they are triggered.
+// Actions still run concurrently, only their start is serialized.
+func WithSerialSpawn() EngineOption {
+	return func(e *Engine) {
+		e.serialSpawn = true
+	}
 }
 
 // NewEngine creates a new event engine.
-func NewEngine(operationLogger OperationLogger) *Engine {
-	return &Engine{
-		triggers:                make(map[EventKey][]ActionKey),
-		actions:                 make(map[ActionKey]Action),
-		actionConcurrencyLimits: make(map[ActionKey]*ConcurrencyGroups),
-		operationLogger:         operationLogger,
+func NewEngine(operationLogger OperationLogger, opts ...EngineOption) *Engine {
+	engine := &Engine{
+		triggers:        make(map[EventKey][]ActionKey),
+		actions:         make(map[ActionKey]ActionConfiguration),
+		operationLogger: operationLogger,
+		clock:           realClock{},
+		running:         make(map[runningKey]int),
+		runningChanged:  make(chan struct{}),
+		correlationID:   newCorrelationID,
+		random:          rand.Float64,
+		fallbacks:       make(map[EventKey]Action),
+		completions:     make(chan Completion, completionsBuffer),
 	}
+
+	for _, opt := range opts {
+		opt(engine)
+	}
+
+	return engine
 }
 
-// logOperation logs an internal engine operation if a logger is set
+// logOperation logs an internal engine operation if a logger is set, adding the
+// correlation id of the dispatch to the metadata
 func (e *Engine) logOperation(ctx context.Context, event string, metadata map[string]string) {
 	if e.operationLogger != nil {
+		if id, ok := CorrelationIDFromContext(ctx); ok {
+			metadata["correlationId"] = id
+		}
+
+		if logger, ok := e.operationLogger.(TimestampedOperationLogger); ok {
+			logger.LogOperationAt(ctx, e.clock.Now(), event, metadata)
+			return
+		}
+
 		e.operationLogger.LogOperation(ctx, event, metadata)
 	}
 }
 
-// On registers an action for the given event keys.
+// On registers an action for the given event keys. Registering several actions for the
+// same event makes it trigger all of them, spawned in the order they were registered.
+// Registering an action key again replaces the previous registration, moving the action
+// last. Actions may be registered while events are being sent, the events sent once
+// registration returns trigger them.
+//
+// An event key may be a wildcard matching a family of events, split into segments by
+// the hierarchy separator or by "." when hierarchy is disabled: "*" matches exactly one
+// segment and "#" matches zero or more, e.g. "user.*" matches "user.created" and
+// "order.#" matches "order" and "order.item.added".
 func (e *Engine) On(eventKeys ...EventKey) *ActionBuilder {
 	return &ActionBuilder{
 		engine:            e,
 		eventKeys:         eventKeys,
 		concurrencyGroups: NewConcurrencyGroups(),
+		maxRetryLater:     DefaultMaxRetryLater,
 		errors:            make([]error, 0),
 	}
 }
 
+// MustOn registers an action without options for the event key, panicking when it can't
+// be registered. Use On with MustDo to configure the action.
+func (e *Engine) MustOn(eventKey EventKey, actionKey ActionKey, action Action) {
+	e.On(eventKey).MustDo(actionKey, action)
+}
+
 // Send sends an event to the engine which will trigger the registered action.
-// It returns true if the event was sent, false if no action is registered for the event.
-func (e *Engine) Send(ctx context.Context, eventKey EventKey, data any) bool {
-	actionKeys, ok := e.triggers[eventKey]
-	if !ok {
-		return false
+// It returns true if the event was sent, false if no action is registered for the event
+// or the event was sent deeper than the configured max depth, or the engine is shutting down.
+// When hierarchy is enabled, the actions of the ancestor keys are triggered as well.
+// Actions with a concurrency wait queue make Send wait for their slots. Events matching
+// a mounted engine are routed to it, see Mount. Options change how this event alone is
+// dispatched, e.g. WithDelay or WithDedupKey.
+func (e *Engine) Send(ctx context.Context, eventKey EventKey, data any, opts ...SendOption) bool {
+	var options sendOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if options.delay > 0 {
+		delay := options.delay
+		options.delay = 0
+		e.schedule(ctx, delay, eventKey, data, options)
+		return true
+	}
+
+	return e.send(ctx, eventKey, data, options) > 0
+}
+
+// SendCancelable sends an event like Send and returns a function canceling the context
+// of the actions it triggered, including their retries. Actions observe the cancellation
+// through ctx.Done(). Like with context.WithCancel, the function should be called once
+// the actions are no longer needed to release its resources.
+func (e *Engine) SendCancelable(ctx context.Context, eventKey EventKey, data any) (context.CancelFunc, bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	if e.send(ctx, eventKey, data, sendOptions{}) == 0 {
+		cancel()
+		return cancel, false
+	}
+
+	return cancel, true
+}
+
+// SendPriority sends an event like Send, running its actions even when their concurrency
+// limits are reached, for operator initiated runs that must not be dropped. The actions
+// don't acquire concurrency slots, so they don't count against the limits either.
+func (e *Engine) SendPriority(ctx context.Context, eventKey EventKey, data any) bool {
+	return e.send(ctx, eventKey, data, sendOptions{bypassConcurrency: true}) > 0
+}
+
+// Event is an event sent by SendBatch, with the options changing how it is dispatched.
+type Event struct {
+	Key     EventKey
+	Data    any
+	Options []SendOption
+}
+
+// SendBatch sends the events in order, each as if Send was called for it with its options,
+// and returns whether each one was sent, at the same index. Unlike SendMany, each event
+// gets its own correlation id.
+func (e *Engine) SendBatch(ctx context.Context, events []Event) []bool {
+	sent := make([]bool, len(events))
+	for i, event := range events {
+		sent[i] = e.Send(ctx, event.Key, event.Data, event.Options...)
+	}
+
+	return sent
+}
+
+// SendMany sends the same data to each of the event keys, as if Send was called for
+// each of them, with all the dispatches sharing one correlation id. It returns the total
+// number of actions triggered.
+func (e *Engine) SendMany(ctx context.Context, data any, eventKeys ...EventKey) int {
+	if _, ok := CorrelationIDFromContext(ctx); !ok {
+		ctx = withCorrelationID(ctx, e.correlationID(ctx))
+	}
+
+	triggered := 0
+	for _, eventKey := range eventKeys {
+		triggered += e.send(ctx, eventKey, data, sendOptions{})
+	}
+
+	return triggered
+}
+
+// sendOptions adjusts how a send dispatches its actions.
+type sendOptions struct {
+	// bypassConcurrency runs the actions without acquiring their concurrency limits
+	bypassConcurrency bool
+	// storedID is the id of an event recovered from the event store
+	storedID string
+	// handle tracks the actions of a SendAwait
+	handle *SendHandle
+	// synchronous runs the actions on the sending goroutine, without queueing them
+	synchronous bool
+	// delay postpones the send, see WithDelay
+	delay time.Duration
+	// dedupKey drops the event while another one with the same key is in flight
+	dedupKey string
+	// headers are the metadata of the event, see WithHeaders
+	headers map[string]string
+	// debounced spawns the action once its burst is quiet, without debouncing it again
+	debounced bool
+	// batched spawns the action with the data of a flushed batch, without batching it again
+	batched bool
+	// backpressure waits for slots and workers instead of dropping, see WithBackpressure
+	backpressure bool
+	// saturated records actions dropped for saturation, see TrySend
+	saturated *atomic.Bool
+	// routed skips the routers and the mounts, for events held while paused
+	routed bool
+	// detached runs the actions with a context not canceled with the caller's
+	detached bool
+	// waitPriority orders the actions waiting for concurrency slots, nil keeps the context's
+	waitPriority *int
+}
+
+// send dispatches the event and returns the number of actions it triggered.
+func (e *Engine) send(ctx context.Context, eventKey EventKey, data any, opts sendOptions) int {
+	// Recovered and resumed events were routed before
+	if opts.storedID == "" && !opts.routed {
+		eventKey = e.route(ctx, eventKey, data)
+		if sub, subKey, ok := e.mountFor(ctx, eventKey); ok {
+			if triggered := sub.send(ctx, subKey, data, opts); triggered > 0 {
+				return triggered
+			}
+		}
+	}
+
+	if held, triggered := e.holdPaused(ctx, eventKey, data, opts); held {
+		return triggered
+	}
+
+	if opts.waitPriority != nil {
+		ctx = ContextWithPriority(ctx, *opts.waitPriority)
+	}
+	ctx = withSendHandle(ctx, opts.handle)
+	ctx = withFanOut(ctx, nil)
+	ctx = withHeaders(ctx, opts.headers)
+	ctx, claimed := e.claimDedup(ctx, eventKey, opts.dedupKey)
+	if !claimed {
+		return 0
+	}
+
+	ctx = e.storeEvent(ctx, eventKey, data, opts)
+	ctx, actionKeys := e.dispatch(ctx, eventKey, data)
+	e.beginStored(ctx, len(actionKeys))
+	e.beginDedup(ctx, len(actionKeys))
+	opts.handle.add(len(actionKeys))
+	if len(actionKeys) == 0 {
+		return 0
+	}
+
+	if mode := e.fanOutMode(eventKey); mode != FanOutParallel && len(actionKeys) > 1 {
+		e.spawnSequential(ctx, actionKeys, data, eventKey, mode, opts)
+		return len(actionKeys)
+	}
+
+	spawned := false
+	for _, actionKey := range actionKeys {
+		if e.spawnAction(ctx, actionKey, data, eventKey, 0, opts) {
+			spawned = true
+		}
+	}
+
+	if !spawned {
+		e.runFallback(ctx, eventKey, data)
+	}
+
+	return len(actionKeys)
+}
+
+// dispatch prepares the dispatch of an event, returning the context of the dispatch
+// and the actions to trigger, or no actions if the event should not be dispatched.
+func (e *Engine) dispatch(ctx context.Context, eventKey EventKey, data any) (context.Context, []ActionKey) {
+	if e.rejectShutdown(ctx, eventKey) {
+		return ctx, nil
+	}
+
+	e.stats.sends.Add(1)
+	e.StartHeartbeat()
+
+	actionKeys := e.actionKeysFor(eventKey)
+	if len(actionKeys) == 0 {
+		e.stats.addDropReason(DropReasonNoHandler, 1)
+		return ctx, nil
+	}
+
+	// Key functions of the actions see the event that triggered them
+	ctx = withEventKey(ctx, eventKey)
+
+	// Events sent from within an action keep the correlation id of their dispatch
+	if _, ok := CorrelationIDFromContext(ctx); !ok {
+		ctx = withCorrelationID(ctx, e.correlationID(ctx))
+	}
+
+	if depth := depthFromContext(ctx); e.maxDepth > 0 && depth >= e.maxDepth {
+		// Log max depth exceeded
+		e.logOperation(ctx, "waffle.event.max_depth_exceeded", map[string]string{
+			"eventKey": string(eventKey),
+			"depth":    strconv.Itoa(depth),
+		})
+		e.drop(DropReasonMaxDepth, len(actionKeys))
+		return ctx, nil
+	}
+
+	for _, decorate := range e.contextDecorators {
+		ctx = decorate(ctx, eventKey, data)
 	}
 
 	// Log event received for non-internal events
@@ -83,34 +618,503 @@ func (e *Engine) Send(ctx context.Context, eventKey EventKey, data any) bool {
 		})
 	}
 
-	for _, actionKey := range actionKeys {
-		e.spawnAction(ctx, actionKey, data, eventKey)
+	return ctx, actionKeys
+}
+
+// UseRouter adds a router rewriting the key of every sent event before anything else
+// happens to it, including mount routing. Routers run in the order they were added, each
+// receiving the key returned by the previous one.
+func (e *Engine) UseRouter(router Router) {
+	e.registryMu.Lock()
+	defer e.registryMu.Unlock()
+
+	e.routers = append(slices.Clip(e.routers), router)
+}
+
+// route returns the event key rewritten by the routers.
+func (e *Engine) route(ctx context.Context, eventKey EventKey, data any) EventKey {
+	e.registryMu.RLock()
+	routers := e.routers
+	e.registryMu.RUnlock()
+
+	for _, router := range routers {
+		eventKey = router(ctx, eventKey, data)
 	}
 
-	return true
+	return eventKey
+}
+
+// Mount routes the events whose key starts with the prefix to the sub engine, which
+// receives them with the prefix stripped. For example, with a sub engine mounted at
+// "billing.", sending "billing.invoice.created" sends "invoice.created" to it. When the
+// sub engine has no action for the event, it is dispatched to the local actions instead.
+// The longest matching prefix wins. A nil engine unmounts the prefix.
+func (e *Engine) Mount(prefix string, sub *Engine) {
+	e.registryMu.Lock()
+	defer e.registryMu.Unlock()
+
+	// Replace the mounts rather than changing them, events being sent may still read them
+	mounts := slices.DeleteFunc(slices.Clone(e.mounts), func(m mount) bool {
+		return m.prefix == prefix
+	})
+
+	if sub != nil {
+		mounts = append(mounts, mount{prefix: prefix, engine: sub})
+		slices.SortStableFunc(mounts, func(a, b mount) int {
+			return len(b.prefix) - len(a.prefix)
+		})
+	}
+
+	e.mounts = mounts
+}
+
+// mountFor returns the engine mounted for the event key and the key to send it, or false
+// if the key matches no mount.
+func (e *Engine) mountFor(ctx context.Context, eventKey EventKey) (*Engine, EventKey, bool) {
+	e.registryMu.RLock()
+	mounts := e.mounts
+	e.registryMu.RUnlock()
+
+	for _, m := range mounts {
+		if subKey, ok := strings.CutPrefix(string(eventKey), m.prefix); ok {
+			// Log event routed
+			e.logOperation(ctx, "waffle.event.routed", map[string]string{
+				"eventKey": string(eventKey),
+				"prefix":   m.prefix,
+			})
+			return m.engine, EventKey(subKey), true
+		}
+	}
+
+	return nil, "", false
+}
+
+// ErrorHandler receives the error of an action that failed or panicked.
+type ErrorHandler func(ctx context.Context, eventKey EventKey, actionKey ActionKey, data any, err error)
+
+// OnError sets a handler called with the error of every action run that failed or
+// panicked and isn't retried, including runs of SendSync, e.g. to report errors to an
+// error tracker. A panic is reported as an error describing it. The handler runs on the
+// goroutine that ran the action. A nil handler removes the current one.
+func (e *Engine) OnError(handler ErrorHandler) {
+	if handler == nil {
+		e.errorHandler.Store(nil)
+		return
+	}
+
+	e.errorHandler.Store(&handler)
+}
+
+// reportError passes the error of an action to the error handler, if one is set.
+func (e *Engine) reportError(ctx context.Context, eventKey EventKey, actionKey ActionKey, data any, err error) {
+	if handler := e.errorHandler.Load(); handler != nil {
+		(*handler)(ctx, eventKey, actionKey, data, err)
+	}
+}
+
+// OnDropped sets a fallback action run synchronously by Send when every action of the
+// event was dropped, e.g. because of concurrency limits. It doesn't run for events
+// without actions. A nil fallback removes the current one.
+func (e *Engine) OnDropped(eventKey EventKey, fallback Action) {
+	e.registryMu.Lock()
+	defer e.registryMu.Unlock()
+
+	if fallback == nil {
+		delete(e.fallbacks, eventKey)
+		return
+	}
+
+	e.fallbacks[eventKey] = fallback
+}
+
+// runFallback runs the fallback of an event whose actions were all dropped, if one is set.
+func (e *Engine) runFallback(ctx context.Context, eventKey EventKey, data any) {
+	e.registryMu.RLock()
+	fallback, ok := e.fallbacks[eventKey]
+	e.registryMu.RUnlock()
+	if !ok {
+		return
+	}
+
+	// Log fallback started
+	e.logOperation(ctx, "waffle.event.fallback", map[string]string{
+		"eventKey": string(eventKey),
+	})
+	if e.dryRun {
+		return
+	}
+
+	if err := fallback(ctx, data); err != nil {
+		// Log fallback failed
+		e.logOperation(ctx, "waffle.event.fallback_failed", map[string]string{
+			"eventKey": string(eventKey),
+			"error":    err.Error(),
+		})
+	}
 }
 
-// AddActionConfiguration adds an action configuration to the engine.
-func (e *Engine) AddActionConfiguration(configuration ActionConfiguration) {
-	// TODO: move validations here
-	e.actions[configuration.ActionKey] = configuration.Action
+// actionKeysFor returns the actions triggered by the event key. When hierarchy is
+// enabled it walks up the key levels, most specific first. The actions of the matching
+// wildcards come last. Each action is returned once.
+func (e *Engine) actionKeysFor(eventKey EventKey) []ActionKey {
+	e.registryMu.RLock()
+	defer e.registryMu.RUnlock()
+
+	if e.hierarchySeparator == "" && len(e.wildcards) == 0 {
+		return e.triggers[eventKey]
+	}
+
+	seen := make(map[ActionKey]struct{})
+	actionKeys := make([]ActionKey, 0)
+	add := func(triggered []ActionKey) {
+		for _, actionKey := range triggered {
+			if _, ok := seen[actionKey]; ok {
+				continue
+			}
+			seen[actionKey] = struct{}{}
+			actionKeys = append(actionKeys, actionKey)
+		}
+	}
+
+	key := string(eventKey)
+	for {
+		add(e.triggers[EventKey(key)])
+
+		if e.hierarchySeparator == "" {
+			break
+		}
+		key = e.parentKey(key)
+		if key == "" {
+			break
+		}
+	}
+
+	if len(e.wildcards) > 0 {
+		segments := strings.Split(string(eventKey), e.segmentSeparator())
+		for _, w := range e.wildcards {
+			if w.eventKey != eventKey && matchSegments(w.segments, segments) {
+				add(e.triggers[w.eventKey])
+			}
+		}
+	}
+
+	return actionKeys
+}
+
+// parentKey returns the closest non-empty ancestor of the key, or an empty string
+// when the key is at the top level.
+func (e *Engine) parentKey(key string) string {
+	i := strings.LastIndex(key, e.hierarchySeparator)
+	if i < 0 {
+		return ""
+	}
+
+	parent := key[:i]
+	for strings.HasSuffix(parent, e.hierarchySeparator) {
+		parent = strings.TrimSuffix(parent, e.hierarchySeparator)
+	}
+
+	return parent
+}
+
+// AddActionConfiguration validates an action configuration and adds it to the engine.
+// It returns an ErrBuilderBadParams listing every invalid field. It is safe to call while
+// events are being sent.
+func (e *Engine) AddActionConfiguration(configuration ActionConfiguration) error {
+	return e.addActionConfiguration("AddActionConfiguration", configuration, true)
+}
+
+// addActionConfiguration validates and adds an action configuration, reporting the errors
+// for the method. Unless replace is set, registering an action key again fails.
+func (e *Engine) addActionConfiguration(method string, configuration ActionConfiguration, replace bool) error {
+	errs := make([]error, 0)
+
+	if configuration.ActionKey == "" {
+		errs = append(errs, &BuilderError{Method: method, Field: "actionKey", Reason: "must be provided"})
+	}
+
+	if len(configuration.EventKeys) == 0 {
+		errs = append(errs, &BuilderError{Method: method, Field: "eventKeys", Reason: "must be provided"})
+	}
+
+	if configuration.Action == nil {
+		errs = append(errs, &BuilderError{Method: method, Field: "action", Reason: "must be provided"})
+	}
+
+	if len(errs) > 0 {
+		return &ErrBuilderBadParams{Errors: errs}
+	}
+
+	// Drop the runs of a queue no longer used once unlocked, settling them may spawn actions
+	var orphaned *actionQueue
+	defer func() { e.dropQueue(orphaned) }()
+
+	e.registryMu.Lock()
+	defer e.registryMu.Unlock()
+
+	if _, ok := e.actions[configuration.ActionKey]; ok && !replace {
+		return &ErrBuilderBadParams{Errors: []error{
+			&BuilderError{Method: method, Field: "actionKey", Reason: fmt.Sprintf("%q is already registered", configuration.ActionKey)},
+		}}
+	}
+
+	if global := configuration.ConcurrencyGroups.globalLimit(); global != nil && e.fairShares != nil {
+		global.setFairShares(e.fairShares)
+	}
+
+	// Registering an action key again keeps the runs already queued
+	queue, queued := e.queues[configuration.ActionKey]
+	switch {
+	case configuration.QueueWhenLimited && queued:
+		queue.resize(configuration.QueueSize, configuration.QueueOverflow)
+	case configuration.QueueWhenLimited:
+		if e.queues == nil {
+			e.queues = make(map[ActionKey]*actionQueue)
+		}
+		e.queues[configuration.ActionKey] = newActionQueue(configuration.QueueSize, configuration.QueueOverflow)
+	case queued:
+		delete(e.queues, configuration.ActionKey)
+		orphaned = queue
+	}
+
+	// Registering an action key again replaces its configuration and its triggers
+	if previous, ok := e.actions[configuration.ActionKey]; ok {
+		for _, eventKey := range previous.EventKeys {
+			e.removeTrigger(eventKey, configuration.ActionKey)
+		}
+	}
+	e.actions[configuration.ActionKey] = configuration
 
 	for _, eventKey := range configuration.EventKeys {
-		e.triggers[eventKey] = append(e.triggers[eventKey], configuration.ActionKey)
+		e.addTrigger(eventKey, configuration.ActionKey)
+	}
+
+	return nil
+}
+
+// Off stops the event from triggering the action, leaving the action registered for its
+// other events. Runs already admitted finish normally. It returns false when the event
+// didn't trigger the action.
+func (e *Engine) Off(eventKey EventKey, actionKey ActionKey) bool {
+	e.registryMu.Lock()
+	defer e.registryMu.Unlock()
+
+	if !slices.Contains(e.triggers[eventKey], actionKey) {
+		return false
+	}
+	e.removeTrigger(eventKey, actionKey)
+
+	if configuration, ok := e.actions[actionKey]; ok {
+		configuration.EventKeys = slices.DeleteFunc(slices.Clone(configuration.EventKeys), func(key EventKey) bool {
+			return key == eventKey
+		})
+		e.actions[actionKey] = configuration
+	}
+
+	return true
+}
+
+// RemoveAction unregisters the action and stops every event from triggering it. Runs
+// already started finish normally while queued runs are dropped, and its OnClose
+// teardowns are no longer run by Close. It returns false when the action is neither
+// registered nor triggered.
+func (e *Engine) RemoveAction(actionKey ActionKey) bool {
+	// Drop the queued runs once unlocked, settling them may spawn actions
+	var orphaned *actionQueue
+	defer func() { e.dropQueue(orphaned) }()
+
+	e.registryMu.Lock()
+	defer e.registryMu.Unlock()
+
+	_, removed := e.actions[actionKey]
+	delete(e.actions, actionKey)
+
+	orphaned = e.queues[actionKey]
+	delete(e.queues, actionKey)
+
+	for eventKey, actionKeys := range e.triggers {
+		if slices.Contains(actionKeys, actionKey) {
+			e.removeTrigger(eventKey, actionKey)
+			removed = true
+		}
+	}
+
+	return removed
+}
+
+// Triggers returns a copy of the routing table, mapping each event key, wildcards
+// included, to the keys of the actions it triggers in the order they run.
+func (e *Engine) Triggers() map[EventKey][]ActionKey {
+	e.registryMu.RLock()
+	defer e.registryMu.RUnlock()
+
+	triggers := make(map[EventKey][]ActionKey, len(e.triggers))
+	for eventKey, actionKeys := range e.triggers {
+		triggers[eventKey] = slices.Clone(actionKeys)
+	}
+
+	return triggers
+}
+
+// Actions returns a copy of the configurations of the registered actions, by action key.
+// Changing the copies doesn't change the actions, but their concurrency groups and
+// throttles are shared with the engine.
+func (e *Engine) Actions() map[ActionKey]ActionConfiguration {
+	e.registryMu.RLock()
+	defer e.registryMu.RUnlock()
+
+	actions := make(map[ActionKey]ActionConfiguration, len(e.actions))
+	for actionKey, configuration := range e.actions {
+		configuration.EventKeys = slices.Clone(configuration.EventKeys)
+		configuration.Middlewares = slices.Clone(configuration.Middlewares)
+		configuration.OnClose = slices.Clone(configuration.OnClose)
+		configuration.Labels = maps.Clone(configuration.Labels)
+		actions[actionKey] = configuration
+	}
+
+	return actions
+}
+
+// ActionsWithLabel returns the keys of the actions tagged with the label, sorted.
+func (e *Engine) ActionsWithLabel(key, value string) []ActionKey {
+	e.registryMu.RLock()
+	defer e.registryMu.RUnlock()
+
+	actionKeys := make([]ActionKey, 0)
+	for actionKey, configuration := range e.actions {
+		if labelValue, ok := configuration.Labels[key]; ok && labelValue == value {
+			actionKeys = append(actionKeys, actionKey)
+		}
+	}
+	slices.Sort(actionKeys)
+
+	return actionKeys
+}
+
+// spawnAction admits the action through its concurrency limits and runs it in a new
+// goroutine, or on the calling goroutine for inline actions. It returns false when the
+// action was dropped.
+func (e *Engine) spawnAction(ctx context.Context, actionKey ActionKey, data any, eventKey EventKey, attempt uint, opts sendOptions) bool {
+	configuration, data, release, status := e.admitAction(ctx, actionKey, data, eventKey, opts)
+	if configuration.Detached || opts.detached {
+		ctx = context.WithoutCancel(ctx)
+	}
+
+	switch status {
+	case admissionDropped:
+		e.settleDispatch(ctx, ActionResult{ActionKey: actionKey, Err: ErrDropped})
+		return false
+	case admissionLimited:
+		return e.enqueueRun(ctx, configuration, data, eventKey, attempt, opts)
+	case admissionSkipped:
+		e.settleDispatch(ctx, ActionResult{ActionKey: actionKey})
+		return true
+	case admissionDebounced, admissionBatched:
+		return true
+	}
+
+	return e.startAction(ctx, configuration, data, eventKey, attempt, opts, release)
+}
+
+// startAction runs an admitted action in a new goroutine, or on the calling goroutine for
+// inline actions. It returns false when the action was dropped for lack of workers.
+func (e *Engine) startAction(ctx context.Context, configuration ActionConfiguration, data any, eventKey EventKey, attempt uint, opts sendOptions, release func()) bool {
+	actionKey := configuration.ActionKey
+	if e.dryRunAction(ctx, actionKey, eventKey, release) {
+		e.settleDispatch(ctx, ActionResult{ActionKey: actionKey})
+		return true
+	}
+
+	if configuration.Inline {
+		e.stats.dispatched.Add(1)
+		e.runAction(ctx, configuration, data, eventKey, attempt, opts, release)
+		return true
+	}
+
+	if !e.acquireWorker(ctx, actionKey, eventKey, opts.backpressure) {
+		opts.markSaturated()
+		release()
+		e.settleDispatch(ctx, ActionResult{ActionKey: actionKey, Err: ErrDropped})
+		return false
+	}
+
+	releaseSlots := release
+	release = func() {
+		releaseSlots()
+		e.releaseWorker()
+	}
+
+	var started chan struct{}
+	if e.serialSpawn {
+		started = make(chan struct{})
+		signal := sync.OnceFunc(func() { close(started) })
+		action := configuration.Action
+		configuration.Action = func(ctx context.Context, data any) error {
+			signal()
+			return action(ctx, data)
+		}
+
+		// Middlewares or Map may return before the action starts
+		runRelease := release
+		release = func() {
+			signal()
+			runRelease()
+		}
+	}
+
+	run := func() {
+		e.runAction(ctx, configuration, data, eventKey, attempt, opts, release)
+	}
+	if !e.submitToPool(ctx, actionKey, eventKey, run, opts.backpressure) {
+		opts.markSaturated()
+		release()
+		e.settleDispatch(ctx, ActionResult{ActionKey: actionKey, Err: ErrDropped})
+		return false
+	}
+	e.stats.dispatched.Add(1)
+
+	if started != nil {
+		<-started
 	}
 
-	e.actionConcurrencyLimits[configuration.ActionKey] = configuration.ConcurrencyGroups
+	return true
 }
 
-func (e *Engine) spawnAction(ctx context.Context, actionKey ActionKey, data any, eventKey EventKey) {
-	action, ok := e.actions[actionKey]
+// admission is the outcome of admitting an action.
+type admission int
+
+const (
+	// admissionAdmitted means the action got its concurrency slots and may run
+	admissionAdmitted admission = iota
+	// admissionDropped means the action was dropped
+	admissionDropped
+	// admissionLimited means the concurrency limits of a queued action are reached, see
+	// ActionConfiguration.QueueWhenLimited
+	admissionLimited
+	// admissionSkipped means the data of the event didn't pass the When predicate
+	admissionSkipped
+	// admissionDebounced means the run is held until its burst is quiet, see
+	// ActionConfiguration.DebounceWindow
+	admissionDebounced
+	// admissionBatched means the run was added to the pending batch of the action, see
+	// ActionConfiguration.BatchSize
+	admissionBatched
+)
+
+// admitAction admits the action through its concurrency limits, returning its
+// configuration, the data to run it with and a function releasing its slots. Bypassing
+// concurrency always admits the action. Actions that queue when limited aren't dropped
+// for lack of slots, unless run synchronously.
+func (e *Engine) admitAction(ctx context.Context, actionKey ActionKey, data any, eventKey EventKey, opts sendOptions) (ActionConfiguration, any, func(), admission) {
+	configuration, ok := e.actionConfiguration(actionKey, eventKey)
 	if !ok {
 		// Log action spawn failed
 		e.logOperation(ctx, "waffle.action.spawn_failed", map[string]string{
 			"actionKey": string(actionKey),
 			"eventKey":  string(eventKey),
 		})
-		return
+		e.drop(DropReasonUnknownAction, 1)
+		return ActionConfiguration{}, nil, nil, admissionDropped
 	}
 
 	// Log action spawned
@@ -119,44 +1123,499 @@ func (e *Engine) spawnAction(ctx context.Context, actionKey ActionKey, data any,
 		"eventKey":  string(eventKey),
 	})
 
-	acquired, release := true, func() {}
-	groups := e.actionConcurrencyLimits[actionKey]
-	if len(groups.groups) > 0 {
-		acquired, release = groups.TryAcquire(ctx, data)
-		if acquired {
-			// Log concurrency acquire success
-			e.logOperation(ctx, "waffle.concurrency.acquire_success", map[string]string{
+	if configuration.DefaultData != nil && isNil(data) {
+		data = configuration.DefaultData(ctx)
+	}
+
+	if configuration.When != nil && !configuration.When(ctx, data) {
+		// Log action skipped
+		e.logOperation(ctx, "waffle.action.skipped", map[string]string{
+			"actionKey": string(actionKey),
+			"eventKey":  string(eventKey),
+		})
+		e.stats.skipped.Add(1)
+		return ActionConfiguration{}, nil, nil, admissionSkipped
+	}
+
+	if configuration.DebounceWindow > 0 && !opts.synchronous && !opts.debounced {
+		e.debounce(ctx, configuration, data, eventKey, opts)
+		return ActionConfiguration{}, nil, nil, admissionDebounced
+	}
+
+	if configuration.BatchSize > 0 && !opts.batched {
+		if opts.synchronous {
+			data = []any{data}
+		} else {
+			e.addToBatch(ctx, configuration, data, eventKey, opts)
+			return ActionConfiguration{}, nil, nil, admissionBatched
+		}
+	}
+
+	if configuration.Throttle != nil && !configuration.Throttle.allow(ctx, data, e.clock.Now()) {
+		// Log action throttled
+		e.logOperation(ctx, "waffle.action.throttled", map[string]string{
+			"actionKey": string(actionKey),
+			"eventKey":  string(eventKey),
+		})
+		e.drop(DropReasonThrottled, 1)
+		opts.markSaturated()
+		return ActionConfiguration{}, nil, nil, admissionDropped
+	}
+
+	if group, ok := configuration.RateLimits.allow(ctx, data, e.clock.Now()); !ok {
+		// Log action rate limited
+		e.logOperation(ctx, "waffle.action.rate_limited", map[string]string{
+			"actionKey": string(actionKey),
+			"eventKey":  string(eventKey),
+			"group":     group,
+		})
+		e.drop(DropReasonRateLimited, 1)
+		opts.markSaturated()
+		return ActionConfiguration{}, nil, nil, admissionDropped
+	}
+
+	if configuration.DeadlineFromData != nil {
+		if deadline, ok := configuration.DeadlineFromData(ctx, data); ok && !e.clock.Now().Before(deadline) {
+			// Log action deadline passed
+			e.logOperation(ctx, "waffle.action.deadline_passed", map[string]string{
 				"actionKey": string(actionKey),
+				"eventKey":  string(eventKey),
+				"deadline":  deadline.Format(time.RFC3339Nano),
 			})
-		} else {
-			// Log concurrency acquire failed
-			e.logOperation(ctx, "waffle.concurrency.acquire_failed", map[string]string{
+			e.drop(DropReasonDeadlinePassed, 1)
+			return ActionConfiguration{}, nil, nil, admissionDropped
+		}
+	}
+
+	acquired, keys, release := true, []string(nil), func() {}
+	groups := configuration.ConcurrencyGroups
+	logConcurrency := !groups.empty() && !configuration.QuietConcurrencyLogs && !opts.bypassConcurrency
+	if opts.bypassConcurrency {
+		// Log priority bypass
+		e.logOperation(ctx, "waffle.action.priority_bypass", map[string]string{
+			"actionKey": string(actionKey),
+			"eventKey":  string(eventKey),
+		})
+	} else if !groups.empty() {
+		var err error
+		// Actions queued when limited wait in their queue rather than on the sender
+		block := opts.backpressure && !(configuration.QueueWhenLimited && !opts.synchronous)
+		acquired, keys, release, err = e.acquireSlots(ctx, groups, data, block)
+		if errors.Is(err, ErrKeyCapReached) {
+			// Log key cap reached, even for quiet actions
+			e.logOperation(ctx, "waffle.concurrency.key_cap_reached", map[string]string{
+				"actionKey": string(actionKey),
+				"eventKey":  string(eventKey),
+			})
+			e.drop(DropReasonKeyCap, 1)
+			return ActionConfiguration{}, nil, nil, admissionDropped
+		}
+
+		if err != nil {
+			// Log key function error, even for quiet actions
+			e.logOperation(ctx, "waffle.concurrency.keyfunc_error", map[string]string{
+				"actionKey": string(actionKey),
+				"eventKey":  string(eventKey),
+				"error":     err.Error(),
+			})
+			e.drop(DropReasonKeyError, 1)
+			return ActionConfiguration{}, nil, nil, admissionDropped
+		}
+
+		if !acquired {
+			if logConcurrency {
+				// Log concurrency acquire failed
+				e.logOperation(ctx, "waffle.concurrency.acquire_failed", map[string]string{
+					"actionKey": string(actionKey),
+				})
+			}
+			if configuration.QueueWhenLimited && !opts.synchronous {
+				return configuration, data, nil, admissionLimited
+			}
+
+			e.drop(DropReasonConcurrencyLimit, 1)
+			opts.markSaturated()
+			return ActionConfiguration{}, nil, nil, admissionDropped
+		}
+
+		if logConcurrency {
+			// Log concurrency acquire success
+			e.logOperation(ctx, "waffle.concurrency.acquire_success", map[string]string{
 				"actionKey": string(actionKey),
 			})
-			return
 		}
 	}
 
-	// Create release function that logs released event
-	originalRelease := release
-	release = func() {
-		originalRelease()
-		if len(groups.groups) > 0 {
+	return configuration, data, e.trackAdmitted(ctx, actionKey, keys, release, logConcurrency), admissionAdmitted
+}
+
+// trackAdmitted tracks the run of an admitted action, returning a release function that
+// frees its slots, lets the queued actions take them and stops tracking the run.
+func (e *Engine) trackAdmitted(ctx context.Context, actionKey ActionKey, keys []string, release func(), logConcurrency bool) func() {
+	untrack := e.trackRunning(actionKey, keys)
+
+	return func() {
+		release()
+		if logConcurrency {
 			// Log concurrency released
 			e.logOperation(ctx, "waffle.concurrency.released", map[string]string{
 				"actionKey": string(actionKey),
 			})
 		}
+
+		// Start the queued actions before untracking, so that the engine isn't idle in between
+		e.drainQueues()
+		untrack()
+	}
+}
+
+// IsRunning reports whether an invocation of the action is in flight for the
+// concurrency key computed by any of its groups. An empty key reports whether any
+// invocation of the action is in flight.
+func (e *Engine) IsRunning(actionKey ActionKey, key string) bool {
+	e.runningMu.Lock()
+	defer e.runningMu.Unlock()
+
+	return e.running[runningKey{actionKey: actionKey, key: key}] > 0
+}
+
+// trackRunning marks an invocation of the action as in flight under the concurrency
+// keys and the empty key, returning a function that unmarks it.
+func (e *Engine) trackRunning(actionKey ActionKey, keys []string) func() {
+	runningKeys := make([]runningKey, 0, len(keys)+1)
+	runningKeys = append(runningKeys, runningKey{actionKey: actionKey})
+	for _, key := range keys {
+		if key != "" && !slices.ContainsFunc(runningKeys, func(k runningKey) bool { return k.key == key }) {
+			runningKeys = append(runningKeys, runningKey{actionKey: actionKey, key: key})
+		}
+	}
+
+	e.runningMu.Lock()
+	for _, key := range runningKeys {
+		e.running[key]++
+	}
+	e.runningMu.Unlock()
+
+	return func() {
+		e.runningMu.Lock()
+		defer e.runningMu.Unlock()
+
+		for _, key := range runningKeys {
+			e.running[key]--
+			if e.running[key] == 0 {
+				delete(e.running, key)
+			}
+		}
+
+		close(e.runningChanged)
+		e.runningChanged = make(chan struct{})
+	}
+}
+
+// waitRunning waits until done reports true, checking it with the running lock held
+// whenever an invocation finishes. It returns the context error if the context is done first.
+func (e *Engine) waitRunning(ctx context.Context, done func() bool) error {
+	for {
+		e.runningMu.Lock()
+		if done() {
+			e.runningMu.Unlock()
+			return nil
+		}
+		changed := e.runningChanged
+		e.runningMu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Wait waits until no action is in flight, or returns the context error if the context
+// is done first. Events sent by the actions are waited for as well, since they are
+// dispatched before the actions sending them return. Retries that are scheduled but not
+// yet running aren't waited for.
+func (e *Engine) Wait(ctx context.Context) error {
+	return e.waitRunning(ctx, func() bool {
+		return len(e.running) == 0
+	})
+}
+
+// WaitIdle waits until no invocation of the action is in flight, or returns the context
+// error if the context is done first. Retries that are scheduled but not yet running
+// aren't waited for.
+func (e *Engine) WaitIdle(ctx context.Context, actionKey ActionKey) error {
+	return e.waitRunning(ctx, func() bool {
+		return e.running[runningKey{actionKey: actionKey}] == 0
+	})
+}
+
+// ErrShutdown is returned by SendSync once the engine is shutting down.
+var ErrShutdown = errors.New("engine is shutting down")
+
+// Shutdown stops the engine from accepting new events and then closes it like Close,
+// waiting for the in-flight actions to finish and running the teardowns. Events sent
+// afterwards, including by the in-flight actions, are rejected and logged as
+// waffle.event.rejected. If the context is done first, Shutdown returns its error and
+// the engine keeps rejecting events.
+func (e *Engine) Shutdown(ctx context.Context) error {
+	e.shuttingDown.Store(true)
+	return e.Close(ctx)
+}
+
+// rejectShutdown rejects the event if the engine is shutting down.
+func (e *Engine) rejectShutdown(ctx context.Context, eventKey EventKey) bool {
+	if !e.shuttingDown.Load() {
+		return false
+	}
+
+	// Log event rejected
+	e.logOperation(ctx, "waffle.event.rejected", map[string]string{
+		"eventKey": string(eventKey),
+	})
+	e.stats.addDropReason(DropReasonShutdown, 1)
+
+	return true
+}
+
+// Close flushes the pending batches, waits for the in-flight actions to finish and then
+// stops the heartbeat and runs the OnClose teardowns of the actions, returning their
+// errors joined. Retries that are scheduled but not yet running aren't waited for. If the context is done first, Close
+// returns its error without running the teardowns, so it may be called again. The
+// teardowns run once, later calls return nil.
+func (e *Engine) Close(ctx context.Context) error {
+	e.flushBatches()
+	if err := e.Wait(ctx); err != nil {
+		return err
+	}
+
+	e.closedMu.Lock()
+	defer e.closedMu.Unlock()
+
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	e.stopHeartbeat()
+	e.stopPool()
+
+	e.registryMu.RLock()
+	teardowns := make([]func(context.Context) error, 0)
+	for _, actionKey := range slices.Sorted(maps.Keys(e.actions)) {
+		teardowns = append(teardowns, e.actions[actionKey].OnClose...)
+	}
+	e.registryMu.RUnlock()
+
+	errs := make([]error, 0)
+	for _, teardown := range teardowns {
+		if err := teardown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// runAction runs an admitted action and logs its outcome, releasing its concurrency
+// slots once it returns. An action asking to be retried later, or failing with a retry
+// policy, is spawned again after the delay as long as it has retries left. A panic in
+// the action is recovered and logged as waffle.action.panicked, without retrying.
+func (e *Engine) runAction(ctx context.Context, configuration ActionConfiguration, data any, eventKey EventKey, attempt uint, opts sendOptions, release func()) {
+	defer release()
+
+	actionKey := configuration.ActionKey
+	recovered, duration, err := e.executeAction(ctx, configuration, data, eventKey)
+
+	var retryLater ErrRetryLater
+	if recovered == nil && errors.As(err, &retryLater) && attempt < configuration.MaxRetryLater {
+		// Log retry scheduled
+		e.logOperation(ctx, "waffle.action.retry_scheduled", map[string]string{
+			"actionKey": string(actionKey),
+			"eventKey":  string(eventKey),
+			"attempt":   strconv.FormatUint(uint64(attempt+1), 10),
+			"delayMs":   strconv.FormatInt(retryLater.After.Milliseconds(), 10),
+		})
+		e.clock.AfterFunc(retryLater.After, func() {
+			e.spawnAction(ctx, actionKey, data, eventKey, attempt+1, opts)
+		})
+		return
 	}
 
-	go func(_release func()) {
-		defer _release()
-		// Log action started
-		e.logOperation(ctx, "waffle.action.started", map[string]string{
+	if recovered == nil && err != nil && !errors.Is(err, ErrStop) && configuration.Backoff != nil && attempt+1 < configuration.RetryAttempts {
+		delay := configuration.Backoff(attempt)
+		// Log retry scheduled
+		e.logOperation(ctx, "waffle.action.retry_scheduled", map[string]string{
 			"actionKey": string(actionKey),
 			"eventKey":  string(eventKey),
+			"attempt":   strconv.FormatUint(uint64(attempt+1), 10),
+			"delayMs":   strconv.FormatInt(delay.Milliseconds(), 10),
+			"error":     err.Error(),
+		})
+		e.clock.AfterFunc(delay, func() {
+			e.spawnAction(ctx, actionKey, data, eventKey, attempt+1, opts)
 		})
-		// TODO: handle errors
-		_ = action(ctx, data)
-	}(release)
+		return
+	}
+
+	e.logOutcome(ctx, actionKey, eventKey, data, recovered, err, duration)
+
+	if recovered != nil {
+		e.deadLetter(ctx, actionKey, eventKey, data, panicError(recovered), attempt+1)
+	} else if err != nil && !errors.Is(err, ErrStop) {
+		e.deadLetter(ctx, actionKey, eventKey, data, err, attempt+1)
+	}
+}
+
+// executeAction runs the action on the calling goroutine with the context of its run,
+// returning the recovered panic, how long it ran and the error of the action.
+func (e *Engine) executeAction(ctx context.Context, configuration ActionConfiguration, data any, eventKey EventKey) (recovered *actionPanic, duration time.Duration, err error) {
+	actionCtx := withDepth(ctx, depthFromContext(ctx)+1)
+	if configuration.Timeout > 0 {
+		var cancel context.CancelFunc
+		actionCtx, cancel = context.WithTimeout(actionCtx, configuration.Timeout)
+		defer cancel()
+	}
+
+	if configuration.DeadlineFromData != nil {
+		if deadline, ok := configuration.DeadlineFromData(ctx, data); ok {
+			var cancel context.CancelFunc
+			actionCtx, cancel = context.WithDeadline(actionCtx, deadline)
+			defer cancel()
+		}
+	}
+
+	// Log action started
+	e.logOperation(ctx, "waffle.action.started", map[string]string{
+		"actionKey": string(configuration.ActionKey),
+		"eventKey":  string(eventKey),
+	})
+	startedAt := e.clock.Now()
+	actionCtx = context.WithValue(actionCtx, actionKeyKey{}, configuration.ActionKey)
+	recovered, err = invokeAction(actionCtx, e.wrapAction(configuration, e.mappedAction(ctx, configuration, eventKey)), data)
+
+	return recovered, e.clock.Now().Sub(startedAt), err
+}
+
+// logOutcome logs how a run of the action ended, counts it in the stats and publishes
+// its completion. An action returning ErrStop finished successfully.
+func (e *Engine) logOutcome(ctx context.Context, actionKey ActionKey, eventKey EventKey, data any, recovered *actionPanic, err error, duration time.Duration) {
+	durationMs := strconv.FormatInt(duration.Milliseconds(), 10)
+	defer func() {
+		if recovered != nil {
+			err = panicError(recovered)
+		} else if errors.Is(err, ErrStop) {
+			err = nil
+		}
+
+		e.registryMu.RLock()
+		labels := e.actions[actionKey].Labels
+		e.registryMu.RUnlock()
+		e.stats.processed.Add(1)
+		e.complete(Completion{EventKey: eventKey, ActionKey: actionKey, Err: err, Duration: duration, Labels: labels})
+		e.settleDispatch(ctx, ActionResult{ActionKey: actionKey, Err: err, Duration: duration})
+
+		if err != nil {
+			e.reportError(ctx, eventKey, actionKey, data, err)
+		}
+	}()
+
+	if recovered != nil {
+		// Log action panicked
+		e.logOperation(ctx, "waffle.action.panicked", map[string]string{
+			"actionKey":  string(actionKey),
+			"eventKey":   string(eventKey),
+			"durationMs": durationMs,
+			"panic":      fmt.Sprint(recovered.value),
+		})
+		e.stats.panicked.Add(1)
+
+		if e.panicHandler != nil {
+			e.panicHandler(ctx, eventKey, actionKey, recovered.value, recovered.stack)
+		}
+		return
+	}
+
+	if err != nil && !errors.Is(err, ErrStop) {
+		// Log action failed
+		e.logOperation(ctx, "waffle.action.failed", map[string]string{
+			"actionKey":  string(actionKey),
+			"eventKey":   string(eventKey),
+			"durationMs": durationMs,
+			"error":      err.Error(),
+		})
+		e.stats.failed.Add(1)
+		return
+	}
+
+	// Log action finished
+	e.logOperation(ctx, "waffle.action.finished", map[string]string{
+		"actionKey":  string(actionKey),
+		"eventKey":   string(eventKey),
+		"durationMs": durationMs,
+	})
+}
+
+// actionPanic is a panic recovered from an action, with the stack it was raised from.
+type actionPanic struct {
+	value any
+	stack []byte
+}
+
+// panicError returns the error reported for an action that panicked.
+func panicError(recovered *actionPanic) error {
+	return fmt.Errorf("action panicked: %v", recovered.value)
+}
+
+// ErrMapFailed wraps the error of an action run whose data ActionBuilder.Map couldn't map.
+var ErrMapFailed = errors.New("map action data")
+
+// mappedAction returns the action of the configuration, running its data through Map
+// first when set.
+func (e *Engine) mappedAction(ctx context.Context, configuration ActionConfiguration, eventKey EventKey) Action {
+	if configuration.Map == nil {
+		return configuration.Action
+	}
+
+	return func(actionCtx context.Context, data any) error {
+		mapped, err := configuration.Map(actionCtx, data)
+		if err != nil {
+			// Log action map failed
+			e.logOperation(ctx, "waffle.action.map_failed", map[string]string{
+				"actionKey": string(configuration.ActionKey),
+				"eventKey":  string(eventKey),
+				"error":     err.Error(),
+			})
+			return fmt.Errorf("%w: %w", ErrMapFailed, err)
+		}
+
+		return configuration.Action(actionCtx, mapped)
+	}
+}
+
+// invokeAction runs the action, recovering a panic so that it doesn't crash the
+// process. It returns the recovered panic, nil when the action didn't panic.
+func invokeAction(ctx context.Context, action Action, data any) (recovered *actionPanic, err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			recovered = &actionPanic{value: value, stack: debug.Stack()}
+		}
+	}()
+
+	return nil, action(ctx, data)
+}
+
+// isNil reports whether data is nil or a typed nil such as a nil pointer or map.
+func isNil(data any) bool {
+	if data == nil {
+		return true
+	}
+
+	value := reflect.ValueOf(data)
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Interface, reflect.Func, reflect.Chan:
+		return value.IsNil()
+	default:
+		return false
+	}
 }
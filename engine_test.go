@@ -2,7 +2,11 @@ package waffle_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -98,6 +102,25 @@ func TestEngine_DifferentActionsForEvent(t *testing.T) {
 	require.True(t, ran2)
 }
 
+func TestEngine_ActionsRunInRegistrationOrder(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	for _, actionKey := range []waffle.ActionKey{"validate", "store", "notify", "store"} {
+		require.NoError(t, engine.On("test").Do(actionKey, func(_ context.Context, _ any) error {
+			return nil
+		}))
+	}
+
+	// Registering "store" again moves it last instead of triggering it twice
+	results, err := engine.SendSync(t.Context(), "test", nil)
+	require.NoError(t, err)
+	actionKeys := make([]waffle.ActionKey, 0, len(results))
+	for _, result := range results {
+		actionKeys = append(actionKeys, result.ActionKey)
+	}
+	require.Equal(t, []waffle.ActionKey{"validate", "notify", "store"}, actionKeys)
+}
+
 func TestEngine_OneActionForMultipleEvents(t *testing.T) {
 	counter := atomic.Int32{}
 
@@ -553,3 +576,1861 @@ func TestEngine_OperationLogging_InternalEventsNotLogged(t *testing.T) {
 	logger.AssertEventNotLogged(t, "waffle.action.started.received")
 	logger.AssertEventNotLogged(t, "waffle.concurrency.acquire_success.received")
 }
+
+func TestEngine_WithHierarchy(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithHierarchy("."))
+
+	counter := atomic.Int32{}
+	action := func(_ context.Context, _ any) error {
+		counter.Add(1)
+		return nil
+	}
+
+	require.NoError(t, engine.On("order.created.eu").Do("region", action))
+	require.NoError(t, engine.On("order.created").Do("created", action))
+	require.NoError(t, engine.On("order").Do("order", action))
+	// Registered on two levels, should only be dispatched once
+	require.NoError(t, engine.On("order", "order.created").Do("audit", action))
+	require.NoError(t, engine.On("order.deleted").Do("deleted", action))
+
+	require.True(t, engine.Send(t.Context(), "order.created.eu", nil))
+
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, int32(4), counter.Load())
+
+	// Actions should be spawned from the most specific level up
+	spawned := make([]string, 0)
+	for _, log := range logger.GetLogs() {
+		if log.Event == "waffle.action.spawned" {
+			spawned = append(spawned, log.Metadata["actionKey"])
+			require.Equal(t, "order.created.eu", log.Metadata["eventKey"])
+		}
+	}
+	require.Equal(t, []string{"region", "created", "audit", "order"}, spawned)
+}
+
+func TestEngine_WithHierarchy_EmptyLevels(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithHierarchy("."))
+
+	action := func(_ context.Context, _ any) error {
+		return nil
+	}
+
+	require.NoError(t, engine.On("order").Do("order", action))
+	require.NoError(t, engine.On("order.").Do("trailing", action))
+	require.NoError(t, engine.On("").Do("root", action))
+	require.NoError(t, engine.On("order..created").Do("created", action))
+	require.NoError(t, engine.On(".order").Do("leading", action))
+
+	require.True(t, engine.Send(t.Context(), "order..created", nil))
+	require.True(t, engine.Send(t.Context(), ".order", nil))
+
+	time.Sleep(10 * time.Millisecond)
+
+	// Empty levels are not ancestors
+	spawned := make([]string, 0)
+	for _, log := range logger.GetLogs() {
+		if log.Event == "waffle.action.spawned" {
+			spawned = append(spawned, log.Metadata["actionKey"])
+		}
+	}
+	require.Equal(t, []string{"created", "order", "leading"}, spawned)
+}
+
+func TestEngine_WithHierarchy_EmptySeparator(t *testing.T) {
+	counter := atomic.Int32{}
+
+	engine := waffle.NewEngine(nil, waffle.WithHierarchy(""))
+
+	require.NoError(t, engine.On("order").Do("order", func(_ context.Context, _ any) error {
+		counter.Add(1)
+		return nil
+	}))
+
+	require.False(t, engine.Send(t.Context(), "order.created", nil))
+	require.True(t, engine.Send(t.Context(), "order", nil))
+
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, int32(1), counter.Load())
+}
+
+func TestEngine_WithoutHierarchy(t *testing.T) {
+	counter := atomic.Int32{}
+
+	engine := waffle.NewEngine(nil)
+
+	require.NoError(t, engine.On("order").Do("order", func(_ context.Context, _ any) error {
+		counter.Add(1)
+		return nil
+	}))
+
+	require.False(t, engine.Send(t.Context(), "order.created", nil))
+
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, int32(0), counter.Load())
+}
+
+func TestEngine_Timeout(t *testing.T) {
+	errs := make(chan error, 1)
+
+	engine := waffle.NewEngine(nil)
+
+	require.NoError(t, engine.
+		On("test").
+		Timeout(20*time.Millisecond).
+		Do("test", func(ctx context.Context, _ any) error {
+			select {
+			case <-time.After(time.Second):
+				errs <- nil
+			case <-ctx.Done():
+				errs <- ctx.Err()
+			}
+			return nil
+		}))
+
+	engine.Send(t.Context(), "test", nil)
+
+	select {
+	case err := <-errs:
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("action was not cancelled by the timeout")
+	}
+}
+
+func TestEngine_DefaultData(t *testing.T) {
+	type Request struct {
+		UserID string
+	}
+
+	var mu sync.Mutex
+	keys := make([]string, 0)
+	received := make(chan Request, 2)
+
+	engine := waffle.NewEngine(nil)
+
+	require.NoError(t, engine.
+		On("test").
+		DefaultData(func(_ context.Context) any {
+			return Request{UserID: "anonymous"}
+		}).
+		ConcurrencyGroup("user", 1, func(_ context.Context, data any) string {
+			key := data.(Request).UserID
+			mu.Lock()
+			keys = append(keys, key)
+			mu.Unlock()
+			return key
+		}).
+		Do("test", func(_ context.Context, data any) error {
+			received <- data.(Request)
+			return nil
+		}))
+
+	engine.Send(t.Context(), "test", nil)
+
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, Request{UserID: "anonymous"}, <-received)
+
+	// Non-nil data should be passed through untouched
+	engine.Send(t.Context(), "test", Request{UserID: "user1"})
+
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, Request{UserID: "user1"}, <-received)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Contains(t, keys, "anonymous")
+	require.Contains(t, keys, "user1")
+}
+
+func TestEngine_DefaultData_TypedNil(t *testing.T) {
+	type Request struct {
+		UserID string
+	}
+
+	received := make(chan *Request, 1)
+
+	engine := waffle.NewEngine(nil)
+
+	require.NoError(t, engine.
+		On("test").
+		DefaultData(func(_ context.Context) any {
+			return &Request{UserID: "anonymous"}
+		}).
+		ConcurrencyGroup("user", 1, func(_ context.Context, data any) string {
+			return data.(*Request).UserID
+		}).
+		Do("test", func(_ context.Context, data any) error {
+			received <- data.(*Request)
+			return nil
+		}))
+
+	engine.Send(t.Context(), "test", (*Request)(nil))
+
+	select {
+	case request := <-received:
+		require.Equal(t, "anonymous", request.UserID)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("action did not run")
+	}
+}
+
+func TestEngine_OperationLogging_Timestamps(t *testing.T) {
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := waffle.NewTestClock(start)
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithClock(clock))
+
+	require.NoError(t, engine.On("test").Do("test", func(_ context.Context, _ any) error {
+		// Simulate work taking 250ms
+		clock.Advance(250 * time.Millisecond)
+		return nil
+	}))
+
+	require.True(t, engine.Send(t.Context(), "test", nil))
+
+	time.Sleep(10 * time.Millisecond)
+
+	for _, log := range logger.GetLogs() {
+		if log.Event == "waffle.event.received" {
+			require.Equal(t, start, log.Timestamp)
+		}
+	}
+
+	logger.AssertEventLoggedAfter(t, "waffle.action.finished", start)
+	logger.AssertEventLoggedWithMetadata(t, "waffle.action.finished", map[string]string{
+		"actionKey":  "test",
+		"eventKey":   "test",
+		"durationMs": "250",
+	})
+}
+
+// eventLogger is an OperationLogger without timestamps.
+type eventLogger struct {
+	events chan string
+}
+
+func (l *eventLogger) LogOperation(_ context.Context, event string, _ map[string]string) {
+	l.events <- event
+}
+
+func TestEngine_OperationLogging_WithoutTimestamps(t *testing.T) {
+	logger := &eventLogger{events: make(chan string, 16)}
+	engine := waffle.NewEngine(logger)
+
+	require.NoError(t, engine.On("test").Do("test", func(context.Context, any) error { return nil }))
+	_, err := engine.SendSync(t.Context(), "test", nil)
+	require.NoError(t, err)
+
+	require.Equal(t, "waffle.event.received", <-logger.events)
+}
+
+func TestEngine_OperationLogging_ActionFinishedAndFailed(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	require.NoError(t, engine.On("ok").Do("ok", func(_ context.Context, _ any) error {
+		return nil
+	}))
+	require.NoError(t, engine.On("fail").Do("fail", func(_ context.Context, _ any) error {
+		return fmt.Errorf("boom")
+	}))
+
+	engine.Send(t.Context(), "ok", nil)
+	engine.Send(t.Context(), "ok", nil)
+	engine.Send(t.Context(), "fail", nil)
+
+	time.Sleep(10 * time.Millisecond)
+
+	logger.AssertEventLoggedTimes(t, "waffle.action.finished", 2)
+	logger.AssertEventLoggedTimes(t, "waffle.action.failed", 1)
+	logger.AssertEventLoggedWithMetadata(t, "waffle.action.failed", map[string]string{
+		"actionKey": "fail",
+		"eventKey":  "fail",
+		"error":     "boom",
+	})
+}
+
+func TestEngine_WithMaxDepth(t *testing.T) {
+	counter := atomic.Int32{}
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithMaxDepth(4))
+
+	// ping and pong trigger each other forever
+	require.NoError(t, engine.On("ping").Do("ping", func(ctx context.Context, _ any) error {
+		counter.Add(1)
+		engine.Send(ctx, "pong", nil)
+		return nil
+	}))
+	require.NoError(t, engine.On("pong").Do("pong", func(ctx context.Context, _ any) error {
+		counter.Add(1)
+		engine.Send(ctx, "ping", nil)
+		return nil
+	}))
+
+	require.True(t, engine.Send(t.Context(), "ping", nil))
+
+	time.Sleep(50 * time.Millisecond)
+
+	// Depths 0 through 3 run, the send at depth 4 is refused
+	require.Equal(t, int32(4), counter.Load())
+	logger.AssertEventLoggedTimes(t, "waffle.event.max_depth_exceeded", 1)
+	logger.AssertEventLoggedWithMetadata(t, "waffle.event.max_depth_exceeded", map[string]string{
+		"eventKey": "ping",
+		"depth":    "4",
+	})
+}
+
+func TestEngine_AddActionConfiguration(t *testing.T) {
+	counter := atomic.Int32{}
+
+	engine := waffle.NewEngine(nil)
+
+	require.NoError(t, engine.AddActionConfiguration(waffle.ActionConfiguration{
+		EventKeys:         []waffle.EventKey{"test"},
+		ConcurrencyGroups: waffle.NewConcurrencyGroups(),
+		ActionKey:         "test",
+		Action: func(_ context.Context, _ any) error {
+			counter.Add(1)
+			return nil
+		},
+	}))
+
+	require.True(t, engine.Send(t.Context(), "test", nil))
+
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, int32(1), counter.Load())
+}
+
+func TestEngine_AddActionConfiguration_Invalid(t *testing.T) {
+	valid := func() waffle.ActionConfiguration {
+		return waffle.ActionConfiguration{
+			EventKeys:         []waffle.EventKey{"test"},
+			ConcurrencyGroups: waffle.NewConcurrencyGroups(),
+			ActionKey:         "test",
+			Action: func(_ context.Context, _ any) error {
+				return nil
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		modify   func(*waffle.ActionConfiguration)
+		expected string
+	}{
+		{
+			name:     "missing action key",
+			modify:   func(c *waffle.ActionConfiguration) { c.ActionKey = "" },
+			expected: "AddActionConfiguration: actionKey must be provided",
+		},
+		{
+			name:     "missing event keys",
+			modify:   func(c *waffle.ActionConfiguration) { c.EventKeys = nil },
+			expected: "AddActionConfiguration: eventKeys must be provided",
+		},
+		{
+			name:     "missing action",
+			modify:   func(c *waffle.ActionConfiguration) { c.Action = nil },
+			expected: "AddActionConfiguration: action must be provided",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := waffle.NewEngine(nil)
+
+			configuration := valid()
+			tt.modify(&configuration)
+
+			err := engine.AddActionConfiguration(configuration)
+
+			var builderErr *waffle.ErrBuilderBadParams
+			require.ErrorAs(t, err, &builderErr)
+			require.Contains(t, err.Error(), tt.expected)
+
+			// Nothing should be registered
+			require.False(t, engine.Send(t.Context(), "test", nil))
+		})
+	}
+}
+
+func TestEngine_AddActionConfiguration_NilConcurrencyGroups(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	ran := make(chan struct{})
+	err := engine.AddActionConfiguration(waffle.ActionConfiguration{
+		EventKeys: []waffle.EventKey{"test"},
+		ActionKey: "test",
+		Action: func(_ context.Context, _ any) error {
+			close(ran)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+
+	require.True(t, engine.Send(t.Context(), "test", nil))
+
+	select {
+	case <-ran:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("action did not run")
+	}
+}
+
+func TestEngine_IsRunning(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	done := make(chan struct{})
+	require.NoError(t, engine.
+		On("test").
+		ConcurrencyGroup("user", 1, func(_ context.Context, data any) string {
+			return data.(string)
+		}).
+		Do("test", func(_ context.Context, _ any) error {
+			<-done
+			return nil
+		}))
+
+	require.False(t, engine.IsRunning("test", "user1"))
+
+	engine.Send(t.Context(), "test", "user1")
+
+	require.True(t, engine.IsRunning("test", "user1"))
+	require.True(t, engine.IsRunning("test", ""))
+	require.False(t, engine.IsRunning("test", "user2"))
+	require.False(t, engine.IsRunning("other", "user1"))
+
+	close(done)
+
+	require.Eventually(t, func() bool {
+		return !engine.IsRunning("test", "user1")
+	}, time.Second, time.Millisecond)
+	require.False(t, engine.IsRunning("test", ""))
+}
+
+func TestEngine_QuietConcurrencyLogs(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	action := func(_ context.Context, _ any) error {
+		return nil
+	}
+
+	require.NoError(t, engine.On("quiet").Concurrency(1).QuietConcurrencyLogs().Do("quiet", action))
+	require.NoError(t, engine.On("loud").Concurrency(1).Do("loud", action))
+
+	engine.Send(t.Context(), "quiet", nil)
+
+	time.Sleep(10 * time.Millisecond)
+	logger.AssertEventLogged(t, "waffle.action.spawned")
+	logger.AssertEventLogged(t, "waffle.action.started")
+	logger.AssertEventLogged(t, "waffle.action.finished")
+	logger.AssertEventNotLogged(t, "waffle.concurrency.acquire_success")
+	logger.AssertEventNotLogged(t, "waffle.concurrency.released")
+
+	engine.Send(t.Context(), "loud", nil)
+
+	time.Sleep(10 * time.Millisecond)
+	logger.AssertEventLoggedWithMetadata(t, "waffle.concurrency.acquire_success", map[string]string{
+		"actionKey": "loud",
+	})
+	logger.AssertEventLoggedTimes(t, "waffle.concurrency.acquire_success", 1)
+}
+
+func TestEngine_ConcurrencyGroupE(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	ran := make(chan string, 2)
+	keyFunc := func(_ context.Context, data any) (string, error) {
+		user, ok := data.(string)
+		if !ok {
+			return "", errors.New("data is not a user")
+		}
+		return user, nil
+	}
+
+	err := engine.On("event").ConcurrencyGroupE("user", 1, keyFunc).Do("action", func(_ context.Context, data any) error {
+		ran <- data.(string)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.True(t, engine.Send(t.Context(), "event", 42))
+
+	time.Sleep(10 * time.Millisecond)
+	require.Empty(t, ran)
+	logger.AssertEventLoggedWithMetadata(t, "waffle.concurrency.keyfunc_error", map[string]string{
+		"actionKey": "action",
+		"error":     "data is not a user",
+	})
+	logger.AssertEventNotLogged(t, "waffle.action.started")
+
+	// The engine keeps serving events whose key can be computed
+	require.True(t, engine.Send(t.Context(), "event", "alice"))
+
+	select {
+	case user := <-ran:
+		require.Equal(t, "alice", user)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("action was not run")
+	}
+}
+
+func TestEngine_ConcurrencyGroupByData(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	err := engine.On("event").ConcurrencyGroupByData("user", 1).Do("action", func(context.Context, any) error {
+		return nil
+	})
+	require.NoError(t, err)
+
+	_, err = engine.SendSync(t.Context(), "event", "alice")
+	require.NoError(t, err)
+
+	// Data that isn't a string can't be a key
+	results, err := engine.SendSync(t.Context(), "event", 42)
+	require.ErrorIs(t, err, waffle.ErrDropped)
+	require.Len(t, results, 1)
+	logger.AssertEventLoggedWithMetadata(t, "waffle.concurrency.keyfunc_error", map[string]string{
+		"actionKey": "action",
+		"error":     waffle.ErrKeyNotString.Error(),
+	})
+
+	// The data is the key, each user has its own slot
+	groups := engine.Actions()["action"].ConcurrencyGroups
+	acquired, release1 := groups.TryAcquire(t.Context(), "alice")
+	require.True(t, acquired)
+	acquired, _ = groups.TryAcquire(t.Context(), "alice")
+	require.False(t, acquired)
+	acquired, release2 := groups.TryAcquire(t.Context(), "bob")
+	require.True(t, acquired)
+	release1()
+	release2()
+
+	err = engine.On("event").ConcurrencyGroupByData("user", 0).Do("invalid", func(context.Context, any) error { return nil })
+	require.ErrorContains(t, err, "ConcurrencyGroupByData: limit must be greater than 0")
+}
+
+func TestEngine_ConcurrencyGroupWithEvent(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	started := make(chan waffle.EventKey, 3)
+	block := make(chan struct{})
+	defer close(block)
+
+	keys := make(chan string, 3)
+	keyFunc := func(_ context.Context, eventKey waffle.EventKey, data any) string {
+		key := string(eventKey) + ":" + data.(string)
+		keys <- key
+		return key
+	}
+
+	err := engine.On("order.created", "order.updated").
+		ConcurrencyGroupWithEvent("order", 1, keyFunc).
+		Do("sync", func(_ context.Context, _ any) error {
+			started <- ""
+			<-block
+			return nil
+		})
+	require.NoError(t, err)
+
+	// The same order under two events gets distinct keys
+	require.True(t, engine.Send(t.Context(), "order.created", "order-1"))
+	require.True(t, engine.Send(t.Context(), "order.updated", "order-1"))
+	require.Equal(t, "order.created:order-1", <-keys)
+	require.Equal(t, "order.updated:order-1", <-keys)
+
+	for range 2 {
+		select {
+		case <-started:
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("action was not run")
+		}
+	}
+
+	// The same order under the same event shares the key
+	require.True(t, engine.Send(t.Context(), "order.created", "order-1"))
+	require.Equal(t, "order.created:order-1", <-keys)
+	logger.AssertEventLoggedWithMetadata(t, "waffle.concurrency.acquire_failed", map[string]string{
+		"actionKey": "sync",
+	})
+}
+
+func TestEngine_SendBatch(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	received := make(chan any, 4)
+	require.NoError(t, engine.On("order.created").Do("store", func(_ context.Context, data any) error {
+		received <- data
+		return nil
+	}))
+
+	sent := engine.SendBatch(t.Context(), []waffle.Event{
+		{Key: "order.created", Data: "order-1"},
+		{Key: "unknown", Data: "order-2"},
+		{Key: "order.created", Data: "order-3", Options: []waffle.SendOption{waffle.WithDedupKey("order-3")}},
+		{Key: "order.created", Data: "order-3", Options: []waffle.SendOption{waffle.WithDedupKey("order-3")}},
+	})
+	require.Equal(t, []bool{true, false, true, false}, sent)
+
+	require.NoError(t, engine.Wait(t.Context()))
+	close(received)
+
+	results := make([]any, 0, 2)
+	for data := range received {
+		results = append(results, data)
+	}
+	require.ElementsMatch(t, []any{"order-1", "order-3"}, results)
+}
+
+func TestEngine_SendMany(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	received := make(chan string, 4)
+	action := func(name string) waffle.Action {
+		return func(_ context.Context, data any) error {
+			received <- name + ":" + data.(string)
+			return nil
+		}
+	}
+
+	require.NoError(t, engine.On("a").Do("first", action("first")))
+	require.NoError(t, engine.On("b").Do("second", action("second")))
+	require.NoError(t, engine.On("c", "b").Do("third", action("third")))
+
+	triggered := engine.SendMany(t.Context(), "payload", "a", "b", "c", "unknown")
+	require.Equal(t, 4, triggered)
+
+	require.NoError(t, engine.Wait(t.Context()))
+	close(received)
+
+	results := make([]string, 0, 4)
+	for result := range received {
+		results = append(results, result)
+	}
+	require.ElementsMatch(t, []string{"first:payload", "second:payload", "third:payload", "third:payload"}, results)
+
+	// All dispatches share a single correlation id
+	ids := make(map[string]struct{})
+	for _, log := range logger.GetLogs() {
+		ids[log.Metadata["correlationId"]] = struct{}{}
+	}
+	require.Len(t, ids, 1)
+}
+
+func TestEngine_OnDropped(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	done := make(chan struct{})
+	require.NoError(t, engine.
+		On("test").
+		Concurrency(1).
+		Do("test", func(_ context.Context, _ any) error {
+			<-done
+			return nil
+		}))
+	defer close(done)
+
+	fallbacks := make([]any, 0)
+	engine.OnDropped("test", func(_ context.Context, data any) error {
+		fallbacks = append(fallbacks, data)
+		return nil
+	})
+	engine.OnDropped("unregistered", func(_ context.Context, data any) error {
+		fallbacks = append(fallbacks, data)
+		return nil
+	})
+
+	// The first send takes the only slot, the overflow goes to the fallback
+	require.True(t, engine.Send(t.Context(), "test", "first"))
+	require.Empty(t, fallbacks)
+
+	require.True(t, engine.Send(t.Context(), "test", "overflow"))
+	require.Equal(t, []any{"overflow"}, fallbacks)
+
+	// Events without actions never reach the fallback
+	require.False(t, engine.Send(t.Context(), "unregistered", "nothing"))
+	require.Equal(t, []any{"overflow"}, fallbacks)
+
+	logger.AssertEventLoggedTimes(t, "waffle.event.fallback", 1)
+}
+
+func TestEngine_OnDroppedWhileSending(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	done := make(chan struct{})
+	require.NoError(t, engine.On("test").Concurrency(1).Do("test", func(context.Context, any) error {
+		<-done
+		return nil
+	}))
+	defer close(done)
+	require.True(t, engine.Send(t.Context(), "test", nil))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			engine.Send(t.Context(), "test", nil)
+		}
+	}()
+
+	for i := range 20 {
+		engine.OnDropped(waffle.EventKey(fmt.Sprintf("other-%d", i)), func(context.Context, any) error { return nil })
+		engine.OnDropped("test", func(context.Context, any) error { return nil })
+	}
+	wg.Wait()
+}
+
+func TestEngine_Stats(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	block := make(chan struct{})
+	require.NoError(t, engine.On("ok").Do("ok", func(_ context.Context, _ any) error {
+		return nil
+	}))
+	require.NoError(t, engine.On("fail").Do("fail", func(_ context.Context, _ any) error {
+		return errors.New("failed")
+	}))
+	require.NoError(t, engine.On("panic").Do("panic", func(_ context.Context, _ any) error {
+		panic("boom")
+	}))
+	require.NoError(t, engine.On("limited").Concurrency(1).Do("limited", func(_ context.Context, _ any) error {
+		<-block
+		return nil
+	}))
+
+	require.Equal(t, waffle.EngineStats{
+		Actions:     map[waffle.ActionKey]waffle.ActionStats{},
+		DropReasons: map[string]int{},
+	}, engine.Stats())
+
+	require.True(t, engine.Send(t.Context(), "ok", nil))
+	require.True(t, engine.Send(t.Context(), "fail", nil))
+	require.True(t, engine.Send(t.Context(), "panic", nil))
+	require.True(t, engine.Send(t.Context(), "limited", nil))
+	require.True(t, engine.Send(t.Context(), "limited", nil))
+	require.False(t, engine.Send(t.Context(), "unknown", nil))
+
+	time.Sleep(10 * time.Millisecond)
+
+	require.Equal(t, waffle.EngineStats{
+		Sends:      6,
+		Dispatched: 4,
+		Dropped:    1,
+		Failed:     1,
+		Panicked:   1,
+		Processed:  3,
+		Running:    1,
+		Actions: map[waffle.ActionKey]waffle.ActionStats{
+			"limited": {Running: 1},
+		},
+		DropReasons: map[string]int{
+			waffle.DropReasonConcurrencyLimit: 1,
+			waffle.DropReasonNoHandler:        1,
+		},
+	}, engine.Stats())
+
+	close(block)
+	require.NoError(t, engine.Wait(t.Context()))
+
+	stats := engine.Stats()
+	require.Equal(t, uint64(4), stats.Processed)
+	require.Zero(t, stats.Running)
+	require.Empty(t, stats.Actions)
+	logger.AssertEventLoggedWithMetadata(t, "waffle.action.panicked", map[string]string{
+		"actionKey": "panic",
+		"panic":     "boom",
+	})
+}
+
+func TestEngine_WithPanicHandler(t *testing.T) {
+	type reported struct {
+		actionKey waffle.ActionKey
+		recovered any
+		stack     string
+	}
+	panics := make(chan reported, 1)
+	engine := waffle.NewEngine(nil, waffle.WithPanicHandler(func(_ context.Context, _ waffle.EventKey, actionKey waffle.ActionKey, recovered any, stack []byte) {
+		panics <- reported{actionKey: actionKey, recovered: recovered, stack: string(stack)}
+	}))
+
+	var calls atomic.Int32
+	ran := make(chan struct{}, 1)
+	err := engine.On("event").Concurrency(1).Do("action", func(_ context.Context, _ any) error {
+		if calls.Add(1) == 1 {
+			panic("boom")
+		}
+		ran <- struct{}{}
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.True(t, engine.Send(t.Context(), "event", nil))
+	select {
+	case r := <-panics:
+		require.Equal(t, waffle.ActionKey("action"), r.actionKey)
+		require.Equal(t, "boom", r.recovered)
+		require.Contains(t, r.stack, "TestEngine_WithPanicHandler")
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("panic was not reported")
+	}
+
+	// The panicking action released its concurrency slot
+	require.NoError(t, engine.Wait(t.Context()))
+	require.True(t, engine.Send(t.Context(), "event", nil))
+	select {
+	case <-ran:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("action was not run")
+	}
+}
+
+func TestEngine_ConcurrencyWithQueue(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	block := make(chan struct{})
+	var ran atomic.Int32
+	err := engine.On("event").ConcurrencyWithQueue(1, 2).Do("action", func(_ context.Context, _ any) error {
+		ran.Add(1)
+		<-block
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.True(t, engine.Send(t.Context(), "event", nil))
+
+	// The second and third sends wait for the running action to release its slot
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			engine.Send(t.Context(), "event", nil)
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// The fourth send finds the queue full and is dropped without waiting
+	done := make(chan struct{})
+	go func() {
+		engine.Send(t.Context(), "event", nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("send waited on a full queue")
+	}
+	logger.AssertEventLoggedTimes(t, "waffle.concurrency.acquire_failed", 1)
+
+	close(block)
+	wg.Wait()
+
+	require.Eventually(t, func() bool {
+		return ran.Load() == 3
+	}, time.Second, time.Millisecond)
+	require.Equal(t, uint64(1), engine.Stats().Dropped)
+}
+
+func TestEngine_SendCancelable(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	err := engine.On("event").Do("action", func(ctx context.Context, _ any) error {
+		close(started)
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return nil
+	})
+	require.NoError(t, err)
+
+	cancel, sent := engine.SendCancelable(t.Context(), "event", nil)
+	require.True(t, sent)
+
+	<-started
+	cancel()
+
+	select {
+	case err := <-cancelled:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("action did not observe the cancellation")
+	}
+
+	cancel, sent = engine.SendCancelable(t.Context(), "unknown", nil)
+	require.False(t, sent)
+	cancel()
+}
+
+func TestEngine_Close(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	block := make(chan struct{})
+	var closed atomic.Int32
+	err := engine.On("event").
+		OnClose(func(_ context.Context) error {
+			closed.Add(1)
+			return nil
+		}).
+		Do("action", func(_ context.Context, _ any) error {
+			<-block
+			return nil
+		})
+	require.NoError(t, err)
+
+	teardownErr := errors.New("teardown failed")
+	err = engine.On("other").
+		OnClose(func(_ context.Context) error {
+			return teardownErr
+		}).
+		Do("other", func(_ context.Context, _ any) error {
+			return nil
+		})
+	require.NoError(t, err)
+
+	require.True(t, engine.Send(t.Context(), "event", nil))
+
+	// The action is still running, so the teardowns don't run yet
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, engine.Close(ctx), context.DeadlineExceeded)
+	require.Equal(t, int32(0), closed.Load())
+
+	close(block)
+	require.ErrorIs(t, engine.Close(t.Context()), teardownErr)
+	require.Equal(t, int32(1), closed.Load())
+
+	require.NoError(t, engine.Close(t.Context()))
+	require.Equal(t, int32(1), closed.Load())
+}
+
+func TestEngine_Shutdown(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	block := make(chan struct{})
+	var finished atomic.Bool
+	err := engine.On("event").Do("action", func(_ context.Context, _ any) error {
+		<-block
+		finished.Store(true)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.True(t, engine.Send(t.Context(), "event", nil))
+
+	// Shutdown waits for the in-flight action
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, engine.Shutdown(ctx), context.DeadlineExceeded)
+
+	// New events are rejected while shutting down
+	require.False(t, engine.Send(t.Context(), "event", nil))
+	_, err = engine.SendSync(t.Context(), "event", nil)
+	require.ErrorIs(t, err, waffle.ErrShutdown)
+	logger.AssertEventLoggedWithMetadata(t, "waffle.event.rejected", map[string]string{
+		"eventKey": "event",
+	})
+	require.Equal(t, 2, engine.DropReasons()[waffle.DropReasonShutdown])
+
+	close(block)
+	require.NoError(t, engine.Shutdown(t.Context()))
+	require.True(t, finished.Load())
+	require.Equal(t, uint64(1), engine.Stats().Dispatched)
+}
+
+func TestEngine_WithHeartbeat(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	clock := waffle.NewTestClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	engine := waffle.NewEngine(logger, waffle.WithClock(clock), waffle.WithHeartbeat(time.Second))
+
+	block := make(chan struct{})
+	started := make(chan struct{})
+	err := engine.On("event").Do("action", func(_ context.Context, _ any) error {
+		close(started)
+		<-block
+		return nil
+	})
+	require.NoError(t, err)
+
+	// The heartbeat starts on the first send
+	clock.Advance(time.Second)
+	logger.AssertEventNotLogged(t, "waffle.engine.heartbeat")
+
+	require.True(t, engine.Send(t.Context(), "event", nil))
+	<-started
+
+	clock.Advance(time.Second)
+	logger.AssertEventLoggedWithMetadata(t, "waffle.engine.heartbeat", map[string]string{
+		"inFlight":   "1",
+		"dispatched": "1",
+	})
+
+	close(block)
+	require.NoError(t, engine.Close(t.Context()))
+
+	clock.Advance(time.Second)
+	logger.AssertEventLoggedTimes(t, "waffle.engine.heartbeat", 1)
+	require.Equal(t, 0, clock.PendingTimers())
+}
+
+func TestMockEngine(t *testing.T) {
+	// signup stands for consumer code depending on a Dispatcher
+	signup := func(ctx context.Context, dispatcher waffle.Dispatcher, user string) {
+		dispatcher.Send(ctx, "user.created", user)
+		dispatcher.SendMany(ctx, user, "email.welcome", "crm.sync")
+	}
+
+	mock := waffle.NewMockEngine()
+	signup(t.Context(), mock, "alice")
+
+	mock.AssertSent(t, "user.created", "alice")
+	mock.AssertSent(t, "email.welcome", "alice")
+	mock.AssertNotSent(t, "user.deleted")
+	require.Equal(t, []waffle.SentEvent{
+		{EventKey: "user.created", Data: "alice"},
+		{EventKey: "email.welcome", Data: "alice"},
+		{EventKey: "crm.sync", Data: "alice"},
+	}, mock.Sent())
+
+	mock.Clear()
+	require.Empty(t, mock.Sent())
+}
+
+func TestEngine_KeyCapReached(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	block := make(chan struct{})
+	policy := waffle.NewConcurrencyGroups()
+	policy.AddLimit("user", waffle.NewConcurrencyLimit(1, func(_ context.Context, data any) string {
+		return data.(string)
+	}, waffle.WithMaxKeys(1)))
+
+	err := engine.On("event").ApplyPolicy(policy).Do("action", func(_ context.Context, _ any) error {
+		<-block
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.True(t, engine.Send(t.Context(), "event", "alice"))
+	require.True(t, engine.Send(t.Context(), "event", "bob"))
+
+	logger.AssertEventLoggedWithMetadata(t, "waffle.concurrency.key_cap_reached", map[string]string{
+		"actionKey": "action",
+		"eventKey":  "event",
+	})
+	require.Equal(t, uint64(1), engine.Stats().Dropped)
+
+	close(block)
+}
+
+func TestEngine_SendPriority(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	block := make(chan struct{})
+	ran := make(chan any, 2)
+	err := engine.On("event").Concurrency(1).Do("action", func(_ context.Context, data any) error {
+		ran <- data
+		if data == "regular" {
+			<-block
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	defer close(block)
+
+	require.True(t, engine.Send(t.Context(), "event", "regular"))
+	require.Equal(t, "regular", <-ran)
+
+	// The slot is taken, so a regular send is dropped while a priority send still runs
+	require.True(t, engine.Send(t.Context(), "event", "dropped"))
+	require.True(t, engine.SendPriority(t.Context(), "event", "priority"))
+
+	select {
+	case data := <-ran:
+		require.Equal(t, "priority", data)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("priority send did not run")
+	}
+
+	logger.AssertEventLoggedWithMetadata(t, "waffle.action.priority_bypass", map[string]string{
+		"actionKey": "action",
+		"eventKey":  "event",
+	})
+	logger.AssertEventLoggedTimes(t, "waffle.concurrency.acquire_failed", 1)
+}
+
+func TestEngine_DropReasons(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithMaxDepth(1))
+
+	block := make(chan struct{})
+	defer close(block)
+
+	require.NoError(t, engine.On("limited").Concurrency(1).Do("limited", func(_ context.Context, _ any) error {
+		<-block
+		return nil
+	}))
+	require.NoError(t, engine.On("keyed").ConcurrencyGroupE("user", 1, func(_ context.Context, _ any) (string, error) {
+		return "", errors.New("no user")
+	}).Do("keyed", func(_ context.Context, _ any) error {
+		return nil
+	}))
+	require.NoError(t, engine.On("nested").Do("nested", func(_ context.Context, _ any) error {
+		return nil
+	}))
+	require.NoError(t, engine.On("outer").Do("outer", func(ctx context.Context, _ any) error {
+		engine.Send(ctx, "nested", nil)
+		return nil
+	}))
+
+	require.Empty(t, engine.DropReasons())
+
+	engine.Send(t.Context(), "unknown", nil)
+	engine.Send(t.Context(), "unknown", nil)
+	engine.Send(t.Context(), "limited", nil)
+	engine.Send(t.Context(), "limited", nil)
+	engine.Send(t.Context(), "keyed", nil)
+	engine.Send(t.Context(), "outer", nil)
+
+	require.Eventually(t, func() bool {
+		return engine.DropReasons()[waffle.DropReasonMaxDepth] == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, map[string]int{
+		waffle.DropReasonNoHandler:        2,
+		waffle.DropReasonConcurrencyLimit: 1,
+		waffle.DropReasonKeyError:         1,
+		waffle.DropReasonMaxDepth:         1,
+	}, engine.DropReasons())
+	require.Equal(t, uint64(3), engine.Stats().Dropped)
+}
+
+func TestEngine_Mount(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+	billing := waffle.NewEngine(nil)
+
+	received := make(chan string, 2)
+	require.NoError(t, billing.On("invoice.created").Do("invoice", func(_ context.Context, data any) error {
+		received <- "billing:" + data.(string)
+		return nil
+	}))
+	require.NoError(t, engine.On("billing.refund").Do("refund", func(_ context.Context, data any) error {
+		received <- "local:" + data.(string)
+		return nil
+	}))
+
+	engine.Mount("billing.", billing)
+
+	require.True(t, engine.Send(t.Context(), "billing.invoice.created", "inv-1"))
+	require.Equal(t, "billing:inv-1", <-received)
+	logger.AssertEventLoggedWithMetadata(t, "waffle.event.routed", map[string]string{
+		"eventKey": "billing.invoice.created",
+		"prefix":   "billing.",
+	})
+
+	// Events the sub engine doesn't handle fall back to the local actions
+	require.True(t, engine.Send(t.Context(), "billing.refund", "ref-1"))
+	require.Equal(t, "local:ref-1", <-received)
+
+	engine.Mount("billing.", nil)
+	require.False(t, engine.Send(t.Context(), "billing.invoice.created", "inv-2"))
+}
+
+func TestEngine_MountWhileSending(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+	require.NoError(t, engine.On("billing.tick").Do("count", func(context.Context, any) error { return nil }))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			engine.Send(t.Context(), "billing.tick", nil)
+		}
+	}()
+
+	for i := range 20 {
+		engine.Mount(fmt.Sprintf("prefix-%d.", i), waffle.NewEngine(nil))
+		engine.Mount("billing.", waffle.NewEngine(nil))
+	}
+	wg.Wait()
+	require.NoError(t, engine.Wait(t.Context()))
+}
+
+func TestEngine_WaitIdle(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	block := make(chan struct{})
+	require.NoError(t, engine.On("sleeps").Do("sleeps", func(_ context.Context, _ any) error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}))
+	require.NoError(t, engine.On("blocks").Do("blocks", func(_ context.Context, _ any) error {
+		<-block
+		return nil
+	}))
+	defer close(block)
+
+	require.True(t, engine.Send(t.Context(), "sleeps", nil))
+	require.True(t, engine.Send(t.Context(), "blocks", nil))
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+	defer cancel()
+	require.NoError(t, engine.WaitIdle(ctx, "sleeps"))
+	require.False(t, engine.IsRunning("sleeps", ""))
+
+	ctx, cancel = context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, engine.WaitIdle(ctx, "blocks"), context.DeadlineExceeded)
+
+	// An action that never ran is idle
+	require.NoError(t, engine.WaitIdle(t.Context(), "unknown"))
+}
+
+func TestEngine_OnError(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	type reported struct {
+		eventKey  waffle.EventKey
+		actionKey waffle.ActionKey
+		data      any
+		err       error
+	}
+	errs := make(chan reported, 2)
+	engine.OnError(func(_ context.Context, eventKey waffle.EventKey, actionKey waffle.ActionKey, data any, err error) {
+		errs <- reported{eventKey: eventKey, actionKey: actionKey, data: data, err: err}
+	})
+
+	chargeErr := errors.New("card declined")
+	require.NoError(t, engine.On("order").Do("charge", func(_ context.Context, _ any) error {
+		return chargeErr
+	}))
+	require.NoError(t, engine.On("order").Do("ship", func(_ context.Context, _ any) error {
+		return nil
+	}))
+	require.NoError(t, engine.On("audit").Do("audit", func(_ context.Context, _ any) error {
+		panic("boom")
+	}))
+
+	require.True(t, engine.Send(t.Context(), "order", "order-1"))
+	select {
+	case r := <-errs:
+		require.Equal(t, reported{eventKey: "order", actionKey: "charge", data: "order-1", err: chargeErr}, r)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("error was not reported")
+	}
+
+	require.True(t, engine.Send(t.Context(), "audit", nil))
+	select {
+	case r := <-errs:
+		require.Equal(t, waffle.ActionKey("audit"), r.actionKey)
+		require.EqualError(t, r.err, "action panicked: boom")
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("panic was not reported")
+	}
+
+	require.NoError(t, engine.Wait(t.Context()))
+	require.Empty(t, errs)
+}
+
+func TestEngine_OnErrorWhileRunning(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+	require.NoError(t, engine.On("fail").Do("fail", func(context.Context, any) error {
+		return errors.New("failed")
+	}))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			engine.Send(t.Context(), "fail", nil)
+		}
+	}()
+
+	var reported atomic.Int64
+	for range 20 {
+		engine.OnError(func(context.Context, waffle.EventKey, waffle.ActionKey, any, error) {
+			reported.Add(1)
+		})
+	}
+	wg.Wait()
+	require.NoError(t, engine.Wait(t.Context()))
+
+	// Once set, the handler receives every error
+	reported.Store(0)
+	require.True(t, engine.Send(t.Context(), "fail", nil))
+	require.NoError(t, engine.Wait(t.Context()))
+	require.Equal(t, int64(1), reported.Load())
+}
+
+func TestEngine_Wait(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	var finished atomic.Int32
+	require.NoError(t, engine.On("order").Do("ship", func(ctx context.Context, _ any) error {
+		time.Sleep(10 * time.Millisecond)
+		engine.Send(ctx, "shipped", nil)
+		finished.Add(1)
+		return nil
+	}))
+	require.NoError(t, engine.On("shipped").Do("notify", func(_ context.Context, _ any) error {
+		time.Sleep(10 * time.Millisecond)
+		finished.Add(1)
+		return nil
+	}))
+
+	// Nothing in flight
+	require.NoError(t, engine.Wait(t.Context()))
+
+	require.True(t, engine.Send(t.Context(), "order", nil))
+	require.True(t, engine.Send(t.Context(), "order", nil))
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+	defer cancel()
+	require.NoError(t, engine.Wait(ctx))
+	require.Equal(t, int32(4), finished.Load())
+
+	block := make(chan struct{})
+	defer close(block)
+	require.NoError(t, engine.On("stuck").Do("stuck", func(_ context.Context, _ any) error {
+		<-block
+		return nil
+	}))
+	require.True(t, engine.Send(t.Context(), "stuck", nil))
+
+	ctx, cancel = context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, engine.Wait(ctx), context.DeadlineExceeded)
+}
+
+func TestEngine_Inline(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	var ran atomic.Bool
+	err := engine.On("event").Concurrency(1).Inline().Do("action", func(_ context.Context, _ any) error {
+		ran.Store(true)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.True(t, engine.Send(t.Context(), "event", nil))
+
+	// The action finished and released its slot before Send returned
+	require.True(t, ran.Load())
+	require.False(t, engine.IsRunning("action", ""))
+	require.True(t, engine.Send(t.Context(), "event", nil))
+	require.Equal(t, uint64(0), engine.Stats().Dropped)
+}
+
+func BenchmarkEngine_Send(b *testing.B) {
+	benchmarkSend(b, func(builder *waffle.ActionBuilder) *waffle.ActionBuilder {
+		return builder
+	})
+}
+
+func BenchmarkEngine_Send_Inline(b *testing.B) {
+	benchmarkSend(b, func(builder *waffle.ActionBuilder) *waffle.ActionBuilder {
+		return builder.Inline()
+	})
+}
+
+func benchmarkSend(b *testing.B, configure func(*waffle.ActionBuilder) *waffle.ActionBuilder) {
+	engine := waffle.NewEngine(nil)
+
+	var wg sync.WaitGroup
+	err := configure(engine.On("event")).Do("action", func(_ context.Context, _ any) error {
+		wg.Done()
+		return nil
+	})
+	require.NoError(b, err)
+
+	for b.Loop() {
+		wg.Add(1)
+		engine.Send(context.Background(), "event", nil)
+	}
+	wg.Wait()
+}
+
+func TestEngine_UseRouter(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	received := make(chan waffle.EventKey, 1)
+	require.NoError(t, engine.On("tenant1.x").Do("action", func(_ context.Context, _ any) error {
+		received <- "tenant1.x"
+		return nil
+	}))
+
+	engine.UseRouter(func(_ context.Context, eventKey waffle.EventKey, _ any) waffle.EventKey {
+		if eventKey == "legacy" {
+			return "x"
+		}
+		return eventKey
+	})
+	// Routers are chained, this one receives the key rewritten by the first one
+	engine.UseRouter(func(_ context.Context, eventKey waffle.EventKey, data any) waffle.EventKey {
+		return waffle.EventKey(data.(string)) + "." + eventKey
+	})
+
+	require.True(t, engine.Send(t.Context(), "x", "tenant1"))
+	require.Equal(t, waffle.EventKey("tenant1.x"), <-received)
+	require.True(t, engine.Send(t.Context(), "legacy", "tenant1"))
+	require.Equal(t, waffle.EventKey("tenant1.x"), <-received)
+
+	require.False(t, engine.Send(t.Context(), "x", "tenant2"))
+}
+
+func TestEngine_UseRouterWhileSending(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+	require.NoError(t, engine.On("tick").Do("count", func(context.Context, any) error { return nil }))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			engine.Send(t.Context(), "tick", nil)
+		}
+	}()
+
+	for range 20 {
+		engine.UseRouter(func(_ context.Context, eventKey waffle.EventKey, _ any) waffle.EventKey {
+			return eventKey
+		})
+	}
+	wg.Wait()
+	require.NoError(t, engine.Wait(t.Context()))
+}
+
+func TestEngine_WithFairShares(t *testing.T) {
+	engine := waffle.NewEngine(nil, waffle.WithFairShares(map[waffle.EventKey]int{
+		"noisy": 1,
+		"quiet": 3,
+	}))
+
+	global := waffle.NewConcurrencyLimitWithQueue(1, 100, nil)
+	groups := waffle.NewConcurrencyGroups()
+	groups.AddLimit("", global)
+
+	started := make(chan string, 50)
+	step := make(chan struct{})
+	err := engine.AddActionConfiguration(waffle.ActionConfiguration{
+		EventKeys:         []waffle.EventKey{"noisy", "quiet"},
+		ActionKey:         "work",
+		ConcurrencyGroups: groups,
+		Action: func(_ context.Context, data any) error {
+			started <- data.(string)
+			<-step
+			return nil
+		},
+	})
+	require.NoError(t, err)
+
+	// Saturate the global limit with both events
+	require.True(t, engine.Send(t.Context(), "noisy", "noisy"))
+	<-started
+	for range 20 {
+		go engine.Send(t.Context(), "noisy", "noisy")
+		go engine.Send(t.Context(), "quiet", "quiet")
+	}
+	require.Eventually(t, func() bool {
+		return global.Waiting() == 40
+	}, time.Second, time.Millisecond)
+
+	// Freed slots go to the events in proportion to their weights
+	counts := make(map[string]int)
+	for range 16 {
+		step <- struct{}{}
+		counts[<-started]++
+	}
+	close(step)
+
+	require.InDelta(t, 12, counts["quiet"], 1)
+	require.InDelta(t, 4, counts["noisy"], 1)
+}
+
+func TestEngine_WithSerialSpawn(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithSerialSpawn())
+
+	expected := make([]string, 0)
+	for i := range 10 {
+		actionKey := waffle.ActionKey(fmt.Sprintf("action-%d", i))
+		expected = append(expected, string(actionKey))
+		require.NoError(t, engine.On("event").Concurrency(1).Do(actionKey, func(_ context.Context, _ any) error {
+			return nil
+		}))
+	}
+
+	require.True(t, engine.Send(t.Context(), "event", nil))
+
+	acquired := make([]string, 0)
+	started := make([]string, 0)
+	for _, log := range logger.GetLogs() {
+		switch log.Event {
+		case "waffle.concurrency.acquire_success":
+			acquired = append(acquired, log.Metadata["actionKey"])
+		case "waffle.action.started":
+			started = append(started, log.Metadata["actionKey"])
+		}
+	}
+
+	require.Equal(t, expected, acquired)
+	require.Equal(t, expected, started)
+}
+
+func TestEngine_DeadlineFromData(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	type job struct {
+		processBefore time.Time
+	}
+
+	deadlines := make(chan time.Time, 2)
+	err := engine.On("job").
+		DeadlineFromData(func(_ context.Context, data any) (time.Time, bool) {
+			return data.(job).processBefore, true
+		}).
+		Do("process", func(ctx context.Context, _ any) error {
+			deadline, _ := ctx.Deadline()
+			deadlines <- deadline
+			return nil
+		})
+	require.NoError(t, err)
+
+	// A job whose deadline passed is dropped
+	require.True(t, engine.Send(t.Context(), "job", job{processBefore: time.Now().Add(-time.Minute)}))
+	logger.AssertEventLoggedWithMetadata(t, "waffle.action.deadline_passed", map[string]string{
+		"actionKey": "process",
+		"eventKey":  "job",
+	})
+	logger.AssertEventNotLogged(t, "waffle.action.started")
+	require.Equal(t, 1, engine.DropReasons()[waffle.DropReasonDeadlinePassed])
+
+	// A job whose deadline is ahead runs with it
+	processBefore := time.Now().Add(time.Minute)
+	require.True(t, engine.Send(t.Context(), "job", job{processBefore: processBefore}))
+
+	select {
+	case deadline := <-deadlines:
+		require.True(t, deadline.Equal(processBefore))
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("action did not run")
+	}
+	require.Empty(t, deadlines)
+}
+
+func TestEngine_Off(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	ran := make(chan string, 4)
+	err := engine.On("user.created", "user.updated").Do("index", func(_ context.Context, data any) error {
+		ran <- data.(string)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.True(t, engine.Off("user.created", "index"))
+	require.False(t, engine.Off("user.created", "index"))
+
+	// The action is still triggered by its other event
+	require.False(t, engine.Send(t.Context(), "user.created", "created"))
+	require.True(t, engine.Send(t.Context(), "user.updated", "updated"))
+	require.NoError(t, engine.Wait(t.Context()))
+	require.Equal(t, "updated", <-ran)
+	require.Empty(t, ran)
+}
+
+func TestEngine_RemoveAction(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	ran := make(chan waffle.ActionKey, 4)
+	for _, actionKey := range []waffle.ActionKey{"index", "notify"} {
+		err := engine.On("user.created", "user.updated").Do(actionKey, func(context.Context, any) error {
+			ran <- actionKey
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	require.True(t, engine.RemoveAction("index"))
+	require.False(t, engine.RemoveAction("index"))
+
+	require.True(t, engine.Send(t.Context(), "user.created", "created"))
+	require.NoError(t, engine.Wait(t.Context()))
+	require.Equal(t, waffle.ActionKey("notify"), <-ran)
+	require.Empty(t, ran)
+
+	// The key can be registered again
+	require.NoError(t, engine.On("user.deleted").Do("index", func(context.Context, any) error { return nil }))
+}
+
+func TestEngine_RegisterWhileSending(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	var ran atomic.Int64
+	action := func(context.Context, any) error {
+		ran.Add(1)
+		return nil
+	}
+	require.NoError(t, engine.On("tick").Do("count", action))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			engine.Send(t.Context(), "tick", nil)
+		}
+	}()
+
+	for i := range 20 {
+		actionKey := waffle.ActionKey(fmt.Sprintf("count-%d", i))
+		require.NoError(t, engine.On("tick").Do(actionKey, action))
+		if i%2 == 0 {
+			require.True(t, engine.RemoveAction(actionKey))
+		}
+	}
+	wg.Wait()
+	require.NoError(t, engine.Wait(t.Context()))
+
+	// Once registration returns, every sent event triggers the new actions
+	ran.Store(0)
+	require.True(t, engine.Send(t.Context(), "tick", nil))
+	require.NoError(t, engine.Wait(t.Context()))
+	require.Equal(t, int64(11), ran.Load())
+}
+
+func TestEngine_When(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	type order struct {
+		total   int
+		country string
+	}
+
+	ran := make(chan order, 4)
+	err := engine.On("order.created").
+		When(func(_ context.Context, data any) bool { return data.(order).total >= 100 }).
+		When(func(_ context.Context, data any) bool { return data.(order).country == "NL" }).
+		Do("review", func(_ context.Context, data any) error {
+			ran <- data.(order)
+			return nil
+		})
+	require.NoError(t, err)
+
+	fallback := make(chan struct{}, 1)
+	engine.OnDropped("order.created", func(context.Context, any) error {
+		fallback <- struct{}{}
+		return nil
+	})
+
+	require.True(t, engine.Send(t.Context(), "order.created", order{total: 50, country: "NL"}))
+	require.True(t, engine.Send(t.Context(), "order.created", order{total: 150, country: "DE"}))
+	require.True(t, engine.Send(t.Context(), "order.created", order{total: 150, country: "NL"}))
+	require.NoError(t, engine.Wait(t.Context()))
+
+	require.Equal(t, order{total: 150, country: "NL"}, <-ran)
+	require.Empty(t, ran)
+	require.Empty(t, fallback)
+	logger.AssertEventLoggedTimes(t, "waffle.action.skipped", 2)
+
+	stats := engine.Stats()
+	require.Equal(t, uint64(2), stats.Skipped)
+	require.Equal(t, uint64(1), stats.Dispatched)
+	require.Zero(t, stats.Dropped)
+
+	// Skipped actions succeed for SendSync and SendAwait
+	results, err := engine.SendSync(t.Context(), "order.created", order{total: 10, country: "NL"})
+	require.NoError(t, err)
+	require.Equal(t, []waffle.ActionResult{{ActionKey: "review"}}, results)
+
+	results, err = engine.SendAwait(t.Context(), "order.created", order{total: 10, country: "NL"}).Wait(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, []waffle.ActionResult{{ActionKey: "review"}}, results)
+}
+
+func TestEngine_Map(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	type user struct {
+		ID   string
+		Name string
+	}
+
+	errs := make(chan error, 1)
+	failedData := make(chan any, 1)
+	engine.OnError(func(_ context.Context, _ waffle.EventKey, _ waffle.ActionKey, data any, err error) {
+		failedData <- data
+		errs <- err
+	})
+
+	ran := make(chan user, 1)
+	err := engine.On("user.created").
+		Map(func(_ context.Context, data any) (any, error) {
+			var u user
+			err := json.Unmarshal(data.([]byte), &u)
+			return u, err
+		}).
+		Map(func(_ context.Context, data any) (any, error) {
+			u := data.(user)
+			u.Name = strings.ToUpper(u.Name)
+			return u, nil
+		}).
+		Do("welcome", func(_ context.Context, data any) error {
+			ran <- data.(user)
+			return nil
+		})
+	require.NoError(t, err)
+
+	require.True(t, engine.Send(t.Context(), "user.created", []byte(`{"ID":"1","Name":"ada"}`)))
+	require.Equal(t, user{ID: "1", Name: "ADA"}, <-ran)
+
+	require.True(t, engine.Send(t.Context(), "user.created", []byte(`not json`)))
+	err = <-errs
+	require.ErrorIs(t, err, waffle.ErrMapFailed)
+	var syntaxErr *json.SyntaxError
+	require.ErrorAs(t, err, &syntaxErr)
+
+	// The error handler receives the data as sent
+	require.Equal(t, []byte(`not json`), <-failedData)
+
+	require.NoError(t, engine.Wait(t.Context()))
+	require.Empty(t, ran)
+	logger.AssertEventLoggedTimes(t, "waffle.action.map_failed", 1)
+	require.Equal(t, uint64(1), engine.Stats().Failed)
+}
+
+func TestEngine_Triggers(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+	noop := func(_ context.Context, _ any) error { return nil }
+
+	require.NoError(t, engine.On("order.created", "order.paid").Do("notify", noop))
+	require.NoError(t, engine.On("order.created").Do("audit", noop))
+	require.NoError(t, engine.On("order.*").Do("metrics", noop))
+
+	triggers := engine.Triggers()
+	require.Equal(t, map[waffle.EventKey][]waffle.ActionKey{
+		"order.created": {"notify", "audit"},
+		"order.paid":    {"notify"},
+		"order.*":       {"metrics"},
+	}, triggers)
+
+	// The copy doesn't change the routing
+	triggers["order.created"][0] = "other"
+	delete(triggers, "order.paid")
+	require.Equal(t, []waffle.ActionKey{"notify", "audit"}, engine.Triggers()["order.created"])
+	require.Contains(t, engine.Triggers(), waffle.EventKey("order.paid"))
+}
+
+func TestEngine_Actions(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+	noop := func(_ context.Context, _ any) error { return nil }
+
+	require.NoError(t, engine.On("order.created", "order.paid").Label("team", "payments").Do("notify", noop))
+	require.NoError(t, engine.On("order.created").Inline().Do("audit", noop))
+
+	actions := engine.Actions()
+	require.Len(t, actions, 2)
+	require.Equal(t, []waffle.EventKey{"order.created", "order.paid"}, actions["notify"].EventKeys)
+	require.Equal(t, map[string]string{"team": "payments"}, actions["notify"].Labels)
+	require.True(t, actions["audit"].Inline)
+
+	// The copies don't change the actions
+	actions["notify"].EventKeys[0] = "other"
+	actions["notify"].Labels["team"] = "growth"
+	require.Equal(t, []waffle.EventKey{"order.created", "order.paid"}, engine.Actions()["notify"].EventKeys)
+	require.Equal(t, []waffle.ActionKey{"notify"}, engine.ActionsWithLabel("team", "payments"))
+}
+
+func TestEngine_Detached(t *testing.T) {
+	type requestKey struct{}
+
+	engine := waffle.NewEngine(nil)
+
+	step := make(chan struct{})
+	errs := make(chan error, 2)
+	values := make(chan any, 2)
+	action := func(ctx context.Context, _ any) error {
+		<-step
+		errs <- ctx.Err()
+		values <- ctx.Value(requestKey{})
+		return nil
+	}
+	require.NoError(t, engine.On("event").Detached().Do("detached", action))
+	require.NoError(t, engine.On("event").Do("attached", action))
+
+	ctx, cancel := context.WithCancel(context.WithValue(t.Context(), requestKey{}, "req-1"))
+	require.True(t, engine.Send(ctx, "event", nil))
+	cancel()
+	close(step)
+
+	// Only the attached action sees the cancellation, both keep the values
+	require.ElementsMatch(t, []error{nil, context.Canceled}, []error{<-errs, <-errs})
+	require.Equal(t, "req-1", <-values)
+	require.Equal(t, "req-1", <-values)
+}
+
+func TestEngine_WithFairShares_FIFO(t *testing.T) {
+	engine := waffle.NewEngine(nil, waffle.WithFairShares(map[waffle.EventKey]int{
+		"noisy": 1,
+		"quiet": 3,
+	}))
+
+	global := waffle.NewConcurrencyLimitWithQueue(1, 100, nil, waffle.WithFIFO())
+	groups := waffle.NewConcurrencyGroups()
+	groups.AddLimit("", global)
+
+	started := make(chan string, 10)
+	step := make(chan struct{})
+	err := engine.AddActionConfiguration(waffle.ActionConfiguration{
+		EventKeys:         []waffle.EventKey{"noisy", "quiet"},
+		ActionKey:         "work",
+		ConcurrencyGroups: groups,
+		Action: func(_ context.Context, data any) error {
+			started <- data.(string)
+			<-step
+			return nil
+		},
+	})
+	require.NoError(t, err)
+
+	require.True(t, engine.Send(t.Context(), "noisy", "first"))
+	<-started
+
+	order := []string{"noisy", "noisy", "quiet", "quiet"}
+	for i, eventKey := range order {
+		go engine.Send(t.Context(), waffle.EventKey(eventKey), eventKey)
+		require.Eventually(t, func() bool {
+			return global.Waiting() == uint(i+1)
+		}, time.Second, time.Millisecond)
+	}
+
+	// Freed slots go to the waiters in arrival order despite the weights
+	for _, eventKey := range order {
+		step <- struct{}{}
+		require.Equal(t, eventKey, <-started)
+	}
+	close(step)
+}
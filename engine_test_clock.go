@@ -0,0 +1,94 @@
+package waffle
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// TestClock is a manually advanced Clock for tests
+type TestClock struct {
+	now    time.Time
+	timers []*testTimer
+	mu     sync.Mutex
+}
+
+// testTimer is a call scheduled on a TestClock
+type testTimer struct {
+	clock *TestClock
+	at    time.Time
+	f     func()
+}
+
+// NewTestClock creates a new test clock starting at the given time
+func NewTestClock(start time.Time) *TestClock {
+	return &TestClock{
+		now: start,
+	}
+}
+
+// Now implements the Clock interface
+func (c *TestClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc implements the Clock interface
+func (c *TestClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	timer := &testTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+// Advance moves the clock forward, running the due timers in order of their due time.
+// Unlike the real clock, timers run synchronously on the goroutine calling Advance
+func (c *TestClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		sort.SliceStable(c.timers, func(i, j int) bool {
+			return c.timers[i].at.Before(c.timers[j].at)
+		})
+		if len(c.timers) == 0 || c.timers[0].at.After(target) {
+			c.now = target
+			c.mu.Unlock()
+			return
+		}
+
+		timer := c.timers[0]
+		c.timers = c.timers[1:]
+		c.now = timer.at
+		c.mu.Unlock()
+
+		// Run outside the lock, the call may schedule more timers
+		timer.f()
+	}
+}
+
+// PendingTimers returns the number of scheduled timers that haven't run yet
+func (c *TestClock) PendingTimers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// Stop implements the Timer interface
+func (t *testTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
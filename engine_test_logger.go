@@ -4,18 +4,22 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // OperationLog represents a single logged operation
 type OperationLog struct {
-	Event    string
-	Metadata map[string]string
+	Event     string
+	Metadata  map[string]string
+	Timestamp time.Time
 }
 
 // TestOperationLogger captures logged operations for testing
 type TestOperationLogger struct {
 	logs []OperationLog
+	mu   sync.Mutex
 }
 
 // NewTestOperationLogger creates a new test operation logger
@@ -25,18 +29,27 @@ func NewTestOperationLogger() *TestOperationLogger {
 	}
 }
 
-// LogOperation implements the OperationLogger interface
+// LogOperation implements the OperationLogger interface, timestamping the operation with
+// the system clock
 func (l *TestOperationLogger) LogOperation(ctx context.Context, event string, metadata map[string]string) {
+	l.LogOperationAt(ctx, time.Now(), event, metadata)
+}
+
+// LogOperationAt implements the TimestampedOperationLogger interface
+func (l *TestOperationLogger) LogOperationAt(ctx context.Context, timestamp time.Time, event string, metadata map[string]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	l.logs = append(l.logs, OperationLog{
-		Event:    event,
-		Metadata: metadata,
+		Event:     event,
+		Metadata:  metadata,
+		Timestamp: timestamp,
 	})
 }
 
 // AssertEventLogged asserts that a specific event was logged
 func (l *TestOperationLogger) AssertEventLogged(t *testing.T, event string) {
 	t.Helper()
-	for _, log := range l.logs {
+	for _, log := range l.GetLogs() {
 		if log.Event == event {
 			return
 		}
@@ -47,7 +60,7 @@ func (l *TestOperationLogger) AssertEventLogged(t *testing.T, event string) {
 // AssertEventLoggedWithMetadata asserts that a specific event was logged with specific metadata
 func (l *TestOperationLogger) AssertEventLoggedWithMetadata(t *testing.T, event string, expectedMetadata map[string]string) {
 	t.Helper()
-	for _, log := range l.logs {
+	for _, log := range l.GetLogs() {
 		if log.Event == event {
 			for key, expectedValue := range expectedMetadata {
 				actualValue, exists := log.Metadata[key]
@@ -69,7 +82,7 @@ func (l *TestOperationLogger) AssertEventLoggedWithMetadata(t *testing.T, event
 // AssertEventNotLogged asserts that a specific event was NOT logged
 func (l *TestOperationLogger) AssertEventNotLogged(t *testing.T, event string) {
 	t.Helper()
-	for _, log := range l.logs {
+	for _, log := range l.GetLogs() {
 		if log.Event == event {
 			t.Errorf("Expected event '%s' to NOT be logged, but it was found in logs", event)
 			return
@@ -81,7 +94,7 @@ func (l *TestOperationLogger) AssertEventNotLogged(t *testing.T, event string) {
 func (l *TestOperationLogger) AssertEventLoggedTimes(t *testing.T, event string, expectedCount int) {
 	t.Helper()
 	count := 0
-	for _, log := range l.logs {
+	for _, log := range l.GetLogs() {
 		if log.Event == event {
 			count++
 		}
@@ -91,28 +104,47 @@ func (l *TestOperationLogger) AssertEventLoggedTimes(t *testing.T, event string,
 	}
 }
 
+// AssertEventLoggedAfter asserts that a specific event was logged with a timestamp after the given time
+func (l *TestOperationLogger) AssertEventLoggedAfter(t *testing.T, event string, after time.Time) {
+	t.Helper()
+	for _, log := range l.GetLogs() {
+		if log.Event == event && log.Timestamp.After(after) {
+			return
+		}
+	}
+	t.Errorf("Expected event '%s' to be logged after %v, but it wasn't. Logged events: %v", event, after, l.getEventNames())
+}
+
 // AssertNoEventsLogged asserts that no events were logged
 func (l *TestOperationLogger) AssertNoEventsLogged(t *testing.T) {
 	t.Helper()
-	if len(l.logs) > 0 {
-		t.Errorf("Expected no events to be logged, but %d events were logged: %v", len(l.logs), l.getEventNames())
+	logs := l.GetLogs()
+	if len(logs) > 0 {
+		t.Errorf("Expected no events to be logged, but %d events were logged: %v", len(logs), l.getEventNames())
 	}
 }
 
 // Clear clears all logged events
 func (l *TestOperationLogger) Clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	l.logs = make([]OperationLog, 0)
 }
 
-// GetLogs returns all logged operations
+// GetLogs returns a copy of all logged operations
 func (l *TestOperationLogger) GetLogs() []OperationLog {
-	return l.logs
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	logs := make([]OperationLog, len(l.logs))
+	copy(logs, l.logs)
+	return logs
 }
 
 // getEventNames returns a slice of all logged event names for error messages
 func (l *TestOperationLogger) getEventNames() []string {
-	events := make([]string, len(l.logs))
-	for i, log := range l.logs {
+	logs := l.GetLogs()
+	events := make([]string, len(logs))
+	for i, log := range logs {
 		events[i] = log.Event
 	}
 	return events
@@ -120,13 +152,14 @@ func (l *TestOperationLogger) getEventNames() []string {
 
 // String returns a string representation of all logged events
 func (l *TestOperationLogger) String() string {
-	if len(l.logs) == 0 {
+	logs := l.GetLogs()
+	if len(logs) == 0 {
 		return "No events logged"
 	}
 
 	var sb strings.Builder
 	sb.WriteString("Logged events:\n")
-	for _, log := range l.logs {
+	for _, log := range logs {
 		sb.WriteString(fmt.Sprintf("  - %s: %v\n", log.Event, log.Metadata))
 	}
 	return sb.String()
@@ -0,0 +1,92 @@
+package waffle
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// SentEvent represents a single event sent to a MockEngine
+type SentEvent struct {
+	EventKey EventKey
+	Data     any
+}
+
+// MockEngine is a Dispatcher recording the sent events without running any action,
+// for testing code that sends events
+type MockEngine struct {
+	sent []SentEvent
+	mu   sync.Mutex
+}
+
+var _ Dispatcher = (*MockEngine)(nil)
+
+// NewMockEngine creates a new mock engine
+func NewMockEngine() *MockEngine {
+	return &MockEngine{
+		sent: make([]SentEvent, 0),
+	}
+}
+
+// Send implements the Dispatcher interface, recording the event and reporting it as sent.
+// The options are ignored
+func (m *MockEngine) Send(_ context.Context, eventKey EventKey, data any, _ ...SendOption) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, SentEvent{EventKey: eventKey, Data: data})
+	return true
+}
+
+// SendMany implements the Dispatcher interface, recording each event and reporting one
+// action triggered per event
+func (m *MockEngine) SendMany(ctx context.Context, data any, eventKeys ...EventKey) int {
+	for _, eventKey := range eventKeys {
+		m.Send(ctx, eventKey, data)
+	}
+	return len(eventKeys)
+}
+
+// SendSync implements the Dispatcher interface, recording the event without results
+func (m *MockEngine) SendSync(ctx context.Context, eventKey EventKey, data any) ([]ActionResult, error) {
+	m.Send(ctx, eventKey, data)
+	return nil, nil
+}
+
+// Sent returns a copy of the sent events, in the order they were sent
+func (m *MockEngine) Sent() []SentEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sent := make([]SentEvent, len(m.sent))
+	copy(sent, m.sent)
+	return sent
+}
+
+// AssertSent asserts that the event was sent with the data
+func (m *MockEngine) AssertSent(t *testing.T, eventKey EventKey, data any) {
+	t.Helper()
+	for _, event := range m.Sent() {
+		if event.EventKey == eventKey && reflect.DeepEqual(event.Data, data) {
+			return
+		}
+	}
+	t.Errorf("Expected event '%s' to be sent with data %v, but it wasn't. Sent events: %v", eventKey, data, m.Sent())
+}
+
+// AssertNotSent asserts that the event was NOT sent
+func (m *MockEngine) AssertNotSent(t *testing.T, eventKey EventKey) {
+	t.Helper()
+	for _, event := range m.Sent() {
+		if event.EventKey == eventKey {
+			t.Errorf("Expected event '%s' to NOT be sent, but it was", eventKey)
+			return
+		}
+	}
+}
+
+// Clear clears all the sent events
+func (m *MockEngine) Clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = make([]SentEvent, 0)
+}
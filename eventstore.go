@@ -0,0 +1,167 @@
+package waffle
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// EventStore persists sent events until their actions are done, so that the events of a
+// crashed process can be dispatched again with Engine.RecoverPending, making dispatch
+// at-least-once. Serializing the data is up to the store.
+type EventStore interface {
+	// Append stores an event before it is dispatched, returning its id
+	Append(ctx context.Context, eventKey EventKey, data any) (string, error)
+	// Complete removes an event once its actions are done
+	Complete(ctx context.Context, id string) error
+	// Pending returns the stored events that weren't completed, in the order they were appended
+	Pending(ctx context.Context) ([]StoredEvent, error)
+}
+
+// StoredEvent is an event kept by an EventStore.
+type StoredEvent struct {
+	ID       string
+	EventKey EventKey
+	Data     any
+}
+
+// storedDispatchKey is the context key holding the stored event of a dispatch.
+type storedDispatchKey struct{}
+
+// storedDispatch counts the actions of a stored event that aren't done yet.
+type storedDispatch struct {
+	id        string
+	remaining atomic.Int64
+}
+
+// RecoverPending dispatches again the events left pending in the event store, e.g. by
+// a process that crashed before their actions were done. It returns how many events
+// were dispatched. The events keep their id in the store and aren't routed again.
+func (e *Engine) RecoverPending(ctx context.Context) (int, error) {
+	if e.eventStore == nil {
+		return 0, nil
+	}
+
+	pending, err := e.eventStore.Pending(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, event := range pending {
+		e.send(ctx, event.EventKey, event.Data, sendOptions{storedID: event.ID})
+	}
+
+	return len(pending), nil
+}
+
+// storeEvent appends the event to the event store, unless it is recovered from it,
+// returning a context tracking the stored event. An event that failed to be stored is
+// still dispatched.
+func (e *Engine) storeEvent(ctx context.Context, eventKey EventKey, data any, opts sendOptions) context.Context {
+	if e.eventStore == nil {
+		return ctx
+	}
+
+	id := opts.storedID
+	if id == "" {
+		var err error
+		id, err = e.eventStore.Append(ctx, eventKey, data)
+		if err != nil {
+			// Log event store failed
+			e.logOperation(ctx, "waffle.event.store_failed", map[string]string{
+				"eventKey": string(eventKey),
+				"error":    err.Error(),
+			})
+
+			// Don't let the dispatch settle the stored event of an outer dispatch
+			return context.WithValue(ctx, storedDispatchKey{}, (*storedDispatch)(nil))
+		}
+	}
+
+	return context.WithValue(ctx, storedDispatchKey{}, &storedDispatch{id: id})
+}
+
+// beginStored sets how many actions the stored event of the dispatch waits for,
+// completing it right away when there are none.
+func (e *Engine) beginStored(ctx context.Context, actions int) {
+	dispatch, _ := ctx.Value(storedDispatchKey{}).(*storedDispatch)
+	if dispatch == nil {
+		return
+	}
+
+	dispatch.remaining.Store(int64(actions) + 1)
+	e.settleStored(ctx)
+}
+
+// settleStored marks an action of the stored event of the dispatch as done, completing
+// the event in the store once all its actions are done.
+func (e *Engine) settleStored(ctx context.Context) {
+	dispatch, _ := ctx.Value(storedDispatchKey{}).(*storedDispatch)
+	if dispatch == nil || dispatch.remaining.Add(-1) != 0 {
+		return
+	}
+
+	if err := e.eventStore.Complete(ctx, dispatch.id); err != nil {
+		// Log event completion failed
+		e.logOperation(ctx, "waffle.event.complete_failed", map[string]string{
+			"id":    dispatch.id,
+			"error": err.Error(),
+		})
+	}
+}
+
+// MemoryEventStore is an EventStore keeping the events in memory, as a reference
+// implementation and for tests. It doesn't survive the process.
+type MemoryEventStore struct {
+	events []StoredEvent
+	nextID int
+	mu     sync.Mutex
+}
+
+var _ EventStore = (*MemoryEventStore)(nil)
+
+// NewMemoryEventStore creates a new in-memory event store.
+func NewMemoryEventStore() *MemoryEventStore {
+	return &MemoryEventStore{
+		events: make([]StoredEvent, 0),
+	}
+}
+
+// Append implements the EventStore interface.
+func (s *MemoryEventStore) Append(_ context.Context, eventKey EventKey, data any) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	id := strconv.Itoa(s.nextID)
+	s.events = append(s.events, StoredEvent{ID: id, EventKey: eventKey, Data: data})
+
+	return id, nil
+}
+
+// Complete implements the EventStore interface.
+func (s *MemoryEventStore) Complete(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, event := range s.events {
+		if event.ID == id {
+			s.events = append(s.events[:i], s.events[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// Pending implements the EventStore interface.
+func (s *MemoryEventStore) Pending(_ context.Context) ([]StoredEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := make([]StoredEvent, len(s.events))
+	copy(pending, s.events)
+
+	return pending, nil
+}
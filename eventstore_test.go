@@ -0,0 +1,84 @@
+package waffle_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_WithEventStore(t *testing.T) {
+	store := waffle.NewMemoryEventStore()
+	engine := waffle.NewEngine(waffle.NewTestOperationLogger(), waffle.WithEventStore(store))
+
+	done := make(chan struct{})
+	err := engine.On("order.created").Do("ship", func(_ context.Context, _ any) error {
+		close(done)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.True(t, engine.Send(t.Context(), "order.created", "order-1"))
+	<-done
+
+	// The event is completed once its action finished
+	require.Eventually(t, func() bool {
+		pending, err := store.Pending(t.Context())
+		require.NoError(t, err)
+		return len(pending) == 0
+	}, time.Second, time.Millisecond)
+
+	// Events without actions are completed right away
+	require.False(t, engine.Send(t.Context(), "order.unknown", "order-2"))
+	pending, err := store.Pending(t.Context())
+	require.NoError(t, err)
+	require.Empty(t, pending)
+}
+
+func TestEngine_RecoverPending(t *testing.T) {
+	store := waffle.NewMemoryEventStore()
+
+	// The first engine stops before its action finishes
+	crashed := waffle.NewEngine(waffle.NewTestOperationLogger(), waffle.WithEventStore(store))
+	block := make(chan struct{})
+	defer close(block)
+	err := crashed.On("order.created").Do("ship", func(_ context.Context, _ any) error {
+		<-block
+		return nil
+	})
+	require.NoError(t, err)
+	require.True(t, crashed.Send(t.Context(), "order.created", "order-1"))
+
+	pending, err := store.Pending(t.Context())
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	require.Equal(t, waffle.EventKey("order.created"), pending[0].EventKey)
+
+	// A new engine sharing the store dispatches the event again
+	recovered := waffle.NewEngine(waffle.NewTestOperationLogger(), waffle.WithEventStore(store))
+	shipped := make(chan any, 1)
+	err = recovered.On("order.created").Do("ship", func(_ context.Context, data any) error {
+		shipped <- data
+		return nil
+	})
+	require.NoError(t, err)
+
+	count, err := recovered.RecoverPending(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	select {
+	case data := <-shipped:
+		require.Equal(t, "order-1", data)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("event was not recovered")
+	}
+
+	require.Eventually(t, func() bool {
+		pending, err := store.Pending(t.Context())
+		require.NoError(t, err)
+		return len(pending) == 0
+	}, time.Second, time.Millisecond)
+}
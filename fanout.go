@@ -0,0 +1,148 @@
+package waffle
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// ErrFanOutStopped is the result of the actions of a FanOutStopOnError event that didn't
+// run because an action before them failed.
+var ErrFanOutStopped = errors.New("fan-out stopped")
+
+// FanOutMode decides how the actions of an event are run when it triggers several.
+type FanOutMode int
+
+const (
+	// FanOutParallel spawns all the actions at once, the default
+	FanOutParallel FanOutMode = iota
+	// FanOutSequential runs the actions one after the other, in the order they were
+	// registered, each starting once the previous one is done, retries included
+	FanOutSequential
+	// FanOutStopOnError runs the actions like FanOutSequential, leaving out the actions
+	// after the first one failing or dropped, with ErrFanOutStopped
+	FanOutStopOnError
+)
+
+// fanOutKey is the context key holding the sequential fan-out of a dispatch.
+type fanOutKey struct{}
+
+// fanOut spawns the actions of a sequential dispatch one at a time, as each one settles.
+type fanOut struct {
+	actionKeys  []ActionKey
+	data        any
+	eventKey    EventKey
+	opts        sendOptions
+	stopOnError bool
+	// next is the index of the action to spawn once the current one settles
+	next int
+	// ran is set once an action settled without being dropped, for the fallback
+	ran bool
+	mu  sync.Mutex
+}
+
+// FanOut sets how the actions of the event are run when it triggers several of them.
+// Each action still fails, retries and reports its result on its own, whatever the mode.
+// Events sent with SendSync always run their actions sequentially.
+func (e *Engine) FanOut(eventKey EventKey, mode FanOutMode) {
+	e.registryMu.Lock()
+	defer e.registryMu.Unlock()
+
+	if e.fanOuts == nil {
+		e.fanOuts = make(map[EventKey]FanOutMode)
+	}
+	e.fanOuts[eventKey] = mode
+}
+
+// fanOutMode returns how the actions of the event are run.
+func (e *Engine) fanOutMode(eventKey EventKey) FanOutMode {
+	e.registryMu.RLock()
+	defer e.registryMu.RUnlock()
+
+	return e.fanOuts[eventKey]
+}
+
+// withFanOut returns a context carrying the sequential fan-out of the dispatch, hiding
+// the fan-out of an outer dispatch so that events sent by actions don't advance it.
+func withFanOut(ctx context.Context, chain *fanOut) context.Context {
+	if chain == nil && ctx.Value(fanOutKey{}) == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, fanOutKey{}, chain)
+}
+
+// spawnSequential spawns the first action of a sequential dispatch, the others follow
+// as the actions before them settle.
+func (e *Engine) spawnSequential(ctx context.Context, actionKeys []ActionKey, data any, eventKey EventKey, mode FanOutMode, opts sendOptions) {
+	chain := &fanOut{
+		actionKeys:  actionKeys,
+		data:        data,
+		eventKey:    eventKey,
+		opts:        opts,
+		stopOnError: mode == FanOutStopOnError,
+		next:        1,
+	}
+
+	e.spawnAction(withFanOut(ctx, chain), actionKeys[0], data, eventKey, 0, opts)
+}
+
+// advanceFanOut spawns the next action of the sequential dispatch the settled action
+// belongs to, if any. Once the last action settled, it runs the fallback of the event
+// when they were all dropped.
+func (e *Engine) advanceFanOut(ctx context.Context, result ActionResult) {
+	chain, _ := ctx.Value(fanOutKey{}).(*fanOut)
+	if chain == nil {
+		return
+	}
+
+	chain.mu.Lock()
+	if chain.next > len(chain.actionKeys) {
+		chain.mu.Unlock()
+		return
+	}
+	if !errors.Is(result.Err, ErrDropped) {
+		chain.ran = true
+	}
+
+	stopped := chain.actionKeys[min(chain.next, len(chain.actionKeys)):]
+	if chain.stopOnError && result.Err != nil && len(stopped) > 0 {
+		chain.next = len(chain.actionKeys) + 1
+		chain.mu.Unlock()
+		e.stopFanOut(ctx, chain, result.ActionKey, stopped)
+		return
+	}
+
+	if chain.next == len(chain.actionKeys) {
+		chain.next++
+		ran := chain.ran
+		chain.mu.Unlock()
+		if !ran {
+			e.runFallback(ctx, chain.eventKey, chain.data)
+		}
+		return
+	}
+
+	actionKey := chain.actionKeys[chain.next]
+	chain.next++
+	chain.mu.Unlock()
+
+	e.spawnAction(ctx, actionKey, chain.data, chain.eventKey, 0, chain.opts)
+}
+
+// stopFanOut settles the actions left out of a sequential dispatch after the failure of
+// one of its actions.
+func (e *Engine) stopFanOut(ctx context.Context, chain *fanOut, failed ActionKey, stopped []ActionKey) {
+	// Log fan-out stopped
+	e.logOperation(ctx, "waffle.event.fan_out_stopped", map[string]string{
+		"eventKey":  string(chain.eventKey),
+		"actionKey": string(failed),
+		"stopped":   strconv.Itoa(len(stopped)),
+	})
+	e.drop(DropReasonFanOutStopped, len(stopped))
+
+	for _, actionKey := range stopped {
+		e.settleDispatch(ctx, ActionResult{ActionKey: actionKey, Err: ErrFanOutStopped})
+	}
+}
@@ -0,0 +1,116 @@
+package waffle_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_FanOut(t *testing.T) {
+	errCharge := errors.New("card declined")
+
+	tests := []struct {
+		name    string
+		mode    waffle.FanOutMode
+		ran     []waffle.ActionKey
+		results []waffle.ActionResult
+	}{
+		{
+			name: "sequential",
+			mode: waffle.FanOutSequential,
+			ran:  []waffle.ActionKey{"reserve", "charge", "ship"},
+			results: []waffle.ActionResult{
+				{ActionKey: "reserve"},
+				{ActionKey: "charge", Err: errCharge},
+				{ActionKey: "ship"},
+			},
+		},
+		{
+			name: "stop on error",
+			mode: waffle.FanOutStopOnError,
+			ran:  []waffle.ActionKey{"reserve", "charge"},
+			results: []waffle.ActionResult{
+				{ActionKey: "reserve"},
+				{ActionKey: "charge", Err: errCharge},
+				{ActionKey: "ship", Err: waffle.ErrFanOutStopped},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := waffle.NewEngine(nil)
+			engine.FanOut("order.placed", tt.mode)
+
+			var mu sync.Mutex
+			running := 0
+			ran := make([]waffle.ActionKey, 0)
+			for _, actionKey := range []waffle.ActionKey{"reserve", "charge", "ship"} {
+				err := engine.On("order.placed").Do(actionKey, func(context.Context, any) error {
+					mu.Lock()
+					running++
+					overlapping := running > 1
+					ran = append(ran, actionKey)
+					mu.Unlock()
+
+					time.Sleep(5 * time.Millisecond)
+
+					mu.Lock()
+					running--
+					mu.Unlock()
+
+					if overlapping {
+						return errors.New("actions overlapped")
+					}
+					if actionKey == "charge" {
+						return errCharge
+					}
+					return nil
+				})
+				require.NoError(t, err)
+			}
+
+			results, err := engine.SendAwait(t.Context(), "order.placed", nil).Wait(t.Context())
+			require.ErrorIs(t, err, errCharge)
+			require.NoError(t, engine.Wait(t.Context()))
+
+			// Durations vary, only compare the keys and errors
+			for i := range results {
+				results[i].Duration = 0
+			}
+			require.Equal(t, tt.results, results)
+
+			mu.Lock()
+			defer mu.Unlock()
+			require.Equal(t, tt.ran, ran)
+		})
+	}
+}
+
+func TestEngine_FanOut_Fallback(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+	engine.FanOut("job", waffle.FanOutSequential)
+
+	for _, actionKey := range []waffle.ActionKey{"first", "second"} {
+		err := engine.On("job").
+			DeadlineFromData(func(context.Context, any) (time.Time, bool) { return time.Now().Add(-time.Minute), true }).
+			Do(actionKey, func(context.Context, any) error { return nil })
+		require.NoError(t, err)
+	}
+
+	fallback := make(chan any, 1)
+	engine.OnDropped("job", func(_ context.Context, data any) error {
+		fallback <- data
+		return nil
+	})
+
+	// The fallback runs once every action of the sequence was dropped
+	require.True(t, engine.Send(t.Context(), "job", "data"))
+	require.Equal(t, "data", <-fallback)
+	require.Equal(t, 2, engine.DropReasons()[waffle.DropReasonDeadlinePassed])
+}
@@ -0,0 +1,164 @@
+package waffle
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// GraphFormat is the diagram language ExportGraph renders the routing in.
+type GraphFormat int
+
+const (
+	// GraphDOT renders a Graphviz digraph
+	GraphDOT GraphFormat = iota
+	// GraphMermaid renders a Mermaid flowchart
+	GraphMermaid
+)
+
+// ErrUnknownGraphFormat is returned by ExportGraph for a format it doesn't render.
+var ErrUnknownGraphFormat = errors.New("unknown graph format")
+
+// graphNode is a node of the routing graph.
+type graphNode struct {
+	id    string
+	label string
+	kind  graphNodeKind
+}
+
+// graphNodeKind tells events, actions and concurrency groups apart.
+type graphNodeKind int
+
+const (
+	graphEvent graphNodeKind = iota
+	graphAction
+	graphGroup
+)
+
+// graphEdge links an event to the action it triggers, or an action to a concurrency
+// group it acquires.
+type graphEdge struct {
+	from, to string
+	// limits marks an edge from an action to a concurrency group
+	limits bool
+}
+
+// ExportGraph renders the events, the actions they trigger and the concurrency groups the
+// actions acquire as a diagram, for documenting and debugging the wiring. Groups shared by
+// several actions appear once. The output is stable for the same registrations.
+func (e *Engine) ExportGraph(format GraphFormat) (string, error) {
+	if format != GraphDOT && format != GraphMermaid {
+		return "", fmt.Errorf("%w: %d", ErrUnknownGraphFormat, format)
+	}
+
+	nodes, edges := e.routingGraph()
+	if format == GraphMermaid {
+		return renderMermaid(nodes, edges), nil
+	}
+
+	return renderDOT(nodes, edges), nil
+}
+
+// routingGraph collects the nodes and edges of the routing, sorted by key.
+func (e *Engine) routingGraph() ([]graphNode, []graphEdge) {
+	triggers := e.Triggers()
+	actions := e.Actions()
+
+	nodes := make([]graphNode, 0, len(triggers)+len(actions))
+	edges := make([]graphEdge, 0)
+
+	actionIDs := make(map[ActionKey]string, len(actions))
+	for i, actionKey := range slices.Sorted(maps.Keys(actions)) {
+		actionIDs[actionKey] = "a" + strconv.Itoa(i)
+	}
+
+	for i, eventKey := range slices.Sorted(maps.Keys(triggers)) {
+		id := "e" + strconv.Itoa(i)
+		nodes = append(nodes, graphNode{id: id, label: string(eventKey), kind: graphEvent})
+		for _, actionKey := range triggers[eventKey] {
+			if actionID, ok := actionIDs[actionKey]; ok {
+				edges = append(edges, graphEdge{from: id, to: actionID})
+			}
+		}
+	}
+
+	groupIDs := make(map[*StringConcurrencyLimit]string)
+	for _, actionKey := range slices.Sorted(maps.Keys(actions)) {
+		actionID := actionIDs[actionKey]
+		nodes = append(nodes, graphNode{id: actionID, label: string(actionKey), kind: graphAction})
+
+		names, limits := actions[actionKey].ConcurrencyGroups.limits()
+		for i, limit := range limits {
+			// Shared groups hold the same slots, whatever key function they use
+			groupID, ok := groupIDs[limit.StringConcurrencyLimit]
+			if !ok {
+				groupID = "g" + strconv.Itoa(len(groupIDs))
+				groupIDs[limit.StringConcurrencyLimit] = groupID
+
+				name := names[i]
+				if name == "" {
+					name = "global"
+				}
+				label := fmt.Sprintf("%s (limit %d)", name, limit.Limit())
+				nodes = append(nodes, graphNode{id: groupID, label: label, kind: graphGroup})
+			}
+			edges = append(edges, graphEdge{from: actionID, to: groupID, limits: true})
+		}
+	}
+
+	return nodes, edges
+}
+
+// renderDOT renders the graph as a Graphviz digraph.
+func renderDOT(nodes []graphNode, edges []graphEdge) string {
+	var b strings.Builder
+	b.WriteString("digraph waffle {\n\trankdir=LR;\n")
+
+	shapes := map[graphNodeKind]string{graphEvent: "ellipse", graphAction: "box", graphGroup: "hexagon"}
+	for _, node := range nodes {
+		fmt.Fprintf(&b, "\t%s [label=%s, shape=%s];\n", node.id, strconv.Quote(node.label), shapes[node.kind])
+	}
+
+	for _, edge := range edges {
+		if edge.limits {
+			fmt.Fprintf(&b, "\t%s -> %s [style=dashed];\n", edge.from, edge.to)
+		} else {
+			fmt.Fprintf(&b, "\t%s -> %s;\n", edge.from, edge.to)
+		}
+	}
+
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
+// renderMermaid renders the graph as a Mermaid flowchart.
+func renderMermaid(nodes []graphNode, edges []graphEdge) string {
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+
+	for _, node := range nodes {
+		label := `"` + strings.ReplaceAll(node.label, `"`, "#quot;") + `"`
+		switch node.kind {
+		case graphEvent:
+			fmt.Fprintf(&b, "\t%s([%s])\n", node.id, label)
+		case graphAction:
+			fmt.Fprintf(&b, "\t%s[%s]\n", node.id, label)
+		case graphGroup:
+			fmt.Fprintf(&b, "\t%s{{%s}}\n", node.id, label)
+		}
+	}
+
+	for _, edge := range edges {
+		if edge.limits {
+			fmt.Fprintf(&b, "\t%s -.-> %s\n", edge.from, edge.to)
+		} else {
+			fmt.Fprintf(&b, "\t%s --> %s\n", edge.from, edge.to)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,71 @@
+package waffle_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func newGraphEngine(t *testing.T) *waffle.Engine {
+	t.Helper()
+
+	engine := waffle.NewEngine(nil)
+	noop := func(_ context.Context, _ any) error { return nil }
+	tenant := func(_ context.Context, _ any) string { return "tenant" }
+
+	require.NoError(t, engine.On("order.created", "order.paid").ConcurrencyGroup("tenant", 2, tenant).Do("notify", noop))
+	require.NoError(t, engine.On("order.created").ShareConcurrencyWith("notify").Concurrency(1).Do("audit", noop))
+
+	return engine
+}
+
+func TestEngine_ExportGraph(t *testing.T) {
+	t.Run("dot", func(t *testing.T) {
+		graph, err := newGraphEngine(t).ExportGraph(waffle.GraphDOT)
+		require.NoError(t, err)
+		require.Equal(t, `digraph waffle {
+	rankdir=LR;
+	e0 [label="order.created", shape=ellipse];
+	e1 [label="order.paid", shape=ellipse];
+	a0 [label="audit", shape=box];
+	g0 [label="global (limit 1)", shape=hexagon];
+	g1 [label="tenant (limit 2)", shape=hexagon];
+	a1 [label="notify", shape=box];
+	e0 -> a1;
+	e0 -> a0;
+	e1 -> a1;
+	a0 -> g0 [style=dashed];
+	a0 -> g1 [style=dashed];
+	a1 -> g0 [style=dashed];
+	a1 -> g1 [style=dashed];
+}
+`, graph)
+	})
+
+	t.Run("mermaid", func(t *testing.T) {
+		graph, err := newGraphEngine(t).ExportGraph(waffle.GraphMermaid)
+		require.NoError(t, err)
+		require.Equal(t, `flowchart LR
+	e0(["order.created"])
+	e1(["order.paid"])
+	a0["audit"]
+	g0{{"global (limit 1)"}}
+	g1{{"tenant (limit 2)"}}
+	a1["notify"]
+	e0 --> a1
+	e0 --> a0
+	e1 --> a1
+	a0 -.-> g0
+	a0 -.-> g1
+	a1 -.-> g0
+	a1 -.-> g1
+`, graph)
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		_, err := waffle.NewEngine(nil).ExportGraph(waffle.GraphFormat(42))
+		require.ErrorIs(t, err, waffle.ErrUnknownGraphFormat)
+	})
+}
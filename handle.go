@@ -0,0 +1,116 @@
+package waffle
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// SendHandle tracks the actions triggered by SendAwait until they are done, retries
+// included, collecting their results. Events sent by the actions aren't tracked.
+type SendHandle struct {
+	results []ActionResult
+	// pending counts the actions not done yet, plus one until the dispatch is over
+	pending int
+	done    chan struct{}
+	mu      sync.Mutex
+}
+
+// sendHandleKey is the context key holding the SendHandle of a dispatch.
+type sendHandleKey struct{}
+
+// SendAwait sends an event like Send and returns a handle to wait for the actions it
+// triggered and get their results. The handle is done right away if no action was triggered.
+func (e *Engine) SendAwait(ctx context.Context, eventKey EventKey, data any) *SendHandle {
+	handle := &SendHandle{
+		results: make([]ActionResult, 0),
+		pending: 1,
+		done:    make(chan struct{}),
+	}
+
+	e.send(ctx, eventKey, data, sendOptions{handle: handle})
+	handle.settle(nil)
+
+	return handle
+}
+
+// Done returns a channel closed once all the actions are done.
+func (h *SendHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait waits for all the actions to be done and returns their results in the order they
+// finished, along with their errors joined. Actions that weren't admitted are reported
+// with ErrDropped, like by SendSync. If the context is done first, it returns the context
+// error and no results.
+func (h *SendHandle) Wait(ctx context.Context) ([]ActionResult, error) {
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	errs := make([]error, 0)
+	for _, result := range h.results {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+		}
+	}
+
+	return h.results, errors.Join(errs...)
+}
+
+// add counts actions the handle waits for. It does nothing on a nil handle.
+func (h *SendHandle) add(actions int) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.pending += actions
+}
+
+// settle records the result of a done action, or ends the dispatch when result is nil.
+func (h *SendHandle) settle(result *ActionResult) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if result != nil {
+		h.results = append(h.results, *result)
+	}
+
+	h.pending--
+	if h.pending == 0 {
+		close(h.done)
+	}
+}
+
+// withSendHandle returns a context carrying the handle of the dispatch, hiding the handle
+// of an outer dispatch so that events sent by actions don't count against it.
+func withSendHandle(ctx context.Context, handle *SendHandle) context.Context {
+	if handle == nil && ctx.Value(sendHandleKey{}) == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, sendHandleKey{}, handle)
+}
+
+// settleDispatch marks an action of the dispatch as done with its result, for the event
+// store and the SendHandle of the dispatch, then spawns the next action of a sequential
+// dispatch.
+func (e *Engine) settleDispatch(ctx context.Context, result ActionResult) {
+	e.settleStored(ctx)
+	e.settleDedup(ctx)
+
+	if handle, _ := ctx.Value(sendHandleKey{}).(*SendHandle); handle != nil {
+		handle.settle(&result)
+	}
+
+	e.advanceFanOut(ctx, result)
+	e.settleBatchMembers(ctx, result)
+}
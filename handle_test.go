@@ -0,0 +1,68 @@
+package waffle_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_SendAwait(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	chargeErr := errors.New("card declined")
+	block := make(chan struct{})
+	defer close(block)
+	require.NoError(t, engine.On("order").Do("charge", func(_ context.Context, _ any) error {
+		return chargeErr
+	}))
+	require.NoError(t, engine.On("order").Do("ship", func(ctx context.Context, _ any) error {
+		// Events sent by the action aren't awaited
+		engine.Send(ctx, "shipped", nil)
+		return nil
+	}))
+	require.NoError(t, engine.On("shipped").Do("notify", func(_ context.Context, _ any) error {
+		<-block
+		return nil
+	}))
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+	defer cancel()
+	results, err := engine.SendAwait(t.Context(), "order", nil).Wait(ctx)
+	require.ErrorIs(t, err, chargeErr)
+	require.Len(t, results, 2)
+	require.ElementsMatch(t, []waffle.ActionKey{"charge", "ship"}, []waffle.ActionKey{results[0].ActionKey, results[1].ActionKey})
+
+	// An event without actions is done right away
+	handle := engine.SendAwait(t.Context(), "unknown", nil)
+	<-handle.Done()
+	results, err = handle.Wait(t.Context())
+	require.NoError(t, err)
+	require.Empty(t, results)
+
+	// Waiting gives up with the context
+	ctx, cancel = context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+	_, err = engine.SendAwait(t.Context(), "shipped", nil).Wait(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestEngine_SendAwait_Dropped(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	block := make(chan struct{})
+	defer close(block)
+	require.NoError(t, engine.On("event").Concurrency(1).Do("action", func(_ context.Context, _ any) error {
+		<-block
+		return nil
+	}))
+
+	require.True(t, engine.Send(t.Context(), "event", nil))
+
+	results, err := engine.SendAwait(t.Context(), "event", nil).Wait(t.Context())
+	require.ErrorIs(t, err, waffle.ErrDropped)
+	require.Equal(t, []waffle.ActionResult{{ActionKey: "action", Err: waffle.ErrDropped}}, results)
+}
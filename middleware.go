@@ -0,0 +1,54 @@
+package waffle
+
+import (
+	"context"
+	"slices"
+)
+
+// Middleware wraps an action with behavior shared by many actions, e.g. logging, metrics,
+// auth or tracing, like an http middleware wraps a handler. The context passed to the
+// action carries its keys, see ActionKeyFromContext and EventKeyFromContext.
+type Middleware func(next Action) Action
+
+// actionKeyKey is the context key holding the key of the running action.
+type actionKeyKey struct{}
+
+// ActionKeyFromContext returns the key of the action the context was passed to,
+// reporting false outside of an action.
+func ActionKeyFromContext(ctx context.Context) (ActionKey, bool) {
+	actionKey, ok := ctx.Value(actionKeyKey{}).(ActionKey)
+	return actionKey, ok
+}
+
+// EventKeyFromContext returns the key of the event that triggered the action the context
+// was passed to, reporting false outside of a dispatch.
+func EventKeyFromContext(ctx context.Context) (EventKey, bool) {
+	eventKey, ok := ctx.Value(eventKeyKey{}).(EventKey)
+	return eventKey, ok
+}
+
+// Use adds middlewares wrapping every action of the engine, including the actions already
+// registered. They run in the order they were added, before the middlewares of the action.
+// Nil middlewares are ignored.
+func (e *Engine) Use(middlewares ...Middleware) {
+	e.registryMu.Lock()
+	defer e.registryMu.Unlock()
+
+	e.middlewares = append(slices.Clip(e.middlewares), slices.DeleteFunc(slices.Clone(middlewares), func(mw Middleware) bool {
+		return mw == nil
+	})...)
+}
+
+// wrapAction wraps the action with the middlewares of the engine and of the action, the
+// first one added being the outermost.
+func (e *Engine) wrapAction(configuration ActionConfiguration, action Action) Action {
+	e.registryMu.RLock()
+	middlewares := slices.Concat(e.middlewares, configuration.Middlewares)
+	e.registryMu.RUnlock()
+
+	for _, mw := range slices.Backward(middlewares) {
+		action = mw(action)
+	}
+
+	return action
+}
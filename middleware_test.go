@@ -0,0 +1,86 @@
+package waffle_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_Use(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	calls := make(chan string, 8)
+	trace := func(name string) waffle.Middleware {
+		return func(next waffle.Action) waffle.Action {
+			return func(ctx context.Context, data any) error {
+				actionKey, _ := waffle.ActionKeyFromContext(ctx)
+				eventKey, _ := waffle.EventKeyFromContext(ctx)
+				calls <- name + " " + string(eventKey) + "/" + string(actionKey)
+				return next(ctx, data)
+			}
+		}
+	}
+
+	err := engine.On("user.created").Use(trace("action")).Do("welcome", func(context.Context, any) error {
+		calls <- "run"
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Engine middlewares apply to the actions already registered, outside of theirs
+	engine.Use(trace("outer"), trace("inner"))
+
+	_, err = engine.SendSync(t.Context(), "user.created", nil)
+	require.NoError(t, err)
+	close(calls)
+
+	got := make([]string, 0)
+	for call := range calls {
+		got = append(got, call)
+	}
+	require.Equal(t, []string{
+		"outer user.created/welcome",
+		"inner user.created/welcome",
+		"action user.created/welcome",
+		"run",
+	}, got)
+}
+
+func TestEngine_Use_ShortCircuit(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	errUnauthorized := errors.New("unauthorized")
+	engine.Use(func(next waffle.Action) waffle.Action {
+		return func(ctx context.Context, data any) error {
+			if data != "admin" {
+				return errUnauthorized
+			}
+			return next(ctx, data)
+		}
+	})
+
+	ran := false
+	require.NoError(t, engine.On("user.deleted").Do("purge", func(context.Context, any) error {
+		ran = true
+		return nil
+	}))
+
+	_, err := engine.SendSync(t.Context(), "user.deleted", "guest")
+	require.ErrorIs(t, err, errUnauthorized)
+	require.False(t, ran)
+
+	_, err = engine.SendSync(t.Context(), "user.deleted", "admin")
+	require.NoError(t, err)
+	require.True(t, ran)
+}
+
+func TestActionKeyFromContext_OutsideAction(t *testing.T) {
+	_, ok := waffle.ActionKeyFromContext(t.Context())
+	require.False(t, ok)
+
+	_, ok = waffle.EventKeyFromContext(t.Context())
+	require.False(t, ok)
+}
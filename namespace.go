@@ -0,0 +1,44 @@
+package waffle
+
+import (
+	"context"
+	"slices"
+	"strings"
+)
+
+// EventKeysIn returns the registered event keys under the namespace, at any depth and
+// sorted, leaving out the namespace itself and wildcards. Namespaces are split by the
+// hierarchy separator, or by "." when hierarchy is disabled, so "user.created" and
+// "user.profile.updated" are both in the "user" namespace.
+func (e *Engine) EventKeysIn(namespace EventKey) []EventKey {
+	prefix := string(namespace) + e.segmentSeparator()
+
+	e.registryMu.RLock()
+	defer e.registryMu.RUnlock()
+
+	eventKeys := make([]EventKey, 0)
+	for eventKey := range e.triggers {
+		if !strings.HasPrefix(string(eventKey), prefix) || e.isWildcard(eventKey) {
+			continue
+		}
+		eventKeys = append(eventKeys, eventKey)
+	}
+	slices.Sort(eventKeys)
+
+	return eventKeys
+}
+
+// SendNamespace fans the data out to every registered event key under the namespace, see
+// EventKeysIn, as SendMany does. When hierarchy is enabled, the actions of the namespace
+// run once per event key, like for any event sent under it. It returns the total number
+// of actions triggered.
+func (e *Engine) SendNamespace(ctx context.Context, namespace EventKey, data any) int {
+	return e.SendMany(ctx, data, e.EventKeysIn(namespace)...)
+}
+
+// isWildcard reports whether the event key is a wildcard matching other event keys.
+func (e *Engine) isWildcard(eventKey EventKey) bool {
+	return slices.ContainsFunc(e.wildcards, func(w wildcard) bool {
+		return w.eventKey == eventKey
+	})
+}
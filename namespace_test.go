@@ -0,0 +1,48 @@
+package waffle_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_SendNamespace(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	var mu sync.Mutex
+	ran := make(map[waffle.ActionKey]any)
+	for eventKey, actionKey := range map[waffle.EventKey]waffle.ActionKey{
+		"user.created":         "welcome",
+		"user.deleted":         "cleanup",
+		"user.profile.updated": "reindex",
+		"user.*":               "audit",
+		"users.created":        "count",
+	} {
+		err := engine.On(eventKey).Do(actionKey, func(_ context.Context, data any) error {
+			mu.Lock()
+			defer mu.Unlock()
+			ran[actionKey] = data
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, []waffle.EventKey{"user.created", "user.deleted", "user.profile.updated"}, engine.EventKeysIn("user"))
+	require.Empty(t, engine.EventKeysIn("order"))
+
+	// The wildcard is triggered by the events it matches, not by the namespace itself
+	require.Equal(t, 5, engine.SendNamespace(t.Context(), "user", "maintenance"))
+	require.NoError(t, engine.Wait(t.Context()))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, map[waffle.ActionKey]any{
+		"welcome": "maintenance",
+		"cleanup": "maintenance",
+		"reindex": "maintenance",
+		"audit":   "maintenance",
+	}, ran)
+}
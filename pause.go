@@ -0,0 +1,184 @@
+package waffle
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ErrPaused is returned by SendSync for an event paused with Engine.Pause.
+var ErrPaused = errors.New("event is paused")
+
+// heldEvent is an event sent while paused, waiting for Resume.
+type heldEvent struct {
+	ctx      context.Context
+	eventKey EventKey
+	data     any
+	opts     sendOptions
+}
+
+// pauser holds the paused event keys and the events sent while they were paused.
+type pauser struct {
+	// all pauses every event, on top of keys
+	all  bool
+	keys map[EventKey]struct{}
+	held []heldEvent
+	// size caps the held events when capped
+	size   int
+	capped bool
+	mu     sync.Mutex
+}
+
+// WithPauseBuffer caps how many events sent while paused are held for Resume. Events sent
+// once the buffer is full are rejected, logged as waffle.event.pause_rejected and counted
+// under DropReasonPaused. A size of zero rejects every paused event instead of holding it.
+// Without this option the held events aren't capped.
+func WithPauseBuffer(size uint) EngineOption {
+	return func(e *Engine) {
+		e.pauser.size = int(size)
+		e.pauser.capped = true
+	}
+}
+
+// Pause stops dispatching the events sent with the keys, or every event when no key is
+// given, e.g. during an incident or maintenance. The events are matched by their key once
+// routed. Events sent while paused are held in memory, see WithPauseBuffer, and sent once
+// resumed, with Send reporting the actions registered for them when they were held. Held
+// events are neither stored nor deduplicated until they are sent, and are lost if the
+// engine stops first. Events already dispatched aren't affected.
+func (e *Engine) Pause(eventKeys ...EventKey) {
+	e.pauser.mu.Lock()
+	if len(eventKeys) == 0 {
+		e.pauser.all = true
+	}
+	if e.pauser.keys == nil {
+		e.pauser.keys = make(map[EventKey]struct{})
+	}
+	for _, eventKey := range eventKeys {
+		e.pauser.keys[eventKey] = struct{}{}
+	}
+	e.pauser.mu.Unlock()
+
+	// Log engine paused
+	e.logOperation(context.Background(), "waffle.engine.paused", map[string]string{
+		"eventKeys": joinEventKeys(eventKeys),
+	})
+}
+
+// Resume dispatches the events with the keys again, or every event when no key is given,
+// then sends the events held while they were paused, in the order they were sent, on the
+// calling goroutine. Resuming some keys doesn't resume them while every event is paused.
+func (e *Engine) Resume(eventKeys ...EventKey) {
+	e.pauser.mu.Lock()
+	if len(eventKeys) == 0 {
+		e.pauser.all = false
+		clear(e.pauser.keys)
+	}
+	for _, eventKey := range eventKeys {
+		delete(e.pauser.keys, eventKey)
+	}
+
+	resumed := make([]heldEvent, 0)
+	held := e.pauser.held[:0]
+	for _, event := range e.pauser.held {
+		if e.pausedLocked(event.eventKey) {
+			held = append(held, event)
+		} else {
+			resumed = append(resumed, event)
+		}
+	}
+	clear(e.pauser.held[len(held):])
+	e.pauser.held = held
+	e.pauser.mu.Unlock()
+
+	// Log engine resumed
+	e.logOperation(context.Background(), "waffle.engine.resumed", map[string]string{
+		"eventKeys": joinEventKeys(eventKeys),
+	})
+
+	for _, event := range resumed {
+		event.opts.routed = true
+		e.send(event.ctx, event.eventKey, event.data, event.opts)
+		if event.opts.handle != nil {
+			event.opts.handle.settle(nil)
+		}
+	}
+}
+
+// Paused reports whether events with the key are paused.
+func (e *Engine) Paused(eventKey EventKey) bool {
+	e.pauser.mu.Lock()
+	defer e.pauser.mu.Unlock()
+
+	return e.pausedLocked(eventKey)
+}
+
+// pausedLocked reports whether events with the key are paused. The caller must hold the
+// pauser lock.
+func (e *Engine) pausedLocked(eventKey EventKey) bool {
+	_, ok := e.pauser.keys[eventKey]
+	return ok || e.pauser.all
+}
+
+// holdPaused holds the event if its key is paused, or rejects it when the pause buffer is
+// full. It returns false when the event isn't paused, along with the number of actions
+// registered for a held event.
+func (e *Engine) holdPaused(ctx context.Context, eventKey EventKey, data any, opts sendOptions) (bool, int) {
+	e.pauser.mu.Lock()
+	if !e.pausedLocked(eventKey) {
+		e.pauser.mu.Unlock()
+		return false, 0
+	}
+
+	// Events without actions are counted as such rather than held
+	actionKeys := e.actionKeysFor(eventKey)
+	if len(actionKeys) == 0 {
+		e.pauser.mu.Unlock()
+		return false, 0
+	}
+
+	if e.pauser.capped && len(e.pauser.held) >= e.pauser.size {
+		e.pauser.mu.Unlock()
+
+		// Log paused event rejected
+		e.logOperation(ctx, "waffle.event.pause_rejected", map[string]string{
+			"eventKey": string(eventKey),
+		})
+		e.stats.addDropReason(DropReasonPaused, 1)
+		return true, 0
+	}
+
+	e.pauser.held = append(e.pauser.held, heldEvent{
+		ctx:      context.WithoutCancel(ctx),
+		eventKey: eventKey,
+		data:     data,
+		opts:     opts,
+	})
+	// The SendHandle waits for the event to be sent
+	opts.handle.add(1)
+	e.pauser.mu.Unlock()
+
+	// Log event held
+	e.logOperation(ctx, "waffle.event.held", map[string]string{
+		"eventKey": string(eventKey),
+	})
+
+	return true, len(actionKeys)
+}
+
+// joinEventKeys joins the event keys for logging, "*" standing for every event.
+func joinEventKeys(eventKeys []EventKey) string {
+	if len(eventKeys) == 0 {
+		return "*"
+	}
+
+	keys := make([]string, 0, len(eventKeys))
+	for _, eventKey := range eventKeys {
+		keys = append(keys, string(eventKey))
+	}
+	slices.Sort(keys)
+
+	return strings.Join(keys, ",")
+}
@@ -0,0 +1,108 @@
+package waffle_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_Pause(t *testing.T) {
+	t.Run("hold and resume", func(t *testing.T) {
+		logger := waffle.NewTestOperationLogger()
+		engine := waffle.NewEngine(logger)
+
+		ran := make(chan any, 3)
+		require.NoError(t, engine.On("order.created", "order.paid").Inline().Do("record", func(_ context.Context, data any) error {
+			ran <- data
+			return nil
+		}))
+
+		engine.Pause("order.created")
+		require.True(t, engine.Paused("order.created"))
+		require.False(t, engine.Paused("order.paid"))
+
+		require.True(t, engine.Send(t.Context(), "order.created", 1))
+		require.True(t, engine.Send(t.Context(), "order.paid", 2))
+		require.True(t, engine.Send(t.Context(), "order.created", 3))
+		require.Equal(t, 2, <-ran)
+		require.Empty(t, ran)
+		logger.AssertEventLoggedTimes(t, "waffle.event.held", 2)
+
+		_, err := engine.SendSync(t.Context(), "order.created", 4)
+		require.ErrorIs(t, err, waffle.ErrPaused)
+
+		// The held events are sent in order
+		engine.Resume("order.created")
+		require.False(t, engine.Paused("order.created"))
+		require.Equal(t, 1, <-ran)
+		require.Equal(t, 3, <-ran)
+	})
+
+	t.Run("all events", func(t *testing.T) {
+		engine := waffle.NewEngine(waffle.NewTestOperationLogger())
+
+		ran := make(chan any, 2)
+		require.NoError(t, engine.On("a", "b").Inline().Do("record", func(_ context.Context, data any) error {
+			ran <- data
+			return nil
+		}))
+
+		engine.Pause()
+		require.True(t, engine.Send(t.Context(), "a", "a"))
+		require.True(t, engine.Send(t.Context(), "b", "b"))
+
+		// Resuming a key doesn't lift the pause of every event
+		engine.Resume("a")
+		require.True(t, engine.Paused("a"))
+		require.Empty(t, ran)
+
+		engine.Resume()
+		require.Equal(t, "a", <-ran)
+		require.Equal(t, "b", <-ran)
+	})
+
+	t.Run("buffer full", func(t *testing.T) {
+		logger := waffle.NewTestOperationLogger()
+		engine := waffle.NewEngine(logger, waffle.WithPauseBuffer(1))
+
+		ran := make(chan any, 2)
+		require.NoError(t, engine.On("event").Inline().Do("record", func(_ context.Context, data any) error {
+			ran <- data
+			return nil
+		}))
+
+		engine.Pause("event")
+		require.True(t, engine.Send(t.Context(), "event", 1))
+		require.False(t, engine.Send(t.Context(), "event", 2))
+		logger.AssertEventLoggedWithMetadata(t, "waffle.event.pause_rejected", map[string]string{
+			"eventKey": "event",
+		})
+		require.Equal(t, 1, engine.DropReasons()[waffle.DropReasonPaused])
+
+		engine.Resume("event")
+		require.Equal(t, 1, <-ran)
+		require.Empty(t, ran)
+	})
+
+	t.Run("send handle", func(t *testing.T) {
+		engine := waffle.NewEngine(nil)
+		require.NoError(t, engine.On("event").Do("noop", func(_ context.Context, _ any) error {
+			return nil
+		}))
+
+		engine.Pause("event")
+		handle := engine.SendAwait(t.Context(), "event", nil)
+		select {
+		case <-handle.Done():
+			t.Fatal("handle done before the event was resumed")
+		default:
+		}
+
+		engine.Resume("event")
+		results, err := handle.Wait(t.Context())
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+	})
+}
@@ -0,0 +1,292 @@
+package waffle
+
+import (
+	"container/list"
+	"context"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// OverflowPolicy decides what happens to a run of an action whose queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDropNewest drops the new run, as ErrDropped
+	OverflowDropNewest OverflowPolicy = iota
+	// OverflowDropOldest drops the oldest queued run to make room for the new one
+	OverflowDropOldest
+	// OverflowBlock makes the sender wait for room in the queue, dropping the new run if
+	// its context is done first
+	OverflowBlock
+	// OverflowReject drops the new run and reports it as failed with ErrQueueFull, to the
+	// error handler and SendAwait, so that the sender can push back
+	OverflowReject
+)
+
+// actionQueue holds the runs of an action waiting for concurrency slots, in arrival order.
+type actionQueue struct {
+	runs list.List
+	// size caps the queued runs, zero means no cap
+	size   int
+	policy OverflowPolicy
+	// room is closed and replaced whenever runs leave the queue, waking up blocked senders
+	room chan struct{}
+	// removed is set once the queue is removed from the engine, runs can't join it anymore
+	removed bool
+	mu      sync.Mutex
+}
+
+// newActionQueue creates the queue of an action.
+func newActionQueue(size int, policy OverflowPolicy) *actionQueue {
+	return &actionQueue{
+		size:   size,
+		policy: policy,
+		room:   make(chan struct{}),
+	}
+}
+
+// resize changes the size and the overflow policy of the queue, keeping its runs.
+func (q *actionQueue) resize(size int, policy OverflowPolicy) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.size = size
+	q.policy = policy
+	// Let blocked senders check the new size
+	close(q.room)
+	q.room = make(chan struct{})
+}
+
+// queuedRun is a run of an action waiting in its queue.
+type queuedRun struct {
+	ctx           context.Context
+	configuration ActionConfiguration
+	data          any
+	eventKey      EventKey
+	attempt       uint
+	opts          sendOptions
+}
+
+// droppedRun is a queued run dropped for the reason.
+type droppedRun struct {
+	*queuedRun
+	reason string
+}
+
+// startableRun is a queued run that got its concurrency slots.
+type startableRun struct {
+	*queuedRun
+	keys    []string
+	release func()
+}
+
+// QueuedRuns returns how many runs of the action wait in its queue for concurrency slots.
+func (e *Engine) QueuedRuns(actionKey ActionKey) int {
+	e.registryMu.RLock()
+	queue, ok := e.queues[actionKey]
+	e.registryMu.RUnlock()
+	if !ok {
+		return 0
+	}
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	return queue.runs.Len()
+}
+
+// enqueueRun queues a run of an action whose concurrency limits are reached, applying the
+// overflow policy when the queue is full. It returns false when the run was dropped.
+func (e *Engine) enqueueRun(ctx context.Context, configuration ActionConfiguration, data any, eventKey EventKey, attempt uint, opts sendOptions) bool {
+	e.registryMu.RLock()
+	queue := e.queues[configuration.ActionKey]
+	e.registryMu.RUnlock()
+
+	run := &queuedRun{
+		ctx:           ctx,
+		configuration: configuration,
+		data:          data,
+		eventKey:      eventKey,
+		attempt:       attempt,
+		opts:          opts,
+	}
+
+	if queue == nil {
+		e.dropQueued([]droppedRun{{queuedRun: run, reason: DropReasonRemoved}})
+		return false
+	}
+
+	queue.mu.Lock()
+	var evicted *queuedRun
+	for !queue.removed && queue.size > 0 && queue.runs.Len() >= queue.size {
+		if queue.policy == OverflowDropOldest {
+			evicted = queue.runs.Remove(queue.runs.Front()).(*queuedRun)
+			e.queuedRuns.Add(-1)
+			break
+		}
+
+		if queue.policy != OverflowBlock {
+			queue.mu.Unlock()
+			e.dropOverflow(run, queue.policy)
+			return false
+		}
+
+		room := queue.room
+		queue.mu.Unlock()
+		select {
+		case <-room:
+		case <-ctx.Done():
+			e.dropOverflow(run, queue.policy)
+			return false
+		}
+		queue.mu.Lock()
+	}
+
+	if queue.removed {
+		queue.mu.Unlock()
+		e.dropQueued([]droppedRun{{queuedRun: run, reason: DropReasonRemoved}})
+		return false
+	}
+
+	queue.runs.PushBack(run)
+	queued := queue.runs.Len()
+	e.queuedRuns.Add(1)
+	queue.mu.Unlock()
+
+	if evicted != nil {
+		e.dropOverflow(evicted, queue.policy)
+	}
+
+	// Log action queued
+	e.logOperation(ctx, "waffle.action.queued", map[string]string{
+		"actionKey": string(configuration.ActionKey),
+		"eventKey":  string(eventKey),
+		"queued":    strconv.Itoa(queued),
+	})
+
+	// The slots may have been freed since the run failed to acquire them
+	e.drainQueue(queue)
+
+	return true
+}
+
+// dropOverflow drops a run that didn't fit in the queue of its action, reporting it as
+// failed with ErrQueueFull under the reject policy.
+func (e *Engine) dropOverflow(run *queuedRun, policy OverflowPolicy) {
+	actionKey := run.configuration.ActionKey
+
+	// Log queue overflow
+	e.logOperation(run.ctx, "waffle.action.queue_overflow", map[string]string{
+		"actionKey": string(actionKey),
+		"eventKey":  string(run.eventKey),
+	})
+	e.drop(DropReasonQueueFull, 1)
+	run.opts.markSaturated()
+
+	if policy != OverflowReject {
+		e.settleDispatch(run.ctx, ActionResult{ActionKey: actionKey, Err: ErrDropped})
+		return
+	}
+
+	e.settleDispatch(run.ctx, ActionResult{ActionKey: actionKey, Err: ErrQueueFull})
+	e.reportError(run.ctx, run.eventKey, actionKey, run.data, ErrQueueFull)
+}
+
+// drainQueues starts the queued runs that can get their concurrency slots, in arrival
+// order within each queue. Runs whose context is done, or whose key function now fails,
+// are dropped.
+func (e *Engine) drainQueues() {
+	if e.queuedRuns.Load() == 0 {
+		return
+	}
+
+	e.registryMu.RLock()
+	queues := slices.Collect(maps.Values(e.queues))
+	e.registryMu.RUnlock()
+
+	for _, queue := range queues {
+		e.drainQueue(queue)
+	}
+}
+
+// drainQueue starts the runs of the queue that can get their concurrency slots.
+func (e *Engine) drainQueue(queue *actionQueue) {
+	startable := make([]startableRun, 0)
+	dropped := make([]droppedRun, 0)
+
+	queue.mu.Lock()
+	for elem := queue.runs.Front(); elem != nil; {
+		next := elem.Next()
+		run := elem.Value.(*queuedRun)
+
+		if run.ctx.Err() != nil {
+			queue.runs.Remove(elem)
+			dropped = append(dropped, droppedRun{queuedRun: run, reason: DropReasonConcurrencyLimit})
+		} else if acquired, keys, release, err := run.configuration.ConcurrencyGroups.acquire(run.ctx, run.data, acquireTry); err != nil {
+			queue.runs.Remove(elem)
+			dropped = append(dropped, droppedRun{queuedRun: run, reason: DropReasonKeyError})
+		} else if acquired {
+			queue.runs.Remove(elem)
+			startable = append(startable, startableRun{queuedRun: run, keys: keys, release: release})
+		}
+
+		elem = next
+	}
+	if removed := len(startable) + len(dropped); removed > 0 {
+		e.queuedRuns.Add(-int64(removed))
+		close(queue.room)
+		queue.room = make(chan struct{})
+	}
+	queue.mu.Unlock()
+
+	e.dropQueued(dropped)
+
+	for _, run := range startable {
+		configuration := run.configuration
+		logConcurrency := !configuration.QuietConcurrencyLogs
+		release := e.trackAdmitted(run.ctx, configuration.ActionKey, run.keys, run.release, logConcurrency)
+		e.startAction(run.ctx, configuration, run.data, run.eventKey, run.attempt, run.opts, release)
+	}
+}
+
+// dropQueue drops every run of a queue removed from the engine, so that they don't wait
+// for slots forever. A nil queue is ignored.
+func (e *Engine) dropQueue(queue *actionQueue) {
+	if queue == nil {
+		return
+	}
+
+	dropped := make([]droppedRun, 0)
+
+	queue.mu.Lock()
+	queue.removed = true
+	for queue.runs.Len() > 0 {
+		run := queue.runs.Remove(queue.runs.Front()).(*queuedRun)
+		dropped = append(dropped, droppedRun{queuedRun: run, reason: DropReasonRemoved})
+	}
+	if len(dropped) > 0 {
+		e.queuedRuns.Add(-int64(len(dropped)))
+	}
+	// Wake up blocked senders, they find the queue removed and drop their run
+	close(queue.room)
+	queue.room = make(chan struct{})
+	queue.mu.Unlock()
+
+	e.dropQueued(dropped)
+}
+
+// dropQueued logs and settles the runs removed from a queue without starting.
+func (e *Engine) dropQueued(dropped []droppedRun) {
+	for _, run := range dropped {
+		// Log queued action dropped
+		e.logOperation(run.ctx, "waffle.action.queue_dropped", map[string]string{
+			"actionKey": string(run.configuration.ActionKey),
+			"eventKey":  string(run.eventKey),
+			"reason":    run.reason,
+		})
+		e.drop(run.reason, 1)
+		e.settleDispatch(run.ctx, ActionResult{ActionKey: run.configuration.ActionKey, Err: ErrDropped})
+	}
+}
@@ -0,0 +1,203 @@
+package waffle_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_QueueWhenLimited(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	ran := make(chan int, 3)
+	step := make(chan struct{})
+	err := engine.On("job").Concurrency(1).QueueWhenLimited().Do("process", func(_ context.Context, data any) error {
+		<-step
+		ran <- data.(int)
+		return nil
+	})
+	require.NoError(t, err)
+
+	for i := range 3 {
+		require.True(t, engine.Send(t.Context(), "job", i))
+	}
+	require.Equal(t, 2, engine.QueuedRuns("process"))
+	logger.AssertEventLoggedTimes(t, "waffle.action.queued", 2)
+
+	stats := engine.Stats()
+	require.Equal(t, 2, stats.Queued)
+	require.Equal(t, waffle.ActionStats{Running: 1, Queued: 2}, stats.Actions["process"])
+
+	// The queued runs start in arrival order as slots free up
+	for i := range 3 {
+		step <- struct{}{}
+		require.Equal(t, i, <-ran)
+	}
+
+	require.NoError(t, engine.Wait(t.Context()))
+	require.Equal(t, 0, engine.QueuedRuns("process"))
+	require.Equal(t, uint64(3), engine.Stats().Dispatched)
+	require.Zero(t, engine.Stats().Dropped)
+}
+
+func TestEngine_QueueWhenLimited_ContextDone(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	ran := make(chan any, 2)
+	step := make(chan struct{})
+	err := engine.On("job").Concurrency(1).QueueWhenLimited().Do("process", func(_ context.Context, data any) error {
+		<-step
+		ran <- data
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.True(t, engine.Send(t.Context(), "job", "first"))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	require.True(t, engine.Send(ctx, "job", "canceled"))
+	cancel()
+
+	// The queued run whose context is done is dropped once the slot frees up
+	close(step)
+	require.Equal(t, "first", <-ran)
+	require.NoError(t, engine.Wait(t.Context()))
+
+	time.Sleep(10 * time.Millisecond)
+	require.Empty(t, ran)
+	require.Equal(t, 0, engine.QueuedRuns("process"))
+	require.Equal(t, 1, engine.DropReasons()[waffle.DropReasonConcurrencyLimit])
+}
+
+func TestEngine_Queue(t *testing.T) {
+	// Each case runs "a", queues "b" and overflows with "c"
+	tests := []struct {
+		name   string
+		policy waffle.OverflowPolicy
+		ran    []string
+	}{
+		{name: "drop newest", policy: waffle.OverflowDropNewest, ran: []string{"a", "b"}},
+		{name: "drop oldest", policy: waffle.OverflowDropOldest, ran: []string{"a", "c"}},
+		{name: "reject", policy: waffle.OverflowReject, ran: []string{"a", "b"}},
+		{name: "block", policy: waffle.OverflowBlock, ran: []string{"a", "b", "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := waffle.NewEngine(nil)
+
+			ran := make(chan string, 3)
+			step := make(chan struct{})
+			err := engine.On("job").Concurrency(1).Queue(1, tt.policy).Do("process", func(_ context.Context, data any) error {
+				<-step
+				ran <- data.(string)
+				return nil
+			})
+			require.NoError(t, err)
+
+			require.True(t, engine.Send(t.Context(), "job", "a"))
+			require.True(t, engine.Send(t.Context(), "job", "b"))
+
+			overflowed := make(chan *waffle.SendHandle, 1)
+			go func() {
+				overflowed <- engine.SendAwait(t.Context(), "job", "c")
+			}()
+
+			switch tt.policy {
+			case waffle.OverflowDropNewest, waffle.OverflowReject:
+				results, err := (<-overflowed).Wait(t.Context())
+				if tt.policy == waffle.OverflowReject {
+					require.ErrorIs(t, err, waffle.ErrQueueFull)
+					require.Equal(t, []waffle.ActionResult{{ActionKey: "process", Err: waffle.ErrQueueFull}}, results)
+				} else {
+					require.ErrorIs(t, err, waffle.ErrDropped)
+				}
+				require.Equal(t, 1, engine.DropReasons()[waffle.DropReasonQueueFull])
+			case waffle.OverflowDropOldest:
+				// "c" takes the place of "b" and waits for a slot
+				<-overflowed
+				require.Equal(t, 1, engine.QueuedRuns("process"))
+				require.Equal(t, 1, engine.DropReasons()[waffle.DropReasonQueueFull])
+			case waffle.OverflowBlock:
+				// The sender waits for room in the queue
+				time.Sleep(10 * time.Millisecond)
+				require.Empty(t, overflowed)
+			}
+
+			close(step)
+			for _, data := range tt.ran {
+				select {
+				case got := <-ran:
+					require.Equal(t, data, got)
+				case <-time.After(time.Second):
+					t.Fatalf("%s did not run", data)
+				}
+			}
+
+			require.NoError(t, engine.Wait(t.Context()))
+			require.Empty(t, ran)
+		})
+	}
+}
+
+func TestEngine_QueueWhenLimited_RegisterAgain(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	ran := make(chan int, 3)
+	step := make(chan struct{})
+	action := func(_ context.Context, data any) error {
+		<-step
+		ran <- data.(int)
+		return nil
+	}
+	require.NoError(t, engine.On("job").Concurrency(1).QueueWhenLimited().Do("process", action))
+
+	for i := range 3 {
+		require.True(t, engine.Send(t.Context(), "job", i))
+	}
+	require.Equal(t, 2, engine.QueuedRuns("process"))
+
+	// The queued runs are kept when the action is registered again
+	require.NoError(t, engine.On("job").Concurrency(1).QueueWhenLimited().Do("process", action))
+	require.Equal(t, 2, engine.QueuedRuns("process"))
+
+	close(step)
+	require.NoError(t, engine.Wait(t.Context()))
+	require.Len(t, ran, 3)
+}
+
+func TestEngine_QueueWhenLimited_RemoveAction(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	step := make(chan struct{})
+	err := engine.On("job").Concurrency(1).QueueWhenLimited().Do("process", func(context.Context, any) error {
+		<-step
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.True(t, engine.Send(t.Context(), "job", "running"))
+	handle := engine.SendAwait(t.Context(), "job", "queued")
+	require.Equal(t, 1, engine.QueuedRuns("process"))
+
+	// The queued run is dropped rather than left waiting forever
+	require.True(t, engine.RemoveAction("process"))
+	results, err := handle.Wait(t.Context())
+	require.ErrorIs(t, err, waffle.ErrDropped)
+	require.Equal(t, []waffle.ActionResult{{ActionKey: "process", Err: waffle.ErrDropped}}, results)
+	require.Equal(t, 1, engine.DropReasons()[waffle.DropReasonRemoved])
+	logger.AssertEventLoggedWithMetadata(t, "waffle.action.queue_dropped", map[string]string{
+		"actionKey": "process",
+		"eventKey":  "job",
+		"reason":    waffle.DropReasonRemoved,
+	})
+
+	close(step)
+	require.NoError(t, engine.Wait(t.Context()))
+	require.Equal(t, 0, engine.QueuedRuns("process"))
+}
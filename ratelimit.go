@@ -0,0 +1,263 @@
+package waffle
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a kind of rate limit group.
+type rateLimiter interface {
+	// allow takes a run at now for the key of the data, returning the key and false when
+	// the key is over its rate
+	allow(ctx context.Context, data any, now time.Time) (string, bool)
+	// refund gives back a run taken by allow, for runs another group refused
+	refund(key string, now time.Time)
+}
+
+// RateLimitGroups limits how often an action runs per key, checking every group at
+// dispatch time. Unlike ConcurrencyGroups, they bound the rate of the runs rather than
+// how many run at once. A run over the rate of any group is dropped and doesn't count
+// against the others. Groups are checked in name order.
+//
+// A nil RateLimitGroups has no limits: every run is allowed.
+type RateLimitGroups struct {
+	groups map[string]rateLimiter
+	// names holds the group names in checking order
+	names []string
+	mu    sync.RWMutex
+}
+
+// NewRateLimitGroups creates a new RateLimitGroups instance.
+func NewRateLimitGroups() *RateLimitGroups {
+	return &RateLimitGroups{
+		groups: make(map[string]rateLimiter),
+	}
+}
+
+// Add adds a token bucket group allowing rate runs per second per key on average, and
+// bursts of up to burst runs. A nil key function limits all the runs together.
+func (r *RateLimitGroups) Add(groupName string, rate float64, burst int, keyFunc func(ctx context.Context, data any) string) {
+	r.set(groupName, NewTokenBucket(rate, burst, keyFunc))
+}
+
+// AddSlidingWindow adds a sliding window group allowing up to limit runs per key within
+// any window. Unlike Add, it never allows more than limit runs within a window, even
+// after idle periods.
+// A nil key function limits all the runs together.
+func (r *RateLimitGroups) AddSlidingWindow(groupName string, limit int, window time.Duration, keyFunc func(ctx context.Context, data any) string) {
+	r.set(groupName, NewSlidingWindow(limit, window, keyFunc))
+}
+
+// set stores the group and keeps the checking order sorted.
+func (r *RateLimitGroups) set(groupName string, limiter rateLimiter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.groups[groupName]; !ok {
+		r.names = append(r.names, groupName)
+		slices.Sort(r.names)
+	}
+
+	r.groups[groupName] = limiter
+}
+
+// allow takes a run at now from every group, returning the name of the first group the
+// data is over the rate of and false, giving back the runs taken from the groups before it.
+func (r *RateLimitGroups) allow(ctx context.Context, data any, now time.Time) (string, bool) {
+	if r == nil {
+		return "", true
+	}
+
+	r.mu.RLock()
+	names := slices.Clone(r.names)
+	limiters := make([]rateLimiter, 0, len(names))
+	for _, name := range names {
+		limiters = append(limiters, r.groups[name])
+	}
+	r.mu.RUnlock()
+
+	keys := make([]string, 0, len(limiters))
+	for i, limiter := range limiters {
+		key, ok := limiter.allow(ctx, data, now)
+		if !ok {
+			for j := i - 1; j >= 0; j-- {
+				limiters[j].refund(keys[j], now)
+			}
+			return names[i], false
+		}
+		keys = append(keys, key)
+	}
+
+	return "", true
+}
+
+// TokenBucket limits runs per key with a bucket of burst tokens refilled at rate tokens
+// per second, each run taking a token.
+type TokenBucket struct {
+	rate    float64
+	burst   float64
+	keyFunc func(ctx context.Context, data any) string
+	buckets map[string]*tokens
+	// lastSweep is when the full buckets were last forgotten
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+// tokens is the bucket of a key, as of the last time it was filled.
+type tokens struct {
+	available float64
+	filledAt  time.Time
+}
+
+// NewTokenBucket creates a token bucket allowing rate runs per second per key on average,
+// and bursts of up to burst runs. A nil key function limits all the runs together.
+func NewTokenBucket(rate float64, burst int, keyFunc func(ctx context.Context, data any) string) *TokenBucket {
+	return &TokenBucket{
+		rate:    rate,
+		burst:   float64(burst),
+		keyFunc: keyFunc,
+		buckets: make(map[string]*tokens),
+	}
+}
+
+// allow takes a token at now for the key of the data.
+func (b *TokenBucket) allow(ctx context.Context, data any, now time.Time) (string, bool) {
+	key := ""
+	if b.keyFunc != nil {
+		key = b.keyFunc(ctx, data)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sweep(now)
+
+	bucket := b.fill(key, now)
+	if bucket.available < 1 {
+		return key, false
+	}
+	bucket.available--
+
+	return key, true
+}
+
+// refund gives back a token taken for the key.
+func (b *TokenBucket) refund(key string, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bucket := b.fill(key, now)
+	bucket.available = min(bucket.available+1, b.burst)
+}
+
+// fill returns the bucket of the key refilled up to now, creating a full one for a new
+// key. The caller must hold the lock.
+func (b *TokenBucket) fill(key string, now time.Time) *tokens {
+	bucket, ok := b.buckets[key]
+	if !ok {
+		bucket = &tokens{available: b.burst, filledAt: now}
+		b.buckets[key] = bucket
+		return bucket
+	}
+
+	if elapsed := now.Sub(bucket.filledAt); elapsed > 0 {
+		bucket.available = min(bucket.available+elapsed.Seconds()*b.rate, b.burst)
+		bucket.filledAt = now
+	}
+
+	return bucket
+}
+
+// sweep forgets the keys whose bucket refilled, at most once per time it takes to refill
+// a bucket, since a new key starts with a full bucket anyway. The caller must hold the lock.
+func (b *TokenBucket) sweep(now time.Time) {
+	refill := time.Duration(b.burst / b.rate * float64(time.Second))
+	if now.Sub(b.lastSweep) < refill {
+		return
+	}
+	b.lastSweep = now
+
+	for key, bucket := range b.buckets {
+		if bucket.available+now.Sub(bucket.filledAt).Seconds()*b.rate >= b.burst {
+			delete(b.buckets, key)
+		}
+	}
+}
+
+// SlidingWindow limits runs per key to a number within any rolling window, keeping the
+// time of every run within the window so that the limit is never exceeded, unlike a
+// TokenBucket after an idle period.
+type SlidingWindow struct {
+	limit   int
+	window  time.Duration
+	keyFunc func(ctx context.Context, data any) string
+	// runs holds the times of the runs within the window, by key, oldest first
+	runs map[string][]time.Time
+	// lastSweep is when the idle keys were last forgotten
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+// NewSlidingWindow creates a sliding window allowing up to limit runs per key within any
+// window. A nil key function limits all the runs together.
+func NewSlidingWindow(limit int, window time.Duration, keyFunc func(ctx context.Context, data any) string) *SlidingWindow {
+	return &SlidingWindow{
+		limit:   limit,
+		window:  window,
+		keyFunc: keyFunc,
+		runs:    make(map[string][]time.Time),
+	}
+}
+
+// allow records a run at now for the key of the data.
+func (w *SlidingWindow) allow(ctx context.Context, data any, now time.Time) (string, bool) {
+	key := ""
+	if w.keyFunc != nil {
+		key = w.keyFunc(ctx, data)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.sweep(now)
+
+	runs := w.runs[key]
+	for len(runs) > 0 && !runs[0].After(now.Add(-w.window)) {
+		runs = runs[1:]
+	}
+
+	if len(runs) >= w.limit {
+		w.runs[key] = runs
+		return key, false
+	}
+	w.runs[key] = append(runs, now)
+
+	return key, true
+}
+
+// refund forgets the latest run recorded for the key.
+func (w *SlidingWindow) refund(key string, _ time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if runs := w.runs[key]; len(runs) > 0 {
+		w.runs[key] = runs[:len(runs)-1]
+	}
+}
+
+// sweep forgets the keys without runs within the window, at most once per window. The
+// caller must hold the lock.
+func (w *SlidingWindow) sweep(now time.Time) {
+	if now.Sub(w.lastSweep) < w.window {
+		return
+	}
+	w.lastSweep = now
+
+	for key, runs := range w.runs {
+		if len(runs) == 0 || !runs[len(runs)-1].After(now.Add(-w.window)) {
+			delete(w.runs, key)
+		}
+	}
+}
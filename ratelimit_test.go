@@ -0,0 +1,231 @@
+package waffle_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_RateLimitGroup(t *testing.T) {
+	clock := waffle.NewTestClock(time.Now())
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithClock(clock))
+
+	err := engine.On("call").
+		RateLimitGroup("tenant", 1, 2, func(_ context.Context, data any) string { return data.(string) }).
+		Do("api", func(context.Context, any) error { return nil })
+	require.NoError(t, err)
+
+	call := func(tenant string) bool {
+		results, err := engine.SendSync(t.Context(), "call", tenant)
+		require.Len(t, results, 1)
+		return err == nil
+	}
+
+	// The bucket starts full, allowing a burst
+	require.True(t, call("acme"))
+	require.True(t, call("acme"))
+	require.False(t, call("acme"))
+	// Each key has its own bucket
+	require.True(t, call("globex"))
+
+	// A token is refilled every second
+	clock.Advance(time.Second)
+	require.True(t, call("acme"))
+	require.False(t, call("acme"))
+
+	// The bucket doesn't refill beyond the burst
+	clock.Advance(time.Minute)
+	require.True(t, call("acme"))
+	require.True(t, call("acme"))
+	require.False(t, call("acme"))
+
+	require.Equal(t, 3, engine.DropReasons()[waffle.DropReasonRateLimited])
+	logger.AssertEventLoggedWithMetadata(t, "waffle.action.rate_limited", map[string]string{
+		"actionKey": "api",
+		"eventKey":  "call",
+		"group":     "tenant",
+	})
+}
+
+func TestEngine_RateLimitGroup_Several(t *testing.T) {
+	clock := waffle.NewTestClock(time.Now())
+	engine := waffle.NewEngine(nil, waffle.WithClock(clock))
+
+	type request struct {
+		tenant string
+		user   string
+	}
+
+	err := engine.On("call").
+		RateLimitGroup("tenant", 1, 2, func(_ context.Context, data any) string { return data.(request).tenant }).
+		RateLimitGroup("user", 1, 1, func(_ context.Context, data any) string { return data.(request).user }).
+		Do("api", func(context.Context, any) error { return nil })
+	require.NoError(t, err)
+
+	call := func(tenant, user string) bool {
+		_, err := engine.SendSync(t.Context(), "call", request{tenant: tenant, user: user})
+		return err == nil
+	}
+
+	require.True(t, call("acme", "alice"))
+	// Over the user rate, the tenant token is given back
+	require.False(t, call("acme", "alice"))
+	require.True(t, call("acme", "bob"))
+	// Over the tenant rate
+	require.False(t, call("acme", "carol"))
+}
+
+func TestEngine_RateLimitGroup_TrySend(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	err := engine.On("call").
+		RateLimitGroup("all", 1, 1, func(context.Context, any) string { return "" }).
+		Do("api", func(context.Context, any) error { return nil })
+	require.NoError(t, err)
+
+	require.NoError(t, engine.TrySend(t.Context(), "call", nil))
+	require.ErrorIs(t, engine.TrySend(t.Context(), "call", nil), waffle.ErrSaturated)
+}
+
+func TestActionBuilder_InvalidRateLimitGroup(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+	keyFunc := func(context.Context, any) string { return "" }
+
+	err := engine.On("test").RateLimitGroup("g", 0, 1, keyFunc).Do("test", func(context.Context, any) error { return nil })
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "RateLimitGroup: rate must be positive")
+
+	err = engine.On("test").RateLimitGroup("g", 1, 0, keyFunc).Do("test", func(context.Context, any) error { return nil })
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "RateLimitGroup: burst must be positive")
+
+	err = engine.On("test").RateLimitGroup("g", 1, 1, nil).Do("test", func(context.Context, any) error { return nil })
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "RateLimitGroup: keyFunc must be provided")
+
+	err = engine.On("test").RateLimitGroup("", 1, 1, keyFunc).Do("test", func(context.Context, any) error { return nil })
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "RateLimitGroup: groupName must be provided")
+}
+
+func TestEngine_SlidingWindowGroup(t *testing.T) {
+	clock := waffle.NewTestClock(time.Now().Truncate(time.Minute))
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithClock(clock))
+
+	err := engine.On("call").
+		SlidingWindowGroup("tenant", 2, time.Minute, func(_ context.Context, data any) string { return data.(string) }).
+		Do("api", func(context.Context, any) error { return nil })
+	require.NoError(t, err)
+
+	call := func(tenant string) bool {
+		results, err := engine.SendSync(t.Context(), "call", tenant)
+		require.Len(t, results, 1)
+		return err == nil
+	}
+
+	require.True(t, call("acme"))
+	clock.Advance(30 * time.Second)
+	require.True(t, call("acme"))
+	require.False(t, call("acme"))
+	// Each key has its own window
+	require.True(t, call("globex"))
+
+	// The first run leaves the window a minute after it started
+	clock.Advance(30 * time.Second)
+	require.True(t, call("acme"))
+	require.False(t, call("acme"))
+
+	// Idle keys don't burst beyond the limit
+	clock.Advance(10 * time.Minute)
+	require.True(t, call("acme"))
+	require.True(t, call("acme"))
+	require.False(t, call("acme"))
+
+	require.Equal(t, 3, engine.DropReasons()[waffle.DropReasonRateLimited])
+	logger.AssertEventLoggedWithMetadata(t, "waffle.action.rate_limited", map[string]string{
+		"actionKey": "api",
+		"eventKey":  "call",
+		"group":     "tenant",
+	})
+}
+
+func TestEngine_SlidingWindowGroup_Boundary(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	clock := waffle.NewTestClock(start)
+	engine := waffle.NewEngine(nil, waffle.WithClock(clock))
+
+	err := engine.On("call").
+		SlidingWindowGroup("quota", 10, time.Second, func(context.Context, any) string { return "" }).
+		Do("api", func(context.Context, any) error { return nil })
+	require.NoError(t, err)
+
+	ran := 0
+	send := func(n int) {
+		for range n {
+			if _, err := engine.SendSync(t.Context(), "call", nil); err == nil {
+				ran++
+			}
+		}
+	}
+
+	// Fill the end of one second, then fire right after the boundary
+	clock.Advance(990 * time.Millisecond)
+	send(10)
+	clock.Advance(510 * time.Millisecond)
+	send(5)
+	require.Equal(t, 10, ran)
+
+	// The runs leave the window a second after they started
+	clock.Advance(490 * time.Millisecond)
+	send(5)
+	require.Equal(t, 15, ran)
+}
+
+func TestEngine_SlidingWindowGroup_WithRateLimitGroup(t *testing.T) {
+	clock := waffle.NewTestClock(time.Now().Truncate(time.Minute))
+	engine := waffle.NewEngine(nil, waffle.WithClock(clock))
+
+	err := engine.On("call").
+		RateLimitGroup("burst", 1, 1, func(context.Context, any) string { return "" }).
+		SlidingWindowGroup("quota", 1, time.Minute, func(context.Context, any) string { return "" }).
+		Do("api", func(context.Context, any) error { return nil })
+	require.NoError(t, err)
+
+	_, err = engine.SendSync(t.Context(), "call", nil)
+	require.NoError(t, err)
+
+	// The token bucket refilled but the quota is used up, the token is given back
+	clock.Advance(time.Second)
+	_, err = engine.SendSync(t.Context(), "call", nil)
+	require.ErrorIs(t, err, waffle.ErrDropped)
+
+	clock.Advance(2 * time.Minute)
+	_, err = engine.SendSync(t.Context(), "call", nil)
+	require.NoError(t, err)
+}
+
+func TestActionBuilder_InvalidSlidingWindowGroup(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+	keyFunc := func(context.Context, any) string { return "" }
+
+	err := engine.On("test").SlidingWindowGroup("g", 0, time.Second, keyFunc).Do("test", func(context.Context, any) error { return nil })
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "SlidingWindowGroup: limit must be positive")
+
+	err = engine.On("test").SlidingWindowGroup("g", 1, 0, keyFunc).Do("test", func(context.Context, any) error { return nil })
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "SlidingWindowGroup: window must be positive")
+
+	err = engine.On("test").SlidingWindowGroup("g", 1, time.Second, nil).Do("test", func(context.Context, any) error { return nil })
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "SlidingWindowGroup: keyFunc must be provided")
+
+	err = engine.On("test").SlidingWindowGroup("", 1, time.Second, keyFunc).Do("test", func(context.Context, any) error { return nil })
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "SlidingWindowGroup: groupName must be provided")
+}
@@ -0,0 +1,61 @@
+package waffle
+
+// ActionResolver provides actions that aren't registered on the engine, e.g. scripts of a
+// plugin system, resolving them by key at dispatch time.
+type ActionResolver interface {
+	// Resolve returns the action for the key, or false if there is none
+	Resolve(actionKey ActionKey) (Action, bool)
+}
+
+// ActionResolverFunc adapts a function to the ActionResolver interface.
+type ActionResolverFunc func(actionKey ActionKey) (Action, bool)
+
+// Resolve implements the ActionResolver interface.
+func (f ActionResolverFunc) Resolve(actionKey ActionKey) (Action, bool) {
+	return f(actionKey)
+}
+
+// WithActionResolver makes the engine ask the resolver for the actions triggered by an
+// event that aren't registered, see Trigger. Registered actions are always used first.
+func WithActionResolver(resolver ActionResolver) EngineOption {
+	return func(e *Engine) {
+		e.actionResolver = resolver
+	}
+}
+
+// Trigger makes the event trigger the actions by key without registering them, leaving
+// them to the ActionResolver. Resolved actions run with the default configuration: no
+// concurrency limits, timeout or retry policy.
+func (e *Engine) Trigger(eventKey EventKey, actionKeys ...ActionKey) {
+	e.registryMu.Lock()
+	defer e.registryMu.Unlock()
+
+	e.addTrigger(eventKey, actionKeys...)
+}
+
+// actionConfiguration returns the configuration of a registered action, or of an action
+// provided by the resolver.
+func (e *Engine) actionConfiguration(actionKey ActionKey, eventKey EventKey) (ActionConfiguration, bool) {
+	e.registryMu.RLock()
+	configuration, ok := e.actions[actionKey]
+	e.registryMu.RUnlock()
+	if ok {
+		return configuration, true
+	}
+
+	if e.actionResolver == nil {
+		return ActionConfiguration{}, false
+	}
+
+	action, ok := e.actionResolver.Resolve(actionKey)
+	if !ok || action == nil {
+		return ActionConfiguration{}, false
+	}
+
+	return ActionConfiguration{
+		EventKeys:     []EventKey{eventKey},
+		ActionKey:     actionKey,
+		Action:        action,
+		MaxRetryLater: DefaultMaxRetryLater,
+	}, true
+}
@@ -0,0 +1,43 @@
+package waffle_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_WithActionResolver(t *testing.T) {
+	ran := make(chan any, 1)
+	resolver := waffle.ActionResolverFunc(func(actionKey waffle.ActionKey) (waffle.Action, bool) {
+		if actionKey != "script:notify" {
+			return nil, false
+		}
+
+		return func(_ context.Context, data any) error {
+			ran <- data
+			return nil
+		}, true
+	})
+
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithActionResolver(resolver))
+	engine.Trigger("user.created", "script:notify", "script:missing")
+
+	require.True(t, engine.Send(t.Context(), "user.created", "alice"))
+
+	select {
+	case data := <-ran:
+		require.Equal(t, "alice", data)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("resolved action was not run")
+	}
+
+	// Actions the resolver doesn't know are dropped
+	logger.AssertEventLoggedWithMetadata(t, "waffle.action.spawn_failed", map[string]string{
+		"actionKey": "script:missing",
+	})
+	require.Equal(t, 1, engine.DropReasons()[waffle.DropReasonUnknownAction])
+}
@@ -0,0 +1,39 @@
+package waffle
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// DefaultMaxRetryLater is how many times an action returning ErrRetryLater is retried
+// unless configured otherwise with ActionBuilder.MaxRetryLater.
+const DefaultMaxRetryLater = 3
+
+// ErrRetryLater is returned by an action to have the engine run it again for the same
+// event once the delay elapses, instead of treating the run as failed. The retry goes
+// through concurrency admission again.
+type ErrRetryLater struct {
+	After time.Duration
+}
+
+func (e ErrRetryLater) Error() string {
+	return fmt.Sprintf("retry later after %s", e.After)
+}
+
+// BackoffStrategy returns the delay before a retry, given how many retries were already
+// made, starting at zero for the first retry.
+type BackoffStrategy func(retry uint) time.Duration
+
+// ExponentialBackoff returns a BackoffStrategy doubling the base delay on every retry,
+// i.e. base*2^retry, randomly spread by up to the jitter fraction in either direction
+// and capped at max. The jitter must be within [0, 1] and random must return values
+// within [0, 1), like rand.Float64.
+func ExponentialBackoff(base, max time.Duration, jitter float64, random func() float64) BackoffStrategy {
+	return func(retry uint) time.Duration {
+		delay := float64(base) * math.Pow(2, float64(retry))
+		delay *= 1 + jitter*(2*random()-1)
+
+		return time.Duration(math.Min(delay, float64(max)))
+	}
+}
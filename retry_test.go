@@ -0,0 +1,217 @@
+package waffle_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_RetryLater(t *testing.T) {
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := waffle.NewTestClock(start)
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithClock(clock))
+
+	var mu sync.Mutex
+	invocations := make([]time.Time, 0, 3)
+	require.NoError(t, engine.On("test").Do("test", func(_ context.Context, _ any) error {
+		mu.Lock()
+		defer mu.Unlock()
+		invocations = append(invocations, clock.Now())
+		if len(invocations) < 3 {
+			return waffle.ErrRetryLater{After: time.Second}
+		}
+		return nil
+	}))
+
+	invoked := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(invocations)
+	}
+
+	require.True(t, engine.Send(t.Context(), "test", nil))
+
+	for attempt := 1; attempt < 3; attempt++ {
+		require.Eventually(t, func() bool {
+			return invoked() == attempt && clock.PendingTimers() == 1
+		}, time.Second, time.Millisecond)
+
+		clock.Advance(time.Second)
+	}
+
+	require.Eventually(t, func() bool {
+		return invoked() == 3
+	}, time.Second, time.Millisecond)
+
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, 3, invoked())
+	require.Equal(t, []time.Time{start, start.Add(time.Second), start.Add(2 * time.Second)}, invocations)
+
+	logger.AssertEventLoggedTimes(t, "waffle.action.retry_scheduled", 2)
+	logger.AssertEventLoggedTimes(t, "waffle.action.finished", 1)
+	logger.AssertEventNotLogged(t, "waffle.action.failed")
+}
+
+func TestEngine_RetryLater_MaxRetries(t *testing.T) {
+	clock := waffle.NewTestClock(time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC))
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithClock(clock))
+
+	require.NoError(t, engine.
+		On("test").
+		MaxRetryLater(1).
+		Do("test", func(_ context.Context, _ any) error {
+			return waffle.ErrRetryLater{After: time.Second}
+		}))
+
+	require.True(t, engine.Send(t.Context(), "test", nil))
+
+	require.Eventually(t, func() bool {
+		return clock.PendingTimers() == 1
+	}, time.Second, time.Millisecond)
+	clock.Advance(time.Second)
+
+	time.Sleep(10 * time.Millisecond)
+
+	// The retry ran once and then gave up
+	require.Zero(t, clock.PendingTimers())
+	logger.AssertEventLoggedTimes(t, "waffle.action.started", 2)
+	logger.AssertEventLoggedTimes(t, "waffle.action.retry_scheduled", 1)
+	logger.AssertEventLoggedTimes(t, "waffle.action.failed", 1)
+}
+
+func TestExponentialBackoff_Bounds(t *testing.T) {
+	base := 100 * time.Millisecond
+	maxDelay := 5 * time.Second
+	jitter := 0.2
+
+	// Extreme and random draws should all stay within the jitter bounds
+	draws := []func() float64{
+		func() float64 { return 0 },
+		func() float64 { return 0.999999 },
+		rand.Float64,
+	}
+
+	for _, random := range draws {
+		backoff := waffle.ExponentialBackoff(base, maxDelay, jitter, random)
+		for retry := uint(0); retry < 10; retry++ {
+			expected := float64(base) * math.Pow(2, float64(retry))
+			low := time.Duration(math.Min(expected*(1-jitter), float64(maxDelay)))
+			high := time.Duration(math.Min(expected*(1+jitter), float64(maxDelay)))
+
+			delay := backoff(retry)
+			require.GreaterOrEqual(t, delay, low, "retry %d", retry)
+			require.LessOrEqual(t, delay, high, "retry %d", retry)
+		}
+	}
+}
+
+func TestExponentialBackoff_NoJitter(t *testing.T) {
+	backoff := waffle.ExponentialBackoff(time.Second, 10*time.Second, 0, rand.Float64)
+
+	require.Equal(t, time.Second, backoff(0))
+	require.Equal(t, 2*time.Second, backoff(1))
+	require.Equal(t, 8*time.Second, backoff(3))
+	require.Equal(t, 10*time.Second, backoff(4))
+}
+
+func TestEngine_RetryWithJitter(t *testing.T) {
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := waffle.NewTestClock(start)
+	logger := waffle.NewTestOperationLogger()
+	// A draw of 0 spreads every delay to its lower bound
+	engine := waffle.NewEngine(logger, waffle.WithClock(clock), waffle.WithRandom(func() float64 { return 0 }))
+
+	var mu sync.Mutex
+	invocations := make([]time.Time, 0, 3)
+	require.NoError(t, engine.
+		On("test").
+		RetryWithJitter(3, time.Second, time.Minute, 0.5).
+		Do("test", func(_ context.Context, _ any) error {
+			mu.Lock()
+			defer mu.Unlock()
+			invocations = append(invocations, clock.Now())
+			return fmt.Errorf("downstream unavailable")
+		}))
+
+	invoked := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(invocations)
+	}
+
+	require.True(t, engine.Send(t.Context(), "test", nil))
+
+	// Delays are spread down to half of 1s and 2s
+	for attempt, delay := range []time.Duration{500 * time.Millisecond, time.Second} {
+		require.Eventually(t, func() bool {
+			return invoked() == attempt+1 && clock.PendingTimers() == 1
+		}, time.Second, time.Millisecond)
+
+		clock.Advance(delay)
+	}
+
+	require.Eventually(t, func() bool {
+		return invoked() == 3
+	}, time.Second, time.Millisecond)
+
+	time.Sleep(10 * time.Millisecond)
+
+	// The third failure is final
+	require.Equal(t, []time.Time{start, start.Add(500 * time.Millisecond), start.Add(1500 * time.Millisecond)}, invocations)
+	require.Zero(t, clock.PendingTimers())
+	logger.AssertEventLoggedTimes(t, "waffle.action.retry_scheduled", 2)
+	logger.AssertEventLoggedTimes(t, "waffle.action.failed", 1)
+}
+
+func TestEngine_Retry(t *testing.T) {
+	clock := waffle.NewTestClock(time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC))
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithClock(clock))
+
+	var calls atomic.Int32
+	done := make(chan struct{})
+	backoff := func(retry uint) time.Duration {
+		return time.Duration(retry+1) * time.Second
+	}
+	require.NoError(t, engine.On("test").Retry(3, backoff).Do("test", func(_ context.Context, _ any) error {
+		if calls.Add(1) < 3 {
+			return fmt.Errorf("downstream unavailable")
+		}
+		close(done)
+		return nil
+	}))
+
+	require.True(t, engine.Send(t.Context(), "test", nil))
+
+	for attempt, delay := range []time.Duration{time.Second, 2 * time.Second} {
+		require.Eventually(t, func() bool {
+			return calls.Load() == int32(attempt+1) && clock.PendingTimers() == 1
+		}, time.Second, time.Millisecond)
+
+		clock.Advance(delay)
+	}
+
+	<-done
+	require.NoError(t, engine.Wait(t.Context()))
+	logger.AssertEventLoggedWithMetadata(t, "waffle.action.retry_scheduled", map[string]string{
+		"attempt": "1",
+		"delayMs": "1000",
+	})
+	logger.AssertEventLoggedTimes(t, "waffle.action.retry_scheduled", 2)
+	logger.AssertEventNotLogged(t, "waffle.action.failed")
+
+	var builderErr *waffle.BuilderError
+	err := engine.On("test").Retry(3, nil).Do("other", func(_ context.Context, _ any) error { return nil })
+	require.ErrorAs(t, err, &builderErr)
+	require.Equal(t, "backoff", builderErr.Field)
+}
@@ -0,0 +1,123 @@
+package waffle
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ScheduledEvent is an event sent with SendAfter that wasn't sent yet.
+type ScheduledEvent struct {
+	ID       string
+	EventKey EventKey
+	At       time.Time
+}
+
+// scheduledSend is a pending SendAfter and the timer sending it.
+type scheduledSend struct {
+	event ScheduledEvent
+	timer Timer
+	// seq orders the events due at the same time
+	seq uint64
+}
+
+// scheduler keeps the events sent with SendAfter until their timer fires.
+type scheduler struct {
+	pending map[string]*scheduledSend
+	nextID  uint64
+	mu      sync.Mutex
+}
+
+// SendAfter sends the event once the delay elapses on the engine clock, returning the id of
+// the scheduled event for CancelScheduled. The event is sent with the values of the context
+// but not its cancellation, since the caller's context is often gone by then.
+func (e *Engine) SendAfter(ctx context.Context, delay time.Duration, eventKey EventKey, data any) string {
+	return e.schedule(ctx, delay, eventKey, data, sendOptions{})
+}
+
+// SendAt sends the event at the time on the engine clock like SendAfter, returning the id
+// of the scheduled event for CancelScheduled. A time in the past sends it right away.
+func (e *Engine) SendAt(ctx context.Context, at time.Time, eventKey EventKey, data any) string {
+	return e.schedule(ctx, at.Sub(e.clock.Now()), eventKey, data, sendOptions{})
+}
+
+// schedule sends the event with the options once the delay elapsed, returning the id of
+// the scheduled event.
+func (e *Engine) schedule(ctx context.Context, delay time.Duration, eventKey EventKey, data any, opts sendOptions) string {
+	delay = max(delay, 0)
+
+	e.scheduler.mu.Lock()
+	defer e.scheduler.mu.Unlock()
+
+	if e.scheduler.pending == nil {
+		e.scheduler.pending = make(map[string]*scheduledSend)
+	}
+
+	e.scheduler.nextID++
+	id := strconv.FormatUint(e.scheduler.nextID, 10)
+	sendCtx := context.WithoutCancel(ctx)
+
+	scheduled := &scheduledSend{
+		event: ScheduledEvent{ID: id, EventKey: eventKey, At: e.clock.Now().Add(delay)},
+		seq:   e.scheduler.nextID,
+	}
+	scheduled.timer = e.clock.AfterFunc(delay, func() {
+		e.scheduler.mu.Lock()
+		_, ok := e.scheduler.pending[id]
+		delete(e.scheduler.pending, id)
+		e.scheduler.mu.Unlock()
+
+		// The event was cancelled while the timer fired
+		if !ok {
+			return
+		}
+
+		e.send(sendCtx, eventKey, data, opts)
+	})
+	e.scheduler.pending[id] = scheduled
+
+	return id
+}
+
+// ScheduledEvents returns the events sent with SendAfter that weren't sent yet, ordered
+// by the time they are due.
+func (e *Engine) ScheduledEvents() []ScheduledEvent {
+	e.scheduler.mu.Lock()
+	defer e.scheduler.mu.Unlock()
+
+	pending := slices.Collect(maps.Values(e.scheduler.pending))
+	slices.SortFunc(pending, func(a, b *scheduledSend) int {
+		if c := a.event.At.Compare(b.event.At); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.seq, b.seq)
+	})
+
+	events := make([]ScheduledEvent, 0, len(pending))
+	for _, scheduled := range pending {
+		events = append(events, scheduled.event)
+	}
+
+	return events
+}
+
+// CancelScheduled cancels an event sent with SendAfter, returning false if it was already
+// sent or cancelled.
+func (e *Engine) CancelScheduled(id string) bool {
+	e.scheduler.mu.Lock()
+	defer e.scheduler.mu.Unlock()
+
+	scheduled, ok := e.scheduler.pending[id]
+	if !ok {
+		return false
+	}
+
+	scheduled.timer.Stop()
+	delete(e.scheduler.pending, id)
+
+	return true
+}
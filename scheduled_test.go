@@ -0,0 +1,78 @@
+package waffle_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_SendAfter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := waffle.NewTestClock(start)
+	engine := waffle.NewEngine(nil, waffle.WithClock(clock))
+
+	sent := make(chan waffle.EventKey, 2)
+	action := func(eventKey waffle.EventKey) waffle.Action {
+		return func(_ context.Context, _ any) error {
+			sent <- eventKey
+			return nil
+		}
+	}
+	require.NoError(t, engine.On("reminder").Do("remind", action("reminder")))
+	require.NoError(t, engine.On("expiry").Do("expire", action("expiry")))
+
+	expiry := engine.SendAfter(t.Context(), 2*time.Minute, "expiry", nil)
+	reminder := engine.SendAfter(t.Context(), time.Minute, "reminder", nil)
+
+	require.Equal(t, []waffle.ScheduledEvent{
+		{ID: reminder, EventKey: "reminder", At: start.Add(time.Minute)},
+		{ID: expiry, EventKey: "expiry", At: start.Add(2 * time.Minute)},
+	}, engine.ScheduledEvents())
+
+	// Cancel the reminder, only the expiry is sent
+	require.True(t, engine.CancelScheduled(reminder))
+	require.False(t, engine.CancelScheduled(reminder))
+
+	clock.Advance(2 * time.Minute)
+
+	select {
+	case eventKey := <-sent:
+		require.Equal(t, waffle.EventKey("expiry"), eventKey)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("scheduled event was not sent")
+	}
+
+	require.Empty(t, engine.ScheduledEvents())
+	require.False(t, engine.CancelScheduled(expiry))
+
+	time.Sleep(10 * time.Millisecond)
+	require.Empty(t, sent)
+}
+
+func TestEngine_SendAt(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := waffle.NewTestClock(start)
+	engine := waffle.NewEngine(nil, waffle.WithClock(clock))
+
+	sent := make(chan any, 2)
+	require.NoError(t, engine.On("report").Do("build", func(_ context.Context, data any) error {
+		sent <- data
+		return nil
+	}))
+
+	midnight := start.Add(24 * time.Hour)
+	id := engine.SendAt(t.Context(), midnight, "report", "daily")
+	require.Equal(t, []waffle.ScheduledEvent{{ID: id, EventKey: "report", At: midnight}}, engine.ScheduledEvents())
+
+	// A time in the past is due right away
+	engine.SendAt(t.Context(), start.Add(-time.Hour), "report", "late")
+	clock.Advance(0)
+	require.Equal(t, "late", <-sent)
+
+	clock.Advance(24 * time.Hour)
+	require.Equal(t, "daily", <-sent)
+	require.Empty(t, engine.ScheduledEvents())
+}
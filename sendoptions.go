@@ -0,0 +1,163 @@
+package waffle
+
+import (
+	"context"
+	"maps"
+	"sync/atomic"
+	"time"
+)
+
+// SendOption changes how Send dispatches a single event.
+type SendOption func(*sendOptions)
+
+// WithDelay sends the event once the delay elapses on the engine clock, like SendAfter.
+// Send then reports true without knowing whether any action will be triggered.
+func WithDelay(delay time.Duration) SendOption {
+	return func(opts *sendOptions) {
+		opts.delay = delay
+	}
+}
+
+// WithPriority runs the actions of the event without acquiring their concurrency limits,
+// like SendPriority.
+func WithPriority() SendOption {
+	return func(opts *sendOptions) {
+		opts.bypassConcurrency = true
+	}
+}
+
+// WithWaitPriority makes the actions of the event that wait for concurrency slots get
+// them ahead of the waiting actions with a lower priority, see ContextWithPriority.
+// Unlike WithPriority, the actions still acquire their concurrency limits. Runs queued
+// with QueueWhenLimited keep their arrival order.
+func WithWaitPriority(priority int) SendOption {
+	return func(opts *sendOptions) {
+		opts.waitPriority = &priority
+	}
+}
+
+// WithDedupKey drops the event while an event sent with the same key still has actions
+// that aren't done, retries included, or was sent within the ttl of the dedup store, see
+// WithDedupStore. Dropped events are counted under
+// DropReasonDuplicate and Send reports false for them. An empty key disables deduplication.
+func WithDedupKey(key string) SendOption {
+	return func(opts *sendOptions) {
+		opts.dedupKey = key
+	}
+}
+
+// WithDetachedContext runs the actions of the event, once admitted, with a context that
+// keeps the values of the context passed to Send but isn't canceled with it, like for
+// actions built with Detached. Their retries and queued runs are detached as well.
+func WithDetachedContext() SendOption {
+	return func(opts *sendOptions) {
+		opts.detached = true
+	}
+}
+
+// WithHeaders attaches metadata to the event, read by its actions and middlewares with
+// HeadersFromContext. Events sent by the actions don't inherit them.
+func WithHeaders(headers map[string]string) SendOption {
+	return func(opts *sendOptions) {
+		opts.headers = maps.Clone(headers)
+	}
+}
+
+// headersKey is the context key holding the headers of the event being dispatched.
+type headersKey struct{}
+
+// HeadersFromContext returns the headers the event being dispatched was sent with, see
+// WithHeaders. The map must not be modified. It reports false when the event has no headers.
+func HeadersFromContext(ctx context.Context) (map[string]string, bool) {
+	headers, _ := ctx.Value(headersKey{}).(map[string]string)
+	return headers, headers != nil
+}
+
+// withHeaders returns a context carrying the headers of the dispatch, hiding the headers
+// of an outer dispatch.
+func withHeaders(ctx context.Context, headers map[string]string) context.Context {
+	if headers == nil && ctx.Value(headersKey{}) == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, headersKey{}, headers)
+}
+
+// dedupDispatchKey is the context key holding the dedup key claimed by a dispatch.
+type dedupDispatchKey struct{}
+
+// dedupDispatch counts the actions of a deduplicated event that aren't done yet.
+type dedupDispatch struct {
+	key       string
+	remaining atomic.Int64
+}
+
+// claimDedup claims the dedup key for the dispatch, returning false when an event sent
+// with the same key is still in flight.
+func (e *Engine) claimDedup(ctx context.Context, eventKey EventKey, key string) (context.Context, bool) {
+	if key == "" {
+		// Don't let the dispatch release the dedup key of an outer dispatch
+		if ctx.Value(dedupDispatchKey{}) == nil {
+			return ctx, true
+		}
+		return context.WithValue(ctx, dedupDispatchKey{}, (*dedupDispatch)(nil)), true
+	}
+
+	e.dedupMu.Lock()
+	_, inFlight := e.dedupKeys[key]
+	if !inFlight {
+		if e.dedupKeys == nil {
+			e.dedupKeys = make(map[string]struct{})
+		}
+		e.dedupKeys[key] = struct{}{}
+	}
+	e.dedupMu.Unlock()
+
+	if inFlight || !e.claimDedupStore(ctx, eventKey, key) {
+		if !inFlight {
+			e.releaseDedup(key)
+		}
+
+		// Log duplicate event
+		e.logOperation(ctx, "waffle.event.duplicate", map[string]string{
+			"eventKey": string(eventKey),
+			"dedupKey": key,
+		})
+		e.stats.addDropReason(DropReasonDuplicate, 1)
+		return ctx, false
+	}
+
+	return context.WithValue(ctx, dedupDispatchKey{}, &dedupDispatch{key: key}), true
+}
+
+// beginDedup sets how many actions the dedup key of the dispatch waits for, releasing
+// it right away when there are none.
+func (e *Engine) beginDedup(ctx context.Context, actions int) {
+	dispatch, _ := ctx.Value(dedupDispatchKey{}).(*dedupDispatch)
+	if dispatch == nil {
+		return
+	}
+
+	dispatch.remaining.Store(int64(actions) + 1)
+	e.settleDedup(ctx)
+}
+
+// settleDedup marks an action of the deduplicated event of the dispatch as done,
+// releasing its dedup key once all its actions are done.
+func (e *Engine) settleDedup(ctx context.Context) {
+	dispatch, _ := ctx.Value(dedupDispatchKey{}).(*dedupDispatch)
+	if dispatch == nil || dispatch.remaining.Add(-1) != 0 {
+		return
+	}
+
+	e.releaseDedup(dispatch.key)
+}
+
+// releaseDedup lets events with the dedup key be sent again, unless the dedup store
+// still holds it.
+func (e *Engine) releaseDedup(key string) {
+	e.dedupMu.Lock()
+	defer e.dedupMu.Unlock()
+
+	delete(e.dedupKeys, key)
+}
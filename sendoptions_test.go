@@ -0,0 +1,165 @@
+package waffle_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_Send_WithDelay(t *testing.T) {
+	clock := waffle.NewTestClock(time.Now())
+	engine := waffle.NewEngine(nil, waffle.WithClock(clock))
+
+	ran := make(chan any, 1)
+	require.NoError(t, engine.On("reminder").Do("notify", func(_ context.Context, data any) error {
+		ran <- data
+		return nil
+	}))
+
+	require.True(t, engine.Send(t.Context(), "reminder", "call back", waffle.WithDelay(time.Minute)))
+	require.Len(t, engine.ScheduledEvents(), 1)
+	require.Empty(t, ran)
+
+	clock.Advance(time.Minute)
+	require.Equal(t, "call back", <-ran)
+}
+
+func TestEngine_Send_WithPriority(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	step := make(chan struct{})
+	ran := make(chan any, 2)
+	require.NoError(t, engine.On("job").Concurrency(1).Do("process", func(_ context.Context, data any) error {
+		if data == "slow" {
+			<-step
+		}
+		ran <- data
+		return nil
+	}))
+
+	require.True(t, engine.Send(t.Context(), "job", "slow"))
+	require.True(t, engine.Send(t.Context(), "job", "urgent", waffle.WithPriority()))
+	require.Equal(t, "urgent", <-ran)
+
+	close(step)
+	require.Equal(t, "slow", <-ran)
+}
+
+func TestEngine_Send_WithDedupKey(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	step := make(chan struct{})
+	ran := make(chan any, 3)
+	require.NoError(t, engine.On("sync").Do("fetch", func(_ context.Context, data any) error {
+		<-step
+		ran <- data
+		return nil
+	}))
+
+	require.True(t, engine.Send(t.Context(), "sync", "first", waffle.WithDedupKey("account-1")))
+	require.False(t, engine.Send(t.Context(), "sync", "duplicate", waffle.WithDedupKey("account-1")))
+	require.True(t, engine.Send(t.Context(), "sync", "other", waffle.WithDedupKey("account-2")))
+	logger.AssertEventLoggedWithMetadata(t, "waffle.event.duplicate", map[string]string{
+		"eventKey": "sync",
+		"dedupKey": "account-1",
+	})
+	require.Equal(t, 1, engine.DropReasons()[waffle.DropReasonDuplicate])
+
+	close(step)
+	require.NoError(t, engine.Wait(t.Context()))
+	require.Len(t, ran, 2)
+
+	// The key is released once the actions are done
+	require.True(t, engine.Send(t.Context(), "sync", "again", waffle.WithDedupKey("account-1")))
+	require.NoError(t, engine.Wait(t.Context()))
+}
+
+func TestEngine_Send_WithHeaders(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	headers := make(chan map[string]string, 2)
+	require.NoError(t, engine.On("order.created").Do("forward", func(ctx context.Context, data any) error {
+		got, _ := waffle.HeadersFromContext(ctx)
+		headers <- got
+		engine.Send(ctx, "order.forwarded", data)
+		return nil
+	}))
+	require.NoError(t, engine.On("order.forwarded").Do("audit", func(ctx context.Context, _ any) error {
+		got, _ := waffle.HeadersFromContext(ctx)
+		headers <- got
+		return nil
+	}))
+
+	sent := map[string]string{"tenant": "acme"}
+	require.True(t, engine.Send(t.Context(), "order.created", nil, waffle.WithHeaders(sent)))
+	sent["tenant"] = "changed"
+
+	require.Equal(t, map[string]string{"tenant": "acme"}, <-headers)
+	// Events sent by the action don't inherit the headers
+	require.Nil(t, <-headers)
+}
+
+func TestEngine_SendWithDetachedContext(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	step := make(chan struct{})
+	errs := make(chan error, 1)
+	require.NoError(t, engine.On("event").Do("work", func(ctx context.Context, _ any) error {
+		<-step
+		errs <- ctx.Err()
+		return nil
+	}))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	require.True(t, engine.Send(ctx, "event", nil, waffle.WithDetachedContext()))
+	cancel()
+	close(step)
+
+	require.NoError(t, <-errs)
+}
+
+func TestEngine_SendWithWaitPriority(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	global := waffle.NewConcurrencyLimitWithQueue(1, 10, nil)
+	groups := waffle.NewConcurrencyGroups()
+	groups.AddLimit("", global)
+
+	started := make(chan string, 3)
+	step := make(chan struct{})
+	err := engine.AddActionConfiguration(waffle.ActionConfiguration{
+		EventKeys:         []waffle.EventKey{"event"},
+		ActionKey:         "work",
+		ConcurrencyGroups: groups,
+		Action: func(_ context.Context, data any) error {
+			started <- data.(string)
+			<-step
+			return nil
+		},
+	})
+	require.NoError(t, err)
+
+	require.True(t, engine.Send(t.Context(), "event", "first"))
+	require.Equal(t, "first", <-started)
+
+	go engine.Send(t.Context(), "event", "batch")
+	require.Eventually(t, func() bool {
+		return global.Waiting() == 1
+	}, time.Second, time.Millisecond)
+
+	go engine.Send(t.Context(), "event", "interactive", waffle.WithWaitPriority(1))
+	require.Eventually(t, func() bool {
+		return global.Waiting() == 2
+	}, time.Second, time.Millisecond)
+
+	// The later send with a higher priority gets the slot first
+	step <- struct{}{}
+	require.Equal(t, "interactive", <-started)
+	step <- struct{}{}
+	require.Equal(t, "batch", <-started)
+	close(step)
+}
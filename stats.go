@@ -0,0 +1,256 @@
+package waffle
+
+import (
+	"context"
+	"maps"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EngineStats is a snapshot of the engine counters, for simple monitoring without
+// implementing an OperationLogger.
+type EngineStats struct {
+	// Sends counts the events sent, including events without actions
+	Sends uint64
+	// Dispatched counts the action runs admitted and started, including retries
+	Dispatched uint64
+	// Dropped counts the action runs that weren't admitted, because of concurrency
+	// limits, key function errors, the max depth or saturated workers
+	Dropped uint64
+	// Skipped counts the action runs skipped by their When predicate
+	Skipped uint64
+	// Debounced counts the action runs superseded by a later run of their burst
+	Debounced uint64
+	// Failed counts the action runs that returned an error and weren't retried
+	Failed uint64
+	// Panicked counts the action runs that panicked
+	Panicked uint64
+	// CompletionsDropped counts the completions dropped because the Completions
+	// channel was full
+	CompletionsDropped uint64
+	// Processed counts the action runs that finished, whatever their outcome
+	Processed uint64
+	// Running is the number of action runs in flight
+	Running int
+	// Queued is the number of action runs waiting in the queues for concurrency slots
+	Queued int
+	// Actions holds the runs in flight and queued of each action that has any
+	Actions map[ActionKey]ActionStats
+	// DropReasons counts the drops by reason, like Engine.DropReasons
+	DropReasons map[string]int
+}
+
+// ActionStats is a snapshot of the runs of an action.
+type ActionStats struct {
+	// Running is the number of runs of the action in flight
+	Running int
+	// Queued is the number of runs of the action waiting in its queue for concurrency slots
+	Queued int
+}
+
+// Reasons for dropping events and actions, as reported by Engine.DropReasons.
+const (
+	// DropReasonNoHandler counts events sent without any action registered
+	DropReasonNoHandler = "no_handler"
+	// DropReasonMaxDepth counts actions of events sent deeper than the max depth
+	DropReasonMaxDepth = "max_depth"
+	// DropReasonUnknownAction counts triggered actions that aren't configured
+	DropReasonUnknownAction = "unknown_action"
+	// DropReasonConcurrencyLimit counts actions that didn't get a concurrency slot
+	DropReasonConcurrencyLimit = "concurrency_limit"
+	// DropReasonKeyError counts actions whose concurrency key function failed
+	DropReasonKeyError = "key_error"
+	// DropReasonKeyCap counts actions whose concurrency key couldn't be tracked
+	DropReasonKeyCap = "key_cap"
+	// DropReasonDeadlinePassed counts actions whose event deadline passed before they ran
+	DropReasonDeadlinePassed = "deadline_passed"
+	// DropReasonWorkerSaturated counts actions that didn't get a worker, see WithWorkerCap
+	DropReasonWorkerSaturated = "worker_saturated"
+	// DropReasonShutdown counts events sent once the engine is shutting down
+	DropReasonShutdown = "shutdown"
+	// DropReasonQueueFull counts actions that didn't fit in the queue of their action
+	DropReasonQueueFull = "queue_full"
+	// DropReasonFanOutStopped counts actions left out after a failure, see FanOutStopOnError
+	DropReasonFanOutStopped = "fan_out_stopped"
+	// DropReasonThrottled counts actions over the rate of their Throttle
+	DropReasonThrottled = "throttled"
+	// DropReasonRemoved counts queued actions dropped because the action was removed or
+	// registered again without a queue
+	DropReasonRemoved = "removed"
+	// DropReasonRateLimited counts actions over the rate of one of their RateLimitGroups
+	DropReasonRateLimited = "rate_limited"
+	// DropReasonPaused counts events rejected while paused, see WithPauseBuffer
+	DropReasonPaused = "paused"
+	// DropReasonDuplicate counts events sent while another one with their dedup key was
+	// in flight, see WithDedupKey
+	DropReasonDuplicate = "duplicate"
+)
+
+// engineStats holds the engine counters, updated alongside the operation logs.
+type engineStats struct {
+	sends      atomic.Uint64
+	dispatched atomic.Uint64
+	dropped    atomic.Uint64
+	skipped    atomic.Uint64
+	debounced  atomic.Uint64
+	failed     atomic.Uint64
+	panicked   atomic.Uint64
+	// completionsDropped counts the completions not published on the full channel
+	completionsDropped atomic.Uint64
+	processed          atomic.Uint64
+	// dropReasons counts the drops by reason
+	dropReasons   map[string]int
+	dropReasonsMu sync.Mutex
+}
+
+// addDropReason counts drops for the reason.
+func (s *engineStats) addDropReason(reason string, count int) {
+	s.dropReasonsMu.Lock()
+	defer s.dropReasonsMu.Unlock()
+
+	if s.dropReasons == nil {
+		s.dropReasons = make(map[string]int)
+	}
+	s.dropReasons[reason] += count
+}
+
+// drop counts dropped actions for the reason.
+func (e *Engine) drop(reason string, actions int) {
+	e.stats.dropped.Add(uint64(actions))
+	e.stats.addDropReason(reason, actions)
+}
+
+// DropReasons returns how many events or actions were dropped, by reason. Events sent
+// without any action, once shutting down, while a duplicate is in flight or while paused
+// count under DropReasonNoHandler, DropReasonShutdown, DropReasonDuplicate and
+// DropReasonPaused, the other reasons count actions, like the Dropped stat.
+func (e *Engine) DropReasons() map[string]int {
+	e.stats.dropReasonsMu.Lock()
+	defer e.stats.dropReasonsMu.Unlock()
+
+	reasons := make(map[string]int, len(e.stats.dropReasons))
+	maps.Copy(reasons, e.stats.dropReasons)
+
+	return reasons
+}
+
+// Stats returns the current counters of the engine, along with the runs in flight and
+// queued, for exporting the health of the engine. The counters and the runs are read one
+// after the other, so they may be slightly off from each other while events are sent.
+func (e *Engine) Stats() EngineStats {
+	stats := EngineStats{
+		Sends:              e.stats.sends.Load(),
+		Dispatched:         e.stats.dispatched.Load(),
+		Dropped:            e.stats.dropped.Load(),
+		Skipped:            e.stats.skipped.Load(),
+		Debounced:          e.stats.debounced.Load(),
+		Failed:             e.stats.failed.Load(),
+		Panicked:           e.stats.panicked.Load(),
+		CompletionsDropped: e.stats.completionsDropped.Load(),
+		Processed:          e.stats.processed.Load(),
+		Actions:            make(map[ActionKey]ActionStats),
+		DropReasons:        e.DropReasons(),
+	}
+
+	e.runningMu.Lock()
+	for key, count := range e.running {
+		if key.key == "" {
+			action := stats.Actions[key.actionKey]
+			action.Running = count
+			stats.Actions[key.actionKey] = action
+			stats.Running += count
+		}
+	}
+	e.runningMu.Unlock()
+
+	e.registryMu.RLock()
+	queues := maps.Clone(e.queues)
+	e.registryMu.RUnlock()
+
+	for actionKey, queue := range queues {
+		queue.mu.Lock()
+		queued := queue.runs.Len()
+		queue.mu.Unlock()
+
+		if queued > 0 {
+			action := stats.Actions[actionKey]
+			action.Queued = queued
+			stats.Actions[actionKey] = action
+			stats.Queued += queued
+		}
+	}
+
+	return stats
+}
+
+// heartbeat schedules the periodic heartbeat log on the engine clock.
+type heartbeat struct {
+	// interval between heartbeats, zero disables them
+	interval time.Duration
+	started  bool
+	stopped  bool
+	timer    Timer
+	mu       sync.Mutex
+}
+
+// StartHeartbeat starts logging heartbeats when WithHeartbeat is set. It does nothing if
+// the heartbeat already started or was stopped by Close.
+func (e *Engine) StartHeartbeat() {
+	e.heartbeat.mu.Lock()
+	defer e.heartbeat.mu.Unlock()
+
+	if e.heartbeat.interval <= 0 || e.heartbeat.started {
+		return
+	}
+
+	e.heartbeat.started = true
+	e.scheduleHeartbeat()
+}
+
+// scheduleHeartbeat schedules the next heartbeat unless the heartbeat was stopped.
+// The caller must hold the heartbeat lock.
+func (e *Engine) scheduleHeartbeat() {
+	if e.heartbeat.stopped {
+		return
+	}
+
+	e.heartbeat.timer = e.clock.AfterFunc(e.heartbeat.interval, func() {
+		// Log engine heartbeat
+		e.logOperation(context.Background(), "waffle.engine.heartbeat", map[string]string{
+			"inFlight":   strconv.Itoa(e.inFlight()),
+			"dispatched": strconv.FormatUint(e.stats.dispatched.Load(), 10),
+		})
+
+		e.heartbeat.mu.Lock()
+		defer e.heartbeat.mu.Unlock()
+		e.scheduleHeartbeat()
+	})
+}
+
+// stopHeartbeat stops logging heartbeats for good.
+func (e *Engine) stopHeartbeat() {
+	e.heartbeat.mu.Lock()
+	defer e.heartbeat.mu.Unlock()
+
+	e.heartbeat.stopped = true
+	if e.heartbeat.timer != nil {
+		e.heartbeat.timer.Stop()
+	}
+}
+
+// inFlight returns the number of in-flight action invocations.
+func (e *Engine) inFlight() int {
+	e.runningMu.Lock()
+	defer e.runningMu.Unlock()
+
+	inFlight := 0
+	for key, count := range e.running {
+		if key.key == "" {
+			inFlight += count
+		}
+	}
+
+	return inFlight
+}
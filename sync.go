@@ -0,0 +1,130 @@
+package waffle
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrStop is returned by an action run by SendSync to stop the actions after it from
+	// running. It isn't treated as a failure, neither by SendSync nor by Send.
+	ErrStop = errors.New("stop dispatch")
+
+	// ErrDropped is the error of an action that SendSync or SendAwait couldn't run because
+	// it wasn't admitted, e.g. by its concurrency limits.
+	ErrDropped = errors.New("action dropped")
+)
+
+// ActionResult is the outcome of an action run by SendSync or awaited with SendAwait.
+type ActionResult struct {
+	ActionKey ActionKey
+	// Err is the error returned by the action, ErrDropped when it didn't run. It is nil
+	// when the action returned ErrStop or was skipped by its When predicate
+	Err error
+	// Duration is how long the action ran
+	Duration time.Duration
+}
+
+// SendSync sends an event like Send but runs the actions one after the other on the
+// calling goroutine, in the order they are triggered, and returns their results along
+// with their errors joined. Actions dropped by their concurrency limits are reported with
+// ErrDropped. Failed actions aren't retried. An action returning ErrStop stops the actions
+// after it from running, without failing. It returns no results if no action is
+// registered for the event or the event was sent deeper than the configured max depth.
+// Events matching a mounted engine are run by it, like with Send. Once the engine is
+// shutting down, it returns ErrShutdown, and paused events return ErrPaused.
+func (e *Engine) SendSync(ctx context.Context, eventKey EventKey, data any) ([]ActionResult, error) {
+	if e.rejectShutdown(ctx, eventKey) {
+		return nil, ErrShutdown
+	}
+
+	eventKey = e.route(ctx, eventKey, data)
+	if sub, subKey, ok := e.mountFor(ctx, eventKey); ok {
+		if results, err := sub.SendSync(ctx, subKey, data); len(results) > 0 {
+			return results, err
+		}
+	}
+
+	if e.Paused(eventKey) {
+		return nil, ErrPaused
+	}
+
+	// Synchronous events aren't stored, awaited or deduplicated, don't let them settle an
+	// outer dispatch
+	ctx = context.WithValue(ctx, storedDispatchKey{}, (*storedDispatch)(nil))
+	ctx = withSendHandle(ctx, nil)
+	ctx = withFanOut(ctx, nil)
+	ctx = withHeaders(ctx, nil)
+	ctx, _ = e.claimDedup(ctx, eventKey, "")
+	ctx, actionKeys := e.dispatch(ctx, eventKey, data)
+	if len(actionKeys) == 0 {
+		return nil, nil
+	}
+
+	results := make([]ActionResult, 0, len(actionKeys))
+	errs := make([]error, 0)
+	admitted := false
+	for _, actionKey := range actionKeys {
+		configuration, actionData, release, status := e.admitAction(ctx, actionKey, data, eventKey, sendOptions{synchronous: true})
+		if status == admissionSkipped {
+			admitted = true
+			results = append(results, ActionResult{ActionKey: actionKey})
+			continue
+		}
+
+		if status != admissionAdmitted {
+			results = append(results, ActionResult{ActionKey: actionKey, Err: ErrDropped})
+			errs = append(errs, ErrDropped)
+			continue
+		}
+
+		admitted = true
+		if e.dryRunAction(ctx, actionKey, eventKey, release) {
+			results = append(results, ActionResult{ActionKey: actionKey})
+			continue
+		}
+
+		e.stats.dispatched.Add(1)
+		actionCtx := ctx
+		if configuration.Detached {
+			actionCtx = context.WithoutCancel(ctx)
+		}
+		result := e.runActionSync(actionCtx, configuration, actionData, eventKey, release)
+		results = append(results, result)
+
+		if errors.Is(result.Err, ErrStop) {
+			results[len(results)-1].Err = nil
+			break
+		}
+
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+		}
+	}
+
+	if !admitted {
+		e.runFallback(ctx, eventKey, data)
+	}
+
+	return results, errors.Join(errs...)
+}
+
+// runActionSync runs an admitted action on the calling goroutine and logs its outcome,
+// releasing its concurrency slots once it returns. A panic is reported as an error.
+func (e *Engine) runActionSync(ctx context.Context, configuration ActionConfiguration, data any, eventKey EventKey, release func()) ActionResult {
+	defer release()
+
+	recovered, duration, err := e.executeAction(ctx, configuration, data, eventKey)
+	e.logOutcome(ctx, configuration.ActionKey, eventKey, data, recovered, err, duration)
+
+	if recovered != nil {
+		err = panicError(recovered)
+	}
+
+	return ActionResult{
+		ActionKey: configuration.ActionKey,
+		Err:       err,
+		Duration:  duration,
+	}
+}
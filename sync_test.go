@@ -0,0 +1,85 @@
+package waffle_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_SendSync(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	failure := errors.New("failed")
+	ran := make([]string, 0)
+	action := func(name string, err error) waffle.Action {
+		return func(_ context.Context, data any) error {
+			ran = append(ran, name+":"+data.(string))
+			return err
+		}
+	}
+
+	require.NoError(t, engine.On("event").Do("first", action("first", nil)))
+	require.NoError(t, engine.On("event").Do("second", action("second", failure)))
+
+	results, err := engine.SendSync(t.Context(), "event", "payload")
+	require.ErrorIs(t, err, failure)
+	require.Equal(t, []string{"first:payload", "second:payload"}, ran)
+	require.Len(t, results, 2)
+	require.Equal(t, waffle.ActionKey("first"), results[0].ActionKey)
+	require.NoError(t, results[0].Err)
+	require.Equal(t, waffle.ActionKey("second"), results[1].ActionKey)
+	require.ErrorIs(t, results[1].Err, failure)
+
+	logger.AssertEventLoggedTimes(t, "waffle.action.finished", 1)
+	logger.AssertEventLoggedTimes(t, "waffle.action.failed", 1)
+
+	results, err = engine.SendSync(t.Context(), "unknown", nil)
+	require.NoError(t, err)
+	require.Empty(t, results)
+}
+
+func TestEngine_SendSync_ErrStop(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger)
+
+	ran := make([]string, 0)
+	action := func(name string, err error) waffle.Action {
+		return func(_ context.Context, _ any) error {
+			ran = append(ran, name)
+			return err
+		}
+	}
+
+	require.NoError(t, engine.On("event").Do("first", action("first", nil)))
+	require.NoError(t, engine.On("event").Do("gate", action("gate", waffle.ErrStop)))
+	require.NoError(t, engine.On("event").Do("third", action("third", nil)))
+
+	results, err := engine.SendSync(t.Context(), "event", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"first", "gate"}, ran)
+	require.Len(t, results, 2)
+	require.NoError(t, results[1].Err)
+
+	logger.AssertEventNotLogged(t, "waffle.action.failed")
+	logger.AssertEventLoggedTimes(t, "waffle.action.finished", 2)
+}
+
+func TestEngine_SendSync_Dropped(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	require.NoError(t, engine.On("event").Concurrency(1).Do("action", func(ctx context.Context, _ any) error {
+		// The action is still holding its slot when it sends the event again
+		results, err := engine.SendSync(ctx, "event", nil)
+		require.ErrorIs(t, err, waffle.ErrDropped)
+		require.Len(t, results, 1)
+		return nil
+	}))
+
+	results, err := engine.SendSync(t.Context(), "event", nil)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+}
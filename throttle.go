@@ -0,0 +1,72 @@
+package waffle
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Throttle limits how often an action runs per key, allowing at most a number of runs
+// within any window of time. Unlike concurrency limits, it bounds the rate of the runs
+// rather than how many run at once. A Throttle may be shared by several actions.
+type Throttle struct {
+	limit   int
+	per     time.Duration
+	keyFunc func(ctx context.Context, data any) string
+	// runs holds the start times of the runs within the window, by key, oldest first
+	runs      map[string][]time.Time
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+// NewThrottle creates a throttle allowing limit runs per key within any window of per.
+// A nil key function throttles all the runs together.
+func NewThrottle(limit int, per time.Duration, keyFunc func(ctx context.Context, data any) string) *Throttle {
+	return &Throttle{
+		limit:   limit,
+		per:     per,
+		keyFunc: keyFunc,
+		runs:    make(map[string][]time.Time),
+	}
+}
+
+// allow records a run at now for the key of the data, returning false when the key
+// already ran limit times within the window.
+func (t *Throttle) allow(ctx context.Context, data any, now time.Time) bool {
+	key := ""
+	if t.keyFunc != nil {
+		key = t.keyFunc(ctx, data)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sweep(now)
+
+	runs := t.runs[key]
+	for len(runs) > 0 && !runs[0].After(now.Add(-t.per)) {
+		runs = runs[1:]
+	}
+
+	if len(runs) >= t.limit {
+		t.runs[key] = runs
+		return false
+	}
+	t.runs[key] = append(runs, now)
+
+	return true
+}
+
+// sweep forgets the keys without runs within the window, at most once per window.
+func (t *Throttle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.per {
+		return
+	}
+	t.lastSweep = now
+
+	for key, runs := range t.runs {
+		if len(runs) == 0 || !runs[len(runs)-1].After(now.Add(-t.per)) {
+			delete(t.runs, key)
+		}
+	}
+}
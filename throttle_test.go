@@ -0,0 +1,64 @@
+package waffle_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_Throttle(t *testing.T) {
+	clock := waffle.NewTestClock(time.Now())
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithClock(clock))
+
+	type alert struct {
+		host string
+		seq  int
+	}
+
+	err := engine.On("alert").
+		Throttle(2, time.Minute, func(_ context.Context, data any) string { return data.(alert).host }).
+		Do("page", func(context.Context, any) error { return nil })
+	require.NoError(t, err)
+
+	page := func(host string, seq int) bool {
+		results, err := engine.SendSync(t.Context(), "alert", alert{host: host, seq: seq})
+		require.Len(t, results, 1)
+		return err == nil
+	}
+
+	require.True(t, page("db", 1))
+	clock.Advance(30 * time.Second)
+	require.True(t, page("db", 2))
+	require.False(t, page("db", 3))
+	// Each key has its own rate
+	require.True(t, page("web", 1))
+
+	// The window slides, the first run leaves it after a minute
+	clock.Advance(30 * time.Second)
+	require.True(t, page("db", 4))
+	require.False(t, page("db", 5))
+
+	require.Equal(t, 2, engine.DropReasons()[waffle.DropReasonThrottled])
+	logger.AssertEventLoggedTimes(t, "waffle.action.throttled", 2)
+}
+
+func TestActionBuilder_InvalidThrottle(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+	keyFunc := func(context.Context, any) string { return "" }
+
+	err := engine.On("test").Throttle(0, time.Second, keyFunc).Do("test", func(context.Context, any) error { return nil })
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Throttle: n must be positive")
+
+	err = engine.On("test").Throttle(1, 0, keyFunc).Do("test", func(context.Context, any) error { return nil })
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Throttle: per must be positive")
+
+	err = engine.On("test").Throttle(1, time.Second, nil).Do("test", func(context.Context, any) error { return nil })
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Throttle: keyFunc must be provided")
+}
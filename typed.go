@@ -0,0 +1,105 @@
+package waffle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrUnexpectedData is the error of a typed action sent data of another type, see OnTyped.
+var ErrUnexpectedData = errors.New("unexpected event data type")
+
+// TypedActionBuilder builds actions whose event data is of type T, see OnTyped.
+type TypedActionBuilder[T any] struct {
+	builder *ActionBuilder
+}
+
+// OnTyped registers an action for the given event keys like Engine.On, with handlers and
+// key functions receiving the event data as a T instead of any. Data of another type fails
+// the action with ErrUnexpectedData, nil data is passed as the zero T.
+func OnTyped[T any](engine *Engine, eventKeys ...EventKey) *TypedActionBuilder[T] {
+	return &TypedActionBuilder[T]{builder: engine.On(eventKeys...)}
+}
+
+// Configure applies the options that don't depend on the data type, e.g. Timeout or
+// Concurrency, to the underlying builder.
+func (tb *TypedActionBuilder[T]) Configure(configure func(ab *ActionBuilder)) *TypedActionBuilder[T] {
+	configure(tb.builder)
+	return tb
+}
+
+// ConcurrencyGroup is like ActionBuilder.ConcurrencyGroup with a typed key function. Data
+// of another type drops the event for this action, like a failing key function.
+func (tb *TypedActionBuilder[T]) ConcurrencyGroup(groupName string, limit uint, keyFunc func(ctx context.Context, data T) string) *TypedActionBuilder[T] {
+	if keyFunc == nil {
+		tb.builder.ConcurrencyGroupE(groupName, limit, nil)
+		return tb
+	}
+
+	tb.builder.ConcurrencyGroupE(groupName, limit, func(ctx context.Context, data any) (string, error) {
+		typed, err := typedData[T](data)
+		if err != nil {
+			return "", err
+		}
+		return keyFunc(ctx, typed), nil
+	})
+
+	return tb
+}
+
+// When is like ActionBuilder.When with a typed predicate. Data of another type skips the
+// action.
+func (tb *TypedActionBuilder[T]) When(predicate func(ctx context.Context, data T) bool) *TypedActionBuilder[T] {
+	if predicate == nil {
+		tb.builder.When(nil)
+		return tb
+	}
+
+	tb.builder.When(func(ctx context.Context, data any) bool {
+		typed, err := typedData[T](data)
+		return err == nil && predicate(ctx, typed)
+	})
+
+	return tb
+}
+
+// Do registers the typed action for all the event keys, like ActionBuilder.Do.
+func (tb *TypedActionBuilder[T]) Do(actionKey ActionKey, action func(ctx context.Context, data T) error) error {
+	return tb.builder.Do(actionKey, typedAction(action))
+}
+
+// MustDo is like Do but panics when the action can't be registered.
+func (tb *TypedActionBuilder[T]) MustDo(actionKey ActionKey, action func(ctx context.Context, data T) error) {
+	tb.builder.MustDo(actionKey, typedAction(action))
+}
+
+// typedAction adapts a typed action to an Action, leaving a nil action nil for the
+// builder to report.
+func typedAction[T any](action func(ctx context.Context, data T) error) Action {
+	if action == nil {
+		return nil
+	}
+
+	return func(ctx context.Context, data any) error {
+		typed, err := typedData[T](data)
+		if err != nil {
+			return err
+		}
+		return action(ctx, typed)
+	}
+}
+
+// typedData returns the data as a T, the zero T for nil data.
+func typedData[T any](data any) (T, error) {
+	if data == nil {
+		var zero T
+		return zero, nil
+	}
+
+	typed, ok := data.(T)
+	if !ok {
+		return typed, fmt.Errorf("%w: got %T, want %T", ErrUnexpectedData, data, typed)
+	}
+
+	return typed, nil
+}
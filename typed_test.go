@@ -0,0 +1,74 @@
+package waffle_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOnTyped(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	type order struct {
+		ID       string
+		Customer string
+		Total    int
+	}
+
+	ran := make(chan order, 2)
+	err := waffle.OnTyped[order](engine, "order.created").
+		Configure(func(ab *waffle.ActionBuilder) { ab.Timeout(time.Second) }).
+		ConcurrencyGroup("customer", 1, func(_ context.Context, o order) string { return o.Customer }).
+		When(func(_ context.Context, o order) bool { return o.Total > 0 }).
+		Do("invoice", func(_ context.Context, o order) error {
+			ran <- o
+			return nil
+		})
+	require.NoError(t, err)
+
+	results, err := engine.SendSync(t.Context(), "order.created", order{ID: "1", Customer: "ada", Total: 10})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Equal(t, order{ID: "1", Customer: "ada", Total: 10}, <-ran)
+
+	// Filtered by the typed predicate
+	_, err = engine.SendSync(t.Context(), "order.created", order{ID: "2", Customer: "ada"})
+	require.NoError(t, err)
+	require.Empty(t, ran)
+
+	// Data of another type skips the action
+	_, err = engine.SendSync(t.Context(), "order.created", "not an order")
+	require.NoError(t, err)
+	require.Empty(t, ran)
+}
+
+func TestOnTyped_UnexpectedData(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	var got *int
+	waffle.OnTyped[*int](engine, "count").MustDo("store", func(_ context.Context, n *int) error {
+		got = n
+		return nil
+	})
+
+	_, err := engine.SendSync(t.Context(), "count", "one")
+	require.ErrorIs(t, err, waffle.ErrUnexpectedData)
+	require.EqualError(t, err, "unexpected event data type: got string, want *int")
+
+	// Nil data is passed as the zero value
+	_, err = engine.SendSync(t.Context(), "count", nil)
+	require.NoError(t, err)
+	require.Nil(t, got)
+}
+
+func TestOnTyped_InvalidParams(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	err := waffle.OnTyped[string](engine, "test").When(nil).Do("test", nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "When: predicate must be provided")
+	require.Contains(t, err.Error(), "Do: action must be provided")
+}
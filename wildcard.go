@@ -0,0 +1,93 @@
+package waffle
+
+import (
+	"slices"
+	"strings"
+)
+
+const (
+	// wildcardSegment matches exactly one segment of an event key, e.g. "user.*"
+	wildcardSegment = "*"
+	// wildcardSegments matches zero or more segments of an event key, e.g. "order.#"
+	wildcardSegments = "#"
+)
+
+// wildcard is an event key pattern with its segments split up front, so that matching
+// an event key at send time doesn't parse the pattern again.
+type wildcard struct {
+	eventKey EventKey
+	segments []string
+}
+
+// segmentSeparator returns the separator of the event key segments: the hierarchy
+// separator when hierarchy is enabled, "." otherwise.
+func (e *Engine) segmentSeparator() string {
+	if e.hierarchySeparator != "" {
+		return e.hierarchySeparator
+	}
+
+	return "."
+}
+
+// addTrigger makes the event trigger the actions, tracking the event key as a wildcard
+// when one of its segments is "*" or "#".
+func (e *Engine) addTrigger(eventKey EventKey, actionKeys ...ActionKey) {
+	if _, ok := e.triggers[eventKey]; !ok {
+		segments := strings.Split(string(eventKey), e.segmentSeparator())
+		if slices.Contains(segments, wildcardSegment) || slices.Contains(segments, wildcardSegments) {
+			e.wildcards = append(slices.Clip(e.wildcards), wildcard{eventKey: eventKey, segments: segments})
+		}
+	}
+
+	// Clip so that dispatches reading the previous triggers never share their array
+	e.triggers[eventKey] = append(slices.Clip(e.triggers[eventKey]), actionKeys...)
+}
+
+// removeTrigger removes the action from the triggers of the event. The actions are
+// copied since dispatches may still be reading them.
+func (e *Engine) removeTrigger(eventKey EventKey, actionKey ActionKey) {
+	actionKeys := slices.DeleteFunc(slices.Clone(e.triggers[eventKey]), func(key ActionKey) bool {
+		return key == actionKey
+	})
+	if len(actionKeys) > 0 {
+		e.triggers[eventKey] = actionKeys
+		return
+	}
+
+	delete(e.triggers, eventKey)
+	e.wildcards = slices.DeleteFunc(slices.Clone(e.wildcards), func(w wildcard) bool {
+		return w.eventKey == eventKey
+	})
+}
+
+// matchSegments reports whether the segments of an event key match the segments of a
+// wildcard pattern.
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case wildcardSegments:
+			// Try every number of segments, the trailing "#" matches the rest at once
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := range len(segments) + 1 {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		case wildcardSegment:
+			if len(segments) == 0 {
+				return false
+			}
+		default:
+			if len(segments) == 0 || segments[0] != pattern[0] {
+				return false
+			}
+		}
+
+		pattern, segments = pattern[1:], segments[1:]
+	}
+
+	return len(segments) == 0
+}
@@ -0,0 +1,107 @@
+package waffle_test
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_Wildcard(t *testing.T) {
+	tests := []struct {
+		name      string
+		pattern   waffle.EventKey
+		opts      []waffle.EngineOption
+		matched   []waffle.EventKey
+		unmatched []waffle.EventKey
+	}{
+		{
+			name:      "single segment",
+			pattern:   "user.*",
+			matched:   []waffle.EventKey{"user.created", "user.deleted"},
+			unmatched: []waffle.EventKey{"user", "user.profile.updated", "order.created"},
+		},
+		{
+			name:      "inner single segment",
+			pattern:   "user.*.updated",
+			matched:   []waffle.EventKey{"user.profile.updated"},
+			unmatched: []waffle.EventKey{"user.updated", "user.profile.created"},
+		},
+		{
+			name:      "zero or more segments",
+			pattern:   "order.#",
+			matched:   []waffle.EventKey{"order", "order.created", "order.item.added"},
+			unmatched: []waffle.EventKey{"orders", "user.order"},
+		},
+		{
+			name:      "inner zero or more segments",
+			pattern:   "#.failed",
+			matched:   []waffle.EventKey{"failed", "payment.failed", "order.item.failed"},
+			unmatched: []waffle.EventKey{"payment.failed.retried"},
+		},
+		{
+			name:      "hierarchy separator",
+			pattern:   "user/*",
+			opts:      []waffle.EngineOption{waffle.WithHierarchy("/")},
+			matched:   []waffle.EventKey{"user/created"},
+			unmatched: []waffle.EventKey{"user.created"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := waffle.NewEngine(nil, tt.opts...)
+
+			var mu sync.Mutex
+			received := make([]waffle.EventKey, 0)
+			err := engine.On(tt.pattern).Do("audit", func(_ context.Context, data any) error {
+				mu.Lock()
+				defer mu.Unlock()
+				received = append(received, data.(waffle.EventKey))
+				return nil
+			})
+			require.NoError(t, err)
+
+			for _, eventKey := range tt.matched {
+				require.True(t, engine.Send(t.Context(), eventKey, eventKey), eventKey)
+			}
+			for _, eventKey := range tt.unmatched {
+				require.False(t, engine.Send(t.Context(), eventKey, eventKey), eventKey)
+			}
+			require.NoError(t, engine.Wait(t.Context()))
+
+			mu.Lock()
+			defer mu.Unlock()
+			slices.Sort(received)
+			require.Equal(t, slices.Sorted(slices.Values(tt.matched)), received)
+		})
+	}
+}
+
+func TestEngine_Wildcard_Off(t *testing.T) {
+	engine := waffle.NewEngine(nil)
+
+	for _, actionKey := range []waffle.ActionKey{"exact", "wildcard"} {
+		eventKey := waffle.EventKey("user.created")
+		if actionKey == "wildcard" {
+			eventKey = "user.*"
+		}
+		err := engine.On(eventKey).Do(actionKey, func(context.Context, any) error { return nil })
+		require.NoError(t, err)
+	}
+
+	// Exact triggers come before wildcards, each action runs once
+	engine.Trigger("user.*", "exact")
+	results, err := engine.SendSync(t.Context(), "user.created", nil)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Equal(t, waffle.ActionKey("exact"), results[0].ActionKey)
+	require.Equal(t, waffle.ActionKey("wildcard"), results[1].ActionKey)
+
+	require.True(t, engine.Off("user.*", "wildcard"))
+	require.True(t, engine.Off("user.*", "exact"))
+	require.False(t, engine.Send(t.Context(), "user.updated", nil))
+}
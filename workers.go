@@ -0,0 +1,193 @@
+package waffle
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WithWorkerCap caps how many actions run on their own goroutine at once, counting retries
+// but not inline actions. When all the workers are busy, spawning an action waits up to
+// wait for one to free up, on the goroutine sending the event, and then drops the action
+// and logs waffle.engine.worker_saturated. A wait of zero drops the action right away.
+func WithWorkerCap(workers uint, wait time.Duration) EngineOption {
+	return func(e *Engine) {
+		e.workers = make(chan struct{}, workers)
+		e.workerWait = wait
+	}
+}
+
+// acquireWorker takes a worker for an action about to run on its own goroutine, waiting
+// for one as configured, or until the context is done when blocking. It returns false when
+// the workers stayed saturated.
+func (e *Engine) acquireWorker(ctx context.Context, actionKey ActionKey, eventKey EventKey, block bool) bool {
+	if e.workers == nil {
+		return true
+	}
+
+	select {
+	case e.workers <- struct{}{}:
+		return true
+	default:
+	}
+
+	if block {
+		select {
+		case e.workers <- struct{}{}:
+			return true
+		case <-ctx.Done():
+		}
+	} else if e.workerWait > 0 {
+		expired := make(chan struct{})
+		timer := e.clock.AfterFunc(e.workerWait, func() {
+			close(expired)
+		})
+		defer timer.Stop()
+
+		select {
+		case e.workers <- struct{}{}:
+			return true
+		case <-expired:
+		case <-ctx.Done():
+		}
+	}
+
+	// Log worker saturated
+	e.logOperation(ctx, "waffle.engine.worker_saturated", map[string]string{
+		"actionKey": string(actionKey),
+		"eventKey":  string(eventKey),
+	})
+	e.drop(DropReasonWorkerSaturated, 1)
+
+	return false
+}
+
+// releaseWorker frees a worker taken by acquireWorker.
+func (e *Engine) releaseWorker() {
+	if e.workers != nil {
+		<-e.workers
+	}
+}
+
+// workerPool runs the actions on a fixed set of goroutines, taking them from a queue.
+type workerPool struct {
+	size  uint
+	jobs  chan func()
+	wait  time.Duration
+	start sync.Once
+	stop  chan struct{}
+	// stopped is set once the engine closed, running the actions on their own goroutine
+	stopped atomic.Bool
+}
+
+// WithWorkerPool runs the actions on a fixed pool of workers instead of a goroutine per
+// run, for producers sending more events than goroutines are worth spawning. Runs wait
+// for a worker in a queue of queueSize. When the queue is full, spawning an action waits
+// up to wait for room, on the goroutine sending the event, and then drops the action and
+// logs waffle.engine.worker_saturated. Inline actions don't use the pool. The workers
+// stop once the engine is closed.
+func WithWorkerPool(workers, queueSize uint, wait time.Duration) EngineOption {
+	return func(e *Engine) {
+		e.pool = &workerPool{
+			size: max(workers, 1),
+			jobs: make(chan func(), queueSize),
+			wait: wait,
+			stop: make(chan struct{}),
+		}
+	}
+}
+
+// submitToPool runs the action on the worker pool, or on its own goroutine without a
+// pool. It waits for room as configured, or until the context is done when blocking, and
+// returns false when the queue of the pool stayed full.
+func (e *Engine) submitToPool(ctx context.Context, actionKey ActionKey, eventKey EventKey, run func(), block bool) bool {
+	pool := e.pool
+	if pool == nil || pool.stopped.Load() {
+		go run()
+		return true
+	}
+
+	pool.start.Do(func() {
+		for range pool.size {
+			go pool.work()
+		}
+	})
+
+	select {
+	case pool.jobs <- run:
+		pool.drainStopped()
+		return true
+	default:
+	}
+
+	if block {
+		select {
+		case pool.jobs <- run:
+			pool.drainStopped()
+			return true
+		case <-ctx.Done():
+		}
+	} else if pool.wait > 0 {
+		expired := make(chan struct{})
+		timer := e.clock.AfterFunc(pool.wait, func() {
+			close(expired)
+		})
+		defer timer.Stop()
+
+		select {
+		case pool.jobs <- run:
+			pool.drainStopped()
+			return true
+		case <-expired:
+		case <-ctx.Done():
+		}
+	}
+
+	// Log worker saturated
+	e.logOperation(ctx, "waffle.engine.worker_saturated", map[string]string{
+		"actionKey": string(actionKey),
+		"eventKey":  string(eventKey),
+	})
+	e.drop(DropReasonWorkerSaturated, 1)
+
+	return false
+}
+
+// work runs the queued actions until the pool stops, then runs the ones left in the
+// queue on their own goroutine.
+func (p *workerPool) work() {
+	for {
+		select {
+		case run := <-p.jobs:
+			run()
+		case <-p.stop:
+			p.drainStopped()
+			return
+		}
+	}
+}
+
+// drainStopped runs the actions left in the queue on their own goroutine once the pool
+// stopped, including the ones queued while the workers were exiting.
+func (p *workerPool) drainStopped() {
+	if !p.stopped.Load() {
+		return
+	}
+
+	for {
+		select {
+		case run := <-p.jobs:
+			go run()
+		default:
+			return
+		}
+	}
+}
+
+// stopPool stops the workers of the pool, if any.
+func (e *Engine) stopPool() {
+	if e.pool != nil && e.pool.stopped.CompareAndSwap(false, true) {
+		close(e.pool.stop)
+	}
+}
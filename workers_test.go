@@ -0,0 +1,103 @@
+package waffle_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/doron-cohen/waffle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_WithWorkerCap(t *testing.T) {
+	t.Run("drop", func(t *testing.T) {
+		logger := waffle.NewTestOperationLogger()
+		engine := waffle.NewEngine(logger, waffle.WithWorkerCap(1, 0))
+
+		block := make(chan struct{})
+		defer close(block)
+		err := engine.On("event").Do("slow", func(_ context.Context, _ any) error {
+			<-block
+			return nil
+		})
+		require.NoError(t, err)
+
+		require.True(t, engine.Send(t.Context(), "event", nil))
+		require.True(t, engine.Send(t.Context(), "event", nil))
+
+		logger.AssertEventLoggedWithMetadata(t, "waffle.engine.worker_saturated", map[string]string{
+			"actionKey": "slow",
+			"eventKey":  "event",
+		})
+		require.Equal(t, 1, engine.DropReasons()[waffle.DropReasonWorkerSaturated])
+		require.Equal(t, uint64(1), engine.Stats().Dispatched)
+	})
+
+	t.Run("bounded wait", func(t *testing.T) {
+		logger := waffle.NewTestOperationLogger()
+		engine := waffle.NewEngine(logger, waffle.WithWorkerCap(1, time.Second))
+
+		ran := make(chan struct{}, 2)
+		err := engine.On("event").Do("slow", func(_ context.Context, _ any) error {
+			time.Sleep(20 * time.Millisecond)
+			ran <- struct{}{}
+			return nil
+		})
+		require.NoError(t, err)
+
+		// The second send waits for the first action to free its worker
+		require.True(t, engine.Send(t.Context(), "event", nil))
+		require.True(t, engine.Send(t.Context(), "event", nil))
+
+		for range 2 {
+			select {
+			case <-ran:
+			case <-time.After(time.Second):
+				t.Fatal("action was not run")
+			}
+		}
+		logger.AssertEventNotLogged(t, "waffle.engine.worker_saturated")
+	})
+}
+
+func TestEngine_WithWorkerPool(t *testing.T) {
+	logger := waffle.NewTestOperationLogger()
+	engine := waffle.NewEngine(logger, waffle.WithWorkerPool(2, 2, 0))
+
+	var running, peak atomic.Int32
+	block := make(chan struct{})
+	err := engine.On("event").Do("work", func(_ context.Context, _ any) error {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		<-block
+		running.Add(-1)
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Two runs take the workers, two wait in the queue and the last one is dropped
+	for range 2 {
+		require.True(t, engine.Send(t.Context(), "event", nil))
+	}
+	require.Eventually(t, func() bool { return running.Load() == 2 }, time.Second, time.Millisecond)
+	for range 3 {
+		require.True(t, engine.Send(t.Context(), "event", nil))
+	}
+	logger.AssertEventLoggedTimes(t, "waffle.engine.worker_saturated", 1)
+	require.Equal(t, 1, engine.DropReasons()[waffle.DropReasonWorkerSaturated])
+
+	close(block)
+	require.NoError(t, engine.Close(t.Context()))
+	require.Equal(t, int32(2), peak.Load())
+	require.Equal(t, uint64(4), engine.Stats().Dispatched)
+
+	// Once closed, actions run on their own goroutine
+	_, err = engine.SendAwait(t.Context(), "event", nil).Wait(t.Context())
+	require.NoError(t, err)
+}